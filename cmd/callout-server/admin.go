@@ -0,0 +1,32 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"time"
+)
+
+// serveAdmin serves operational endpoints on a separate HTTP port.
+func serveAdmin(port string, minter *tokenMinter) {
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           adminHandler(minter),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Printf("callout-server admin listening on :%s", port)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("admin server error: %v", err)
+	}
+}
+
+// adminHandler publishes metrics with expvar at /debug/vars and, when
+// internal tokens are minted, their public keys at jwksPath.
+func adminHandler(minter *tokenMinter) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	if minter != nil {
+		mux.HandleFunc("GET "+jwksPath, minter.serveJWKS)
+	}
+	return mux
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	defaultAPIKeyHeader = "x-api-key"
+	sha256HashPrefix    = "sha256:"
+	argon2idHashPrefix  = "$argon2id$"
+
+	// maxArgon2idMemory caps the m parameter (KiB) of stored hashes, since
+	// every request presenting the key id derives a key with it.
+	maxArgon2idMemory = 256 * 1024
+)
+
+var (
+	errMissingAPIKey     = errors.New("api key is missing")
+	errInvalidAPIKey     = errors.New("api key is invalid")
+	errExpiredAPIKey     = errors.New("api key is expired")
+	errAPIKeyRouteDenied = errors.New("api key is not allowed for this route")
+	errAPIKeyHostDenied  = errors.New("api key is not allowed for this host")
+)
+
+// apiKeyFile is the on-disk format of API_KEYS_FILE. Keys are never stored in
+// clear text: hash is either "sha256:<hex>" or an argon2id PHC string. Argon2id
+// keys must be presented as "<id>.<secret>" so the entry can be found without
+// hashing against every stored key. A key without tenants is accepted on every
+// tenant, the top-level policy included.
+type apiKeyFile struct {
+	Keys []apiKeyEntry `json:"keys"`
+}
+
+type apiKeyEntry struct {
+	ID        string     `json:"id"`
+	Hash      string     `json:"hash"`
+	Owner     string     `json:"owner"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Routes    []string   `json:"routes,omitempty"`
+	Tenants   []string   `json:"tenants,omitempty"`
+}
+
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+type apiKey struct {
+	entry  apiKeyEntry
+	argon2 *argon2idHash
+}
+
+type apiKeyStore struct {
+	keys     []*apiKey
+	bySHA256 map[[sha256.Size]byte]*apiKey
+	byID     map[string]*apiKey
+}
+
+func loadAPIKeyStore(path string) (*apiKeyStore, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file apiKeyFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parse API key file: %w", err)
+	}
+	return newAPIKeyStore(file.Keys)
+}
+
+func newAPIKeyStore(entries []apiKeyEntry) (*apiKeyStore, error) {
+	store := &apiKeyStore{
+		bySHA256: make(map[[sha256.Size]byte]*apiKey),
+		byID:     make(map[string]*apiKey),
+	}
+	for i, entry := range entries {
+		if entry.Owner == "" {
+			return nil, fmt.Errorf("key %d: owner is required", i)
+		}
+		key := &apiKey{entry: entry}
+		switch {
+		case strings.HasPrefix(entry.Hash, sha256HashPrefix):
+			digest, err := hex.DecodeString(strings.TrimPrefix(entry.Hash, sha256HashPrefix))
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("key %d: invalid sha256 hash", i)
+			}
+			store.bySHA256[[sha256.Size]byte(digest)] = key
+		case strings.HasPrefix(entry.Hash, argon2idHashPrefix):
+			if entry.ID == "" || strings.Contains(entry.ID, ".") {
+				return nil, fmt.Errorf("key %d: argon2id keys need an id without dots", i)
+			}
+			hash, err := parseArgon2idHash(entry.Hash)
+			if err != nil {
+				return nil, fmt.Errorf("key %d: %w", i, err)
+			}
+			key.argon2 = hash
+		default:
+			return nil, fmt.Errorf("key %d: unsupported hash format", i)
+		}
+		if entry.ID != "" {
+			if _, ok := store.byID[entry.ID]; ok {
+				return nil, fmt.Errorf("key %d: duplicate id %q", i, entry.ID)
+			}
+			store.byID[entry.ID] = key
+		}
+		store.keys = append(store.keys, key)
+	}
+	return store, nil
+}
+
+// parseArgon2idHash parses "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>" with
+// unpadded standard base64 salt and key, as produced by the reference CLI.
+func parseArgon2idHash(encoded string) (*argon2idHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2id version")
+	}
+	hash := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.memory, &hash.time, &hash.threads); err != nil {
+		return nil, errors.New("invalid argon2id parameters")
+	}
+	// argon2.IDKey panics when time or threads is below 1.
+	if hash.time < 1 || hash.threads < 1 {
+		return nil, errors.New("argon2id t and p must be at least 1")
+	}
+	if hash.memory > maxArgon2idMemory {
+		return nil, fmt.Errorf("argon2id m must be at most %d", maxArgon2idMemory)
+	}
+	var err error
+	if hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("invalid argon2id salt")
+	}
+	if hash.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(hash.key) == 0 {
+		return nil, errors.New("invalid argon2id key")
+	}
+	return hash, nil
+}
+
+func (h *argon2idHash) matches(secret string) bool {
+	derived := argon2.IDKey([]byte(secret), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(derived, h.key) == 1
+}
+
+func (s *apiKeyStore) lookup(presented string) *apiKey {
+	if key, ok := s.bySHA256[sha256.Sum256([]byte(presented))]; ok {
+		return key
+	}
+	id, _, ok := strings.Cut(presented, ".")
+	if !ok {
+		return nil
+	}
+	key, ok := s.byID[id]
+	if !ok || key.argon2 == nil || !key.argon2.matches(presented) {
+		return nil
+	}
+	return key
+}
+
+// checkTenants reports the first key that lists a tenant not in names.
+func (s *apiKeyStore) checkTenants(names map[string]bool) error {
+	for i, key := range s.keys {
+		for _, name := range key.entry.Tenants {
+			if !names[name] {
+				return fmt.Errorf("key %d: unknown tenant %q", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *apiKeyStore) authenticate(presented, tenant, path string, now time.Time) (*identity, error) {
+	key := s.lookup(presented)
+	if key == nil {
+		return nil, errInvalidAPIKey
+	}
+	if key.entry.ExpiresAt != nil && !now.Before(*key.entry.ExpiresAt) {
+		return nil, errExpiredAPIKey
+	}
+	if len(key.entry.Tenants) > 0 && !slices.Contains(key.entry.Tenants, tenant) {
+		return nil, errAPIKeyHostDenied
+	}
+	if !key.allowsPath(path) {
+		return nil, errAPIKeyRouteDenied
+	}
+	return &identity{subject: key.entry.Owner, scopes: key.entry.Scopes}, nil
+}
+
+func (k *apiKey) allowsPath(path string) bool {
+	if len(k.entry.Routes) == 0 {
+		return true
+	}
+	for _, prefix := range k.entry.Routes {
+		if hasPathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"golang.org/x/crypto/argon2"
+	"google.golang.org/grpc/codes"
+)
+
+// apiKeyTestNow is the time API key expiry is checked against.
+var apiKeyTestNow = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func sha256Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return sha256HashPrefix + hex.EncodeToString(sum[:])
+}
+
+// argon2idHashString hashes key with small parameters in the PHC format of
+// the reference CLI.
+func argon2idHashString(key string) string {
+	salt := []byte("0123456789abcdef")
+	derived := argon2.IDKey([]byte(key), salt, 1, 64, 1, 32)
+	b64 := base64.RawStdEncoding.EncodeToString
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version, b64(salt), b64(derived))
+}
+
+func newTestAPIKeyStore(t *testing.T) *apiKeyStore {
+	t.Helper()
+	expired := apiKeyTestNow
+	store, err := newAPIKeyStore([]apiKeyEntry{
+		{Hash: sha256Hash("plain-key"), Owner: "ci", Scopes: []string{"read", "write"}},
+		{ID: "batch", Hash: argon2idHashString("batch.s3cret"), Owner: "batch"},
+		{Hash: sha256Hash("old-key"), Owner: "old", ExpiresAt: &expired},
+		{Hash: sha256Hash("reports-key"), Owner: "reports", Routes: []string{"/reports/", "/exports"}},
+	})
+	if err != nil {
+		t.Fatalf("newAPIKeyStore: %v", err)
+	}
+	return store
+}
+
+func TestAPIKeyAuthenticate(t *testing.T) {
+	store := newTestAPIKeyStore(t)
+	tests := []struct {
+		name       string
+		key        string
+		path       string
+		wantErr    error
+		wantOwner  string
+		wantScopes []string
+	}{
+		{name: "sha256", key: "plain-key", path: "/", wantOwner: "ci", wantScopes: []string{"read", "write"}},
+		{name: "argon2id", key: "batch.s3cret", path: "/", wantOwner: "batch"},
+		{name: "argon2id wrong secret", key: "batch.other", path: "/", wantErr: errInvalidAPIKey},
+		{name: "argon2id unknown id", key: "nightly.s3cret", path: "/", wantErr: errInvalidAPIKey},
+		{name: "argon2id without id", key: "s3cret", path: "/", wantErr: errInvalidAPIKey},
+		{name: "unknown", key: "other-key", path: "/", wantErr: errInvalidAPIKey},
+		{name: "expired", key: "old-key", path: "/", wantErr: errExpiredAPIKey},
+		{name: "route prefix", key: "reports-key", path: "/reports/2026", wantOwner: "reports"},
+		{name: "second route prefix", key: "reports-key", path: "/exports/all", wantOwner: "reports"},
+		{name: "exact route prefix", key: "reports-key", path: "/exports", wantOwner: "reports"},
+		{name: "route denied", key: "reports-key", path: "/admin", wantErr: errAPIKeyRouteDenied},
+		{name: "route prefix within segment", key: "reports-key", path: "/exportsx", wantErr: errAPIKeyRouteDenied},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			id, err := store.authenticate(tc.key, defaultTenantName, tc.path, apiKeyTestNow)
+			if tc.wantErr != nil {
+				if err != tc.wantErr {
+					t.Fatalf("authenticate = %v, %v; want %v", id, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticate: %v", err)
+			}
+			if id.subject != tc.wantOwner || !slices.Equal(id.scopes, tc.wantScopes) {
+				t.Errorf("identity = %+v, want %s %v", id, tc.wantOwner, tc.wantScopes)
+			}
+		})
+	}
+}
+
+func TestAPIKeyStoreRejectsEntries(t *testing.T) {
+	for name, entry := range map[string]apiKeyEntry{
+		"missing owner":    {Hash: sha256Hash("k")},
+		"short sha256":     {Hash: sha256HashPrefix + "abcd", Owner: "o"},
+		"unknown format":   {Hash: "md5:abcd", Owner: "o"},
+		"argon2id no id":   {Hash: argon2idHashString("k"), Owner: "o"},
+		"argon2id dot id":  {ID: "a.b", Hash: argon2idHashString("k"), Owner: "o"},
+		"argon2id invalid": {ID: "a", Hash: "$argon2id$v=19$m=64$salt$key", Owner: "o"},
+		"argon2id t=0":     {ID: "a", Hash: "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5", Owner: "o"},
+		"argon2id p=0":     {ID: "a", Hash: "$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$a2V5", Owner: "o"},
+		"argon2id huge m":  {ID: "a", Hash: "$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdHNhbHQ$a2V5", Owner: "o"},
+	} {
+		if _, err := newAPIKeyStore([]apiKeyEntry{entry}); err == nil {
+			t.Errorf("%s: newAPIKeyStore succeeded, want error", name)
+		}
+	}
+}
+
+func TestAPIKeyIdentityHeaders(t *testing.T) {
+	server, err := newCalloutServer(serverConfig{apiKeys: newTestAPIKeyStore(t)})
+	if err != nil {
+		t.Fatalf("newCalloutServer: %v", err)
+	}
+	for key, wantScopes := range map[string]string{"plain-key": "read write", "batch.s3cret": ""} {
+		resp, err := server.Check(context.Background(), &auth.CheckRequest{
+			Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+				Http: &auth.AttributeContext_HttpRequest{Path: "/", HeaderMap: &core.HeaderMap{Headers: []*core.HeaderValue{
+					{Key: defaultAPIKeyHeader, Value: key},
+					{Key: headerScopes, Value: "admin"},
+				}}},
+			}},
+		})
+		if err != nil || resp.GetStatus().GetCode() != int32(codes.OK) {
+			t.Fatalf("%s: Check = %v, %v; want OK", key, resp.GetStatus(), err)
+		}
+		var scopes string
+		for _, h := range resp.GetOkResponse().GetHeaders() {
+			if h.GetHeader().GetKey() == headerScopes {
+				scopes = h.GetHeader().GetValue()
+			}
+		}
+		if scopes != wantScopes {
+			t.Errorf("%s: %s = %q, want %q", key, headerScopes, scopes, wantScopes)
+		}
+		// A key without scopes strips the client-supplied x-scopes.
+		if removed := slices.Contains(resp.GetOkResponse().GetHeadersToRemove(), headerScopes); removed != (wantScopes == "") {
+			t.Errorf("%s: headers to remove = %v", key, resp.GetOkResponse().GetHeadersToRemove())
+		}
+	}
+}
+
+func TestNonCanonicalPathsDenied(t *testing.T) {
+	server := newAPIKeyServer(t)
+	for path, wantCode := range map[string]codes.Code{
+		"/reports/2026?format=csv": codes.OK,
+		"/reports/%32026":          codes.OK,
+		"/admin?next=/reports/":    codes.PermissionDenied,
+		"/reports/../admin":        codes.PermissionDenied,
+		"/reports/%2e%2e/admin":    codes.PermissionDenied,
+		"/reports/%2E%2E/admin":    codes.PermissionDenied,
+		"/reports%2fadmin":         codes.PermissionDenied,
+		"/reports/%5c..%5cadmin":   codes.PermissionDenied,
+		"/reports//admin":          codes.PermissionDenied,
+		"/reports/./2026":          codes.PermissionDenied,
+		"/reports/%zz":             codes.PermissionDenied,
+	} {
+		resp, err := server.Check(context.Background(), &auth.CheckRequest{
+			Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+				Http: &auth.AttributeContext_HttpRequest{Path: path, HeaderMap: &core.HeaderMap{Headers: []*core.HeaderValue{
+					{Key: defaultAPIKeyHeader, Value: "reports-key"},
+				}}},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("%s: Check: %v", path, err)
+		}
+		if got := codes.Code(resp.GetStatus().GetCode()); got != wantCode {
+			t.Errorf("%s: Check = %v, want %v", path, got, wantCode)
+		}
+	}
+}
+
+func TestRouteTableMatchesSegments(t *testing.T) {
+	table := routeTable{{prefix: "/machine/jobs/", modes: authModeJWT}, {prefix: "/machine", modes: authModeAPIKey}}
+	for path, want := range map[string]authModes{
+		"/machine":           authModeAPIKey,
+		"/machine/":          authModeAPIKey,
+		"/machine/x":         authModeAPIKey,
+		"/machine/jobs/1":    authModeJWT,
+		"/machine/jobsx":     authModeAPIKey,
+		"/machinery":         0,
+		"/machinery/machine": 0,
+	} {
+		if got, _ := table.match(path); got != want {
+			t.Errorf("match(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
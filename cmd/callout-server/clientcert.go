@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const defaultClientCertHeader = "x-client-identity"
+
+type clientCertMode int
+
+const (
+	// clientCertOff ignores the peer certificate.
+	clientCertOff clientCertMode = iota
+	// clientCertInstead authenticates callers by certificate only.
+	clientCertInstead
+	// clientCertAdditional requires an allowed certificate on top of the
+	// JWT or API key authentication.
+	clientCertAdditional
+)
+
+var (
+	errMissingClientCert    = errors.New("client certificate is missing")
+	errInvalidClientCert    = errors.New("client certificate is invalid")
+	errClientCertNotAllowed = errors.New("client certificate is not allowed")
+)
+
+func parseClientCertMode(value string) (clientCertMode, error) {
+	switch value {
+	case "", "off":
+		return clientCertOff, nil
+	case "instead":
+		return clientCertInstead, nil
+	case "additional":
+		return clientCertAdditional, nil
+	default:
+		return clientCertOff, fmt.Errorf("unknown client certificate mode: %q", value)
+	}
+}
+
+// clientCertAllowlist holds exact identities and prefixes (entries ending in
+// "*"), e.g. "spiffe://example.org/ns/prod/*".
+type clientCertAllowlist struct {
+	exact    map[string]struct{}
+	prefixes []string
+}
+
+func parseClientCertAllowlist(value string) clientCertAllowlist {
+	list := clientCertAllowlist{exact: make(map[string]struct{})}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case strings.HasSuffix(entry, "*"):
+			list.prefixes = append(list.prefixes, strings.TrimSuffix(entry, "*"))
+		default:
+			list.exact[entry] = struct{}{}
+		}
+	}
+	return list
+}
+
+func (l clientCertAllowlist) empty() bool {
+	return len(l.exact) == 0 && len(l.prefixes) == 0
+}
+
+func (l clientCertAllowlist) allows(id string) bool {
+	if _, ok := l.exact[id]; ok {
+		return true
+	}
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(id, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCertIdentity returns the caller identity forwarded by the load
+// balancer. The certificate chain was already verified by the load balancer
+// during the mTLS handshake, so only the identity is extracted here: the
+// SPIFFE URI SAN when present, otherwise the subject CN. When only the
+// principal is forwarded it is used as is.
+func clientCertIdentity(certificate, principal string) (string, error) {
+	if certificate == "" {
+		if principal == "" {
+			return "", errMissingClientCert
+		}
+		return principal, nil
+	}
+	// ext_authz forwards the leaf certificate URL-encoded in PEM format. The
+	// base64 body keeps "+" unescaped, which QueryUnescape would turn into a
+	// space.
+	decoded, err := url.PathUnescape(certificate)
+	if err != nil {
+		return "", errInvalidClientCert
+	}
+	block, _ := pem.Decode([]byte(decoded))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", errInvalidClientCert
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", errInvalidClientCert
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String(), nil
+		}
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, nil
+	}
+	return "", errInvalidClientCert
+}
+
+func (s *calloutServer) authenticateClientCert(req requestInfo) (string, error) {
+	id, err := clientCertIdentity(req.certificate, req.principal)
+	if err != nil {
+		return "", err
+	}
+	if !s.clientCertAllowlist.allows(id) {
+		return "", errClientCertNotAllowed
+	}
+	return id, nil
+}
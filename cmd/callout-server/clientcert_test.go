@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// forwardedCert returns a self-signed certificate URL-encoded as the load
+// balancer forwards it: spaces, newlines and "=" escaped, "+" and "/" kept.
+func forwardedCert(t *testing.T, cn string, uris ...string) string {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			t.Fatalf("parse URI %q: %v", u, err)
+		}
+		tmpl.URIs = append(tmpl.URIs, parsed)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	encoded := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return strings.NewReplacer(" ", "%20", "\n", "%0A", "=", "%3D").Replace(encoded)
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	tests := []struct {
+		name        string
+		certificate string
+		principal   string
+		want        string
+		wantErr     error
+	}{
+		{name: "spiffe uri san", certificate: forwardedCert(t, "workload", "https://example.org/ignored", "spiffe://example.org/ns/prod/sa/api"),
+			want: "spiffe://example.org/ns/prod/sa/api"},
+		{name: "cn fallback", certificate: forwardedCert(t, "batch.internal", "https://example.org/not-spiffe"), want: "batch.internal"},
+		{name: "principal without certificate", principal: "spiffe://example.org/ns/prod/sa/web", want: "spiffe://example.org/ns/prod/sa/web"},
+		{name: "certificate over principal", certificate: forwardedCert(t, "batch.internal"), principal: "other", want: "batch.internal"},
+		{name: "no cn or san", certificate: forwardedCert(t, ""), wantErr: errInvalidClientCert},
+		{name: "not pem", certificate: "not%20a%20certificate", wantErr: errInvalidClientCert},
+		{name: "invalid escape", certificate: "%zz", wantErr: errInvalidClientCert},
+		{name: "missing", wantErr: errMissingClientCert},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := clientCertIdentity(tc.certificate, tc.principal)
+			if err != tc.wantErr || got != tc.want {
+				t.Errorf("clientCertIdentity = %q, %v; want %q, %v", got, err, tc.want, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientCertAllowlist(t *testing.T) {
+	list := parseClientCertAllowlist(" spiffe://example.org/ns/prod/*, batch.internal ,,")
+	for id, want := range map[string]bool{
+		"spiffe://example.org/ns/prod/sa/api": true,
+		"spiffe://example.org/ns/prod/":       true,
+		"spiffe://example.org/ns/dev/sa/api":  false,
+		"batch.internal":                      true,
+		"batch.internal.evil":                 false,
+		"batch":                               false,
+		"":                                    false,
+	} {
+		if got := list.allows(id); got != want {
+			t.Errorf("allows(%q) = %v, want %v", id, got, want)
+		}
+	}
+	if !parseClientCertAllowlist(" , ").empty() {
+		t.Error("allowlist of blank entries is not empty")
+	}
+}
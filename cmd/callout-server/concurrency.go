@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+const (
+	headerLoadShed = "x-load-shed"
+
+	// aimdBackoff is the multiplicative decrease applied when a request takes
+	// longer than the target latency.
+	aimdBackoff = 0.9
+)
+
+var (
+	concurrencyLimit    = expvar.NewMap("concurrency_limit")
+	concurrencyInflight = expvar.NewMap("concurrency_inflight")
+	concurrencyShed     = expvar.NewMap("concurrency_shed_total")
+)
+
+type loadShedMode int
+
+const (
+	// loadShedDeny rejects shed requests with 503.
+	loadShedDeny loadShedMode = iota
+	// loadShedAllow lets shed requests through unauthenticated and marks
+	// them with the x-load-shed header so the origin can decide.
+	loadShedAllow
+)
+
+func parseLoadShedMode(value string) (loadShedMode, error) {
+	switch value {
+	case "", "deny":
+		return loadShedDeny, nil
+	case "allow":
+		return loadShedAllow, nil
+	default:
+		return loadShedDeny, fmt.Errorf("unknown load shed mode: %q", value)
+	}
+}
+
+type concurrencyConfig struct {
+	targetLatency time.Duration
+	initialLimit  int
+	minLimit      int
+	maxLimit      int
+}
+
+// adaptiveLimiter is an AIMD concurrency limiter. Requests finishing within
+// the target latency grow the limit by one per limit's worth of requests;
+// slower requests shrink it multiplicatively. Requests over the limit are
+// rejected immediately instead of queueing, so the decision stays well
+// inside the extension timeout.
+type adaptiveLimiter struct {
+	name string
+	cfg  concurrencyConfig
+	// now measures request latency; time.Now unless a test replaces it.
+	now func() time.Time
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+}
+
+func (cfg concurrencyConfig) validate() error {
+	if cfg.targetLatency <= 0 {
+		return errors.New("target latency must be positive")
+	}
+	if cfg.minLimit < 1 || cfg.maxLimit < cfg.minLimit || cfg.initialLimit < cfg.minLimit || cfg.initialLimit > cfg.maxLimit {
+		return errors.New("limits must satisfy 1 <= min <= initial <= max")
+	}
+	return nil
+}
+
+func newAdaptiveLimiter(name string, cfg concurrencyConfig) (*adaptiveLimiter, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	l := &adaptiveLimiter{name: name, cfg: cfg, now: time.Now, limit: float64(cfg.initialLimit)}
+	l.publish()
+	return l, nil
+}
+
+// acquire admits a request if the in-flight count is below the current limit.
+// The returned release func must be called when the request finishes.
+func (l *adaptiveLimiter) acquire() (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= int(l.limit) {
+		concurrencyShed.Add(l.name, 1)
+		return nil, false
+	}
+	l.inflight++
+	l.publish()
+	start := l.now()
+	return func() { l.release(l.now().Sub(start)) }, true
+}
+
+func (l *adaptiveLimiter) release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if latency > l.cfg.targetLatency {
+		l.limit = math.Max(float64(l.cfg.minLimit), l.limit*aimdBackoff)
+	} else if float64(l.inflight+1) >= l.limit/2 {
+		// Only grow while the limit is actually being used.
+		l.limit = math.Min(float64(l.cfg.maxLimit), l.limit+1/l.limit)
+	}
+	l.publish()
+}
+
+func (l *adaptiveLimiter) publish() {
+	limit := new(expvar.Int)
+	limit.Set(int64(l.limit))
+	concurrencyLimit.Set(l.name, limit)
+	inflight := new(expvar.Int)
+	inflight.Set(int64(l.inflight))
+	concurrencyInflight.Set(l.name, inflight)
+}
+
+func (l *adaptiveLimiter) unaryInterceptor(shed func(req any) (any, error)) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		release, ok := l.acquire()
+		if !ok {
+			return shed(req)
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+// streamInterceptor admits each stream, for ext_proc one Process stream per
+// HTTP request, as one request of the limiter. Its latency is the stream
+// lifetime, which covers only the request headers with the
+// REQUEST_HEADERS-only traffic extension.
+func (l *adaptiveLimiter) streamInterceptor(shed grpc.StreamHandler) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		release, ok := l.acquire()
+		if !ok {
+			return shed(srv, stream)
+		}
+		defer release()
+		return handler(srv, stream)
+	}
+}
+
+// shedUnary answers a unary request rejected by the limiter.
+func (s *calloutServer) shedUnary(req any) (any, error) {
+	if _, ok := req.(*auth.CheckRequest); !ok {
+		return nil, grpcstatus.Error(codes.ResourceExhausted, "callout-server is overloaded")
+	}
+	if s.loadShedMode == loadShedAllow {
+		resp := buildOkResponse(headerValueOptions([][2]string{{headerLoadShed, "1"}}))
+		// The caller is unauthenticated, so never forward client-supplied
+		// identity headers.
+		resp.GetOkResponse().HeadersToRemove = s.identityHeaderNames()
+		return resp, nil
+	}
+	return &auth.CheckResponse{
+		Status: &status.Status{Code: int32(codes.Unavailable), Message: "overloaded"},
+		HttpResponse: &auth.CheckResponse_DeniedResponse{
+			DeniedResponse: &auth.DeniedHttpResponse{
+				Status: &envoytype.HttpStatus{Code: envoytype.StatusCode_ServiceUnavailable},
+				Body:   "denied: overloaded",
+			},
+		},
+	}, nil
+}
+
+// shedProcess answers a Process stream rejected by the limiter without
+// authenticating it.
+func (s *calloutServer) shedProcess(_ any, stream grpc.ServerStream) error {
+	return serveProcess(stream, func(req *extproc.ProcessingRequest) (*extproc.ProcessingResponse, error) {
+		if req.GetRequestHeaders() != nil {
+			return s.shedRequestHeaders(), nil
+		}
+		return buildContinueProcessingResponse(req), nil
+	})
+}
+
+// shedRequestHeaders answers the request_headers message of a shed Process
+// stream.
+func (s *calloutServer) shedRequestHeaders() *extproc.ProcessingResponse {
+	if s.loadShedMode == loadShedAllow {
+		resp := buildRequestHeadersProcessingResponse(headerValueOptions([][2]string{{headerLoadShed, "1"}}))
+		resp.GetRequestHeaders().GetResponse().GetHeaderMutation().RemoveHeaders = s.identityHeaderNames()
+		return resp
+	}
+	return &extproc.ProcessingResponse{
+		Response: &extproc.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &extproc.ImmediateResponse{
+				Status: &envoytype.HttpStatus{Code: envoytype.StatusCode_ServiceUnavailable},
+				Body:   []byte("denied: overloaded"),
+			},
+		},
+	}
+}
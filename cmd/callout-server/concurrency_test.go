@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestLimiter returns a limiter whose request latency is set by advancing
+// the returned clock between acquire and release.
+func newTestLimiter(t *testing.T, cfg concurrencyConfig) (*adaptiveLimiter, *fakeClock) {
+	t.Helper()
+	l, err := newAdaptiveLimiter(t.Name(), cfg)
+	if err != nil {
+		t.Fatalf("newAdaptiveLimiter: %v", err)
+	}
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l.now = clock.Now
+	return l, clock
+}
+
+// newAPIKeyServer returns a server that authenticates the keys of
+// newTestAPIKeyStore.
+func newAPIKeyServer(t *testing.T) *calloutServer {
+	t.Helper()
+	server, err := newCalloutServer(serverConfig{apiKeys: newTestAPIKeyStore(t)})
+	if err != nil {
+		t.Fatalf("newCalloutServer: %v", err)
+	}
+	return server
+}
+
+func TestAdaptiveLimiterAIMD(t *testing.T) {
+	l, clock := newTestLimiter(t, concurrencyConfig{targetLatency: 10 * time.Millisecond, initialLimit: 4, minLimit: 2, maxLimit: 5})
+	assertLimit := func(want float64) {
+		t.Helper()
+		if math.Abs(l.limit-want) > 1e-9 {
+			t.Fatalf("limit = %v, want %v", l.limit, want)
+		}
+	}
+
+	var releases []func()
+	for i := 0; i < 4; i++ {
+		release, ok := l.acquire()
+		if !ok {
+			t.Fatalf("request %d shed below the limit", i)
+		}
+		releases = append(releases, release)
+	}
+	if _, ok := l.acquire(); ok {
+		t.Fatal("request over the limit admitted")
+	}
+
+	// Fast requests while the limit is in use grow it by 1/limit.
+	clock.now = clock.now.Add(time.Millisecond)
+	releases[0]()
+	assertLimit(4.25)
+	// Slow requests shrink it by aimdBackoff each.
+	clock.now = clock.now.Add(20 * time.Millisecond)
+	releases[1]()
+	assertLimit(4.25 * aimdBackoff)
+	releases[2]()
+	releases[3]()
+	shrunk := 4.25 * aimdBackoff * aimdBackoff * aimdBackoff
+	assertLimit(shrunk)
+	// Fast requests on an idle limiter do not grow it.
+	release, _ := l.acquire()
+	release()
+	assertLimit(shrunk)
+
+	// Slow requests stop at the minimum.
+	for i := 0; i < 20; i++ {
+		release, _ := l.acquire()
+		clock.now = clock.now.Add(time.Second)
+		release()
+	}
+	assertLimit(2)
+
+	// Fast requests using the whole limit stop at the maximum.
+	for i := 0; i < 200; i++ {
+		var held []func()
+		for release, ok := l.acquire(); ok; release, ok = l.acquire() {
+			held = append(held, release)
+		}
+		for _, release := range held {
+			release()
+		}
+	}
+	assertLimit(5)
+}
+
+func TestShedResponses(t *testing.T) {
+	server := newAPIKeyServer(t)
+	removed := []string{headerUID, headerScopes, defaultClientCertHeader}
+
+	if _, err := server.shedUnary(&rls.RateLimitRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("shed rate limit request error = %v, want ResourceExhausted", err)
+	}
+
+	resp, err := server.shedUnary(&auth.CheckRequest{})
+	if err != nil {
+		t.Fatalf("shedUnary: %v", err)
+	}
+	denied := resp.(*auth.CheckResponse)
+	if denied.GetStatus().GetCode() != int32(codes.Unavailable) || denied.GetDeniedResponse().GetStatus().GetCode() != envoytype.StatusCode_ServiceUnavailable {
+		t.Errorf("deny mode response = %v, want 503", denied)
+	}
+	if immediate := server.shedRequestHeaders().GetImmediateResponse(); immediate.GetStatus().GetCode() != envoytype.StatusCode_ServiceUnavailable {
+		t.Errorf("deny mode ext_proc response = %v, want 503", immediate)
+	}
+
+	server.loadShedMode = loadShedAllow
+	resp, err = server.shedUnary(&auth.CheckRequest{})
+	if err != nil {
+		t.Fatalf("shedUnary: %v", err)
+	}
+	ok := resp.(*auth.CheckResponse).GetOkResponse()
+	if len(ok.GetHeaders()) != 1 || ok.GetHeaders()[0].GetHeader().GetKey() != headerLoadShed || !slices.Equal(ok.GetHeadersToRemove(), removed) {
+		t.Errorf("allow mode response = %v, want %s and %v removed", ok, headerLoadShed, removed)
+	}
+	mutation := server.shedRequestHeaders().GetRequestHeaders().GetResponse().GetHeaderMutation()
+	if len(mutation.GetSetHeaders()) != 1 || !slices.Equal(mutation.GetRemoveHeaders(), removed) {
+		t.Errorf("allow mode ext_proc mutation = %v, want %s and %v removed", mutation, headerLoadShed, removed)
+	}
+}
+
+func TestProcessStreamShed(t *testing.T) {
+	server := newAPIKeyServer(t)
+	server.loadShedMode = loadShedAllow
+	limiter, _ := newTestLimiter(t, concurrencyConfig{targetLatency: time.Second, initialLimit: 1, minLimit: 1, maxLimit: 1})
+
+	lis := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(grpc.ChainStreamInterceptor(limiter.streamInterceptor(server.shedProcess)))
+	extproc.RegisterExternalProcessorServer(grpcServer, server)
+	go func() { _ = grpcServer.Serve(lis) }()
+	t.Cleanup(grpcServer.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := extproc.NewExternalProcessorClient(conn)
+
+	requestHeaders := func() *extproc.HeadersResponse {
+		t.Helper()
+		stream, err := client.Process(context.Background())
+		if err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+		defer func() { _ = stream.CloseSend() }()
+		headers := &core.HeaderMap{Headers: []*core.HeaderValue{
+			{Key: headerPath, Value: "/"},
+			{Key: defaultAPIKeyHeader, Value: "plain-key"},
+		}}
+		if err := stream.Send(&extproc.ProcessingRequest{Request: &extproc.ProcessingRequest_RequestHeaders{
+			RequestHeaders: &extproc.HttpHeaders{Headers: headers},
+		}}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		return resp.GetRequestHeaders()
+	}
+
+	// Another stream holds the only slot, so this one is shed.
+	release, _ := limiter.acquire()
+	set := requestHeaders().GetResponse().GetHeaderMutation().GetSetHeaders()
+	if len(set) != 1 || set[0].GetHeader().GetKey() != headerLoadShed {
+		t.Errorf("shed stream headers = %v, want only %s", set, headerLoadShed)
+	}
+	release()
+
+	set = requestHeaders().GetResponse().GetHeaderMutation().GetSetHeaders()
+	if len(set) == 0 || set[0].GetHeader().GetKey() != headerUID {
+		t.Errorf("admitted stream headers = %v, want %s", set, headerUID)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+)
+
+// configSchemaVersion is the only schema_version accepted in --config files.
+const configSchemaVersion = 1
+
+// fileConfig is the format of the --config file, YAML or JSON. Every field
+// is optional: defaultFileConfig holds the defaults, and the environment
+// variables read by applyEnv replace the file values when they are set.
+type fileConfig struct {
+	SchemaVersion int `yaml:"schema_version"`
+	// Port is the gRPC port. Env: PORT.
+	Port string `yaml:"port"`
+	// AdminPort serves /debug/vars, and the internal token JWKS, when set.
+	// Env: ADMIN_PORT.
+	AdminPort string `yaml:"admin_port"`
+
+	// tenantPolicy is the default tenant, which serves every host that no
+	// tenant lists.
+	tenantPolicy `yaml:",inline"`
+	// Tenants are selected by the request host.
+	Tenants []tenantFileConfig `yaml:"tenants"`
+
+	Headers headersConfig `yaml:"headers"`
+	// APIKeysFile enables API keys, see apiKeyFile. Env: API_KEYS_FILE.
+	APIKeysFile string           `yaml:"api_keys_file"`
+	ClientCert  clientCertConfig `yaml:"client_cert"`
+	Limits      limitsConfig     `yaml:"limits"`
+	// InternalToken mints a JWT for the origin on allowed requests.
+	InternalToken internalTokenConfig `yaml:"internal_token"`
+	Logging       loggingConfig       `yaml:"logging"`
+}
+
+// tenantPolicy is the JWT policy of a tenant.
+type tenantPolicy struct {
+	// Keys verify bearer JWTs. Env: PUBLIC_KEY_PEM replaces the default
+	// tenant keys with one key.
+	Keys []keyConfig `yaml:"keys"`
+	// JWKSFile adds the keys of a JWKS document.
+	JWKSFile string `yaml:"jwks_file"`
+	// Issuer, when set, must equal the token iss.
+	Issuer string `yaml:"issuer"`
+	// Audiences, when set, must contain one of the token aud values.
+	Audiences  []string         `yaml:"audiences"`
+	Validation validationConfig `yaml:"validation"`
+	Claims     claimsConfig     `yaml:"claims"`
+	// Routes select the authentication modes by path prefix. Env:
+	// AUTH_ROUTES replaces the default tenant routes.
+	Routes []routeConfig `yaml:"routes"`
+}
+
+// tenantFileConfig is a tenant with the hosts that select it, e.g.
+// "api.example.com" or "*.example.com".
+type tenantFileConfig struct {
+	Name         string   `yaml:"name"`
+	Hosts        []string `yaml:"hosts"`
+	tenantPolicy `yaml:",inline"`
+}
+
+type claimsConfig struct {
+	// Subject is the string claim used as the subject; sub when empty.
+	Subject string `yaml:"subject"`
+	// Headers maps request header names to the string claims they carry.
+	Headers map[string]string `yaml:"headers"`
+}
+
+// keyConfig is a PEM public key (PKIX) given inline or as a file. Alg
+// defaults to the algorithm of the key type: RS256 for RSA, ES256 for
+// P-256 and EdDSA for Ed25519.
+type keyConfig struct {
+	Kid              string `yaml:"kid,omitempty"`
+	Alg              string `yaml:"alg,omitempty"`
+	PublicKeyPEM     string `yaml:"public_key_pem,omitempty"`
+	PublicKeyPEMFile string `yaml:"public_key_pem_file,omitempty"`
+}
+
+type validationConfig struct {
+	// Leeway is the clock skew tolerated for exp, nbf and iat.
+	Leeway time.Duration `yaml:"leeway"`
+	// RequireExp rejects tokens without exp.
+	RequireExp bool `yaml:"require_exp"`
+}
+
+// headersConfig names the headers read from and set on requests.
+type headersConfig struct {
+	// Subject carries the authenticated subject to the origin.
+	Subject string `yaml:"subject"`
+	// Scopes carries the API key scopes, space-separated.
+	Scopes string `yaml:"scopes"`
+	// ClientIdentity carries the client certificate identity. Env:
+	// CLIENT_CERT_HEADER.
+	ClientIdentity string `yaml:"client_identity"`
+	// APIKey is the request header holding the API key. Env: API_KEY_HEADER.
+	APIKey string `yaml:"api_key"`
+}
+
+type clientCertConfig struct {
+	// Mode is off, instead or additional. Env: CLIENT_CERT_MODE.
+	Mode string `yaml:"mode"`
+	// Allowlist holds identities, with a trailing * for a prefix match.
+	// Env: CLIENT_CERT_ALLOWLIST (comma-separated).
+	Allowlist []string `yaml:"allowlist"`
+}
+
+type limitsConfig struct {
+	// RateLimitFile enables the token-bucket limiter. Env: RATE_LIMIT_FILE.
+	RateLimitFile string `yaml:"rate_limit_file"`
+	// RLSConfigFile enables envoy.service.ratelimit.v3. Env: RLS_CONFIG_FILE.
+	RLSConfigFile string            `yaml:"rls_config_file"`
+	Concurrency   concurrencyLimits `yaml:"concurrency"`
+	// LoadShedMode is deny or allow. Env: LOAD_SHED_MODE.
+	LoadShedMode string `yaml:"load_shed_mode"`
+}
+
+// concurrencyLimits configure the adaptive concurrency limiter, which is
+// disabled while TargetLatency is zero. Env: CONCURRENCY_TARGET_LATENCY and
+// CONCURRENCY_{INITIAL,MIN,MAX}_LIMIT.
+type concurrencyLimits struct {
+	TargetLatency time.Duration `yaml:"target_latency"`
+	InitialLimit  int           `yaml:"initial_limit"`
+	MinLimit      int           `yaml:"min_limit"`
+	MaxLimit      int           `yaml:"max_limit"`
+}
+
+type loggingConfig struct {
+	// Decisions logs every authentication decision with its tenant, path
+	// and reason.
+	Decisions bool `yaml:"decisions"`
+}
+
+func defaultFileConfig() fileConfig {
+	return fileConfig{
+		SchemaVersion: configSchemaVersion,
+		Port:          "8080",
+		Headers: headersConfig{
+			Subject:        headerUID,
+			Scopes:         headerScopes,
+			ClientIdentity: defaultClientCertHeader,
+			APIKey:         defaultAPIKeyHeader,
+		},
+		ClientCert: clientCertConfig{Mode: "off"},
+		Limits: limitsConfig{
+			Concurrency:  concurrencyLimits{InitialLimit: 20, MinLimit: 1, MaxLimit: 1000},
+			LoadShedMode: "deny",
+		},
+		InternalToken: internalTokenConfig{
+			Issuer: defaultInternalTokenIssuer,
+			TTL:    defaultInternalTokenTTL,
+			Header: defaultInternalTokenHeader,
+		},
+	}
+}
+
+// loadConfig reads path (optional) over the defaults and applies the
+// environment overrides.
+func loadConfig(path string, getenv func(string) string) (fileConfig, error) {
+	cfg := defaultFileConfig()
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.SchemaVersion = 0
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&cfg); err != nil && err != io.EOF {
+			return cfg, fmt.Errorf("parse config %s: %w", path, err)
+		}
+		if cfg.SchemaVersion != configSchemaVersion {
+			return cfg, fmt.Errorf("config %s: schema_version must be %d", path, configSchemaVersion)
+		}
+	}
+	if err := cfg.applyEnv(getenv); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// applyEnv replaces file values with the environment variables that are
+// set and not empty.
+func (c *fileConfig) applyEnv(getenv func(string) string) error {
+	for name, dst := range map[string]*string{
+		"PORT":               &c.Port,
+		"ADMIN_PORT":         &c.AdminPort,
+		"API_KEYS_FILE":      &c.APIKeysFile,
+		"API_KEY_HEADER":     &c.Headers.APIKey,
+		"CLIENT_CERT_MODE":   &c.ClientCert.Mode,
+		"CLIENT_CERT_HEADER": &c.Headers.ClientIdentity,
+		"RATE_LIMIT_FILE":    &c.Limits.RateLimitFile,
+		"RLS_CONFIG_FILE":    &c.Limits.RLSConfigFile,
+		"LOAD_SHED_MODE":     &c.Limits.LoadShedMode,
+
+		"INTERNAL_TOKEN_AUDIENCE": &c.InternalToken.Audience,
+	} {
+		if value := getenv(name); value != "" {
+			*dst = value
+		}
+	}
+	if value := getenv("PUBLIC_KEY_PEM"); value != "" {
+		// Cloud Run env vars cannot hold newlines, so deploy-*.sh pass the
+		// PEM with literal \n.
+		c.Keys = []keyConfig{{PublicKeyPEM: strings.ReplaceAll(value, "\\n", "\n")}}
+	}
+	if value := getenv("INTERNAL_TOKEN_PRIVATE_KEY_PEM"); value != "" {
+		c.InternalToken.PrivateKeyPEM = strings.ReplaceAll(value, "\\n", "\n")
+		c.InternalToken.PrivateKeyPEMFile = ""
+	}
+	if value := getenv("AUTH_ROUTES"); value != "" {
+		routes, err := parseRouteEntries(value)
+		if err != nil {
+			return fmt.Errorf("AUTH_ROUTES: %w", err)
+		}
+		c.Routes = routes
+	}
+	if value := getenv("CLIENT_CERT_ALLOWLIST"); value != "" {
+		c.ClientCert.Allowlist = nil
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				c.ClientCert.Allowlist = append(c.ClientCert.Allowlist, entry)
+			}
+		}
+	}
+	if value := getenv("CONCURRENCY_TARGET_LATENCY"); value != "" {
+		target, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("CONCURRENCY_TARGET_LATENCY: %w", err)
+		}
+		c.Limits.Concurrency.TargetLatency = target
+	}
+	for name, dst := range map[string]*int{
+		"CONCURRENCY_INITIAL_LIMIT": &c.Limits.Concurrency.InitialLimit,
+		"CONCURRENCY_MIN_LIMIT":     &c.Limits.Concurrency.MinLimit,
+		"CONCURRENCY_MAX_LIMIT":     &c.Limits.Concurrency.MaxLimit,
+	} {
+		if raw := getenv(name); raw != "" {
+			value, err := strconv.Atoi(raw)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*dst = value
+		}
+	}
+	return nil
+}
+
+// options is a resolved fileConfig: everything main needs to start.
+type options struct {
+	server serverConfig
+	// concurrency is nil when the limiter is disabled.
+	concurrency *concurrencyConfig
+	rls         *rateLimitService
+}
+
+// resolve validates c, reads the files it refers to and fills in the
+// detected key algorithms. All problems are reported together.
+func (c *fileConfig) resolve() (*options, error) {
+	opts := &options{server: serverConfig{
+		apiKeyHeader:     c.Headers.APIKey,
+		subjectHeader:    c.Headers.Subject,
+		scopesHeader:     c.Headers.Scopes,
+		clientCertHeader: c.Headers.ClientIdentity,
+		logDecisions:     c.Logging.Decisions,
+	}}
+	var errs []error
+	check := func(section string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", section, err))
+		}
+	}
+
+	if c.Port == "" {
+		check("port", errors.New("is required"))
+	}
+	opts.server.tenantConfig = c.tenantPolicy.resolve("", check)
+	for i := range c.Tenants {
+		tc := &c.Tenants[i]
+		resolved := tc.tenantPolicy.resolve(fmt.Sprintf("tenants[%d].", i), check)
+		resolved.name = tc.Name
+		resolved.hosts = tc.Hosts
+		opts.server.tenants = append(opts.server.tenants, resolved)
+	}
+	for _, h := range [][2]string{
+		{"headers.subject", c.Headers.Subject},
+		{"headers.scopes", c.Headers.Scopes},
+		{"headers.client_identity", c.Headers.ClientIdentity},
+		{"headers.api_key", c.Headers.APIKey},
+	} {
+		if !validHeaderName(h[1]) {
+			check(h[0], fmt.Errorf("%q must be a lower-case header name", h[1]))
+		}
+	}
+
+	var err error
+	if c.APIKeysFile != "" {
+		opts.server.apiKeys, err = loadAPIKeyStore(c.APIKeysFile)
+		check("api_keys_file", err)
+	}
+	opts.server.clientCertMode, err = parseClientCertMode(c.ClientCert.Mode)
+	check("client_cert.mode", err)
+	opts.server.clientCertAllowlist = parseClientCertAllowlist(strings.Join(c.ClientCert.Allowlist, ","))
+	if c.Limits.RateLimitFile != "" {
+		opts.server.rateLimiter, err = loadRateLimiter(c.Limits.RateLimitFile)
+		check("limits.rate_limit_file", err)
+	}
+	if c.Limits.RLSConfigFile != "" {
+		opts.rls, err = loadRateLimitService(c.Limits.RLSConfigFile)
+		check("limits.rls_config_file", err)
+	}
+	if limits := c.Limits.Concurrency; limits.TargetLatency != 0 {
+		opts.concurrency = &concurrencyConfig{
+			targetLatency: limits.TargetLatency,
+			initialLimit:  limits.InitialLimit,
+			minLimit:      limits.MinLimit,
+			maxLimit:      limits.MaxLimit,
+		}
+		check("limits.concurrency", opts.concurrency.validate())
+	}
+	opts.server.loadShedMode, err = parseLoadShedMode(c.Limits.LoadShedMode)
+	check("limits.load_shed_mode", err)
+	if c.InternalToken.enabled() {
+		opts.server.minter, err = newTokenMinter(c.InternalToken)
+		check("internal_token", err)
+		if err == nil {
+			c.InternalToken.Kid = opts.server.minter.kid
+		}
+		if h := c.InternalToken.Header; h != "" && !validHeaderName(h) {
+			check("internal_token.header", fmt.Errorf("%q must be a lower-case header name", h))
+		}
+	}
+
+	if len(errs) == 0 {
+		// Cross-field checks, e.g. routes that need keys or hosts listed by
+		// two tenants.
+		_, err := newCalloutServer(opts.server)
+		check("config", err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return opts, nil
+}
+
+// resolve validates p and reads its keys, reporting problems under prefix,
+// and fills in the detected key algorithms.
+func (p *tenantPolicy) resolve(prefix string, check func(string, error)) tenantConfig {
+	tc := tenantConfig{
+		leeway:       p.Validation.Leeway,
+		requireExp:   p.Validation.RequireExp,
+		issuer:       p.Issuer,
+		audiences:    p.Audiences,
+		subjectClaim: p.Claims.Subject,
+	}
+	for i := range p.Keys {
+		key, err := p.Keys[i].load()
+		check(fmt.Sprintf("%skeys[%d]", prefix, i), err)
+		if err == nil {
+			p.Keys[i].Alg = key.Algorithm
+			tc.keys = append(tc.keys, key)
+		}
+	}
+	if p.JWKSFile != "" {
+		raw, err := os.ReadFile(p.JWKSFile)
+		if err == nil {
+			var keys []jwtverify.Key
+			keys, err = jwtverify.ParseJWKS(raw)
+			tc.keys = append(tc.keys, keys...)
+		}
+		check(prefix+"jwks_file", err)
+	}
+	seen := make(map[string]bool)
+	for _, key := range tc.keys {
+		if key.ID != "" && seen[key.ID] {
+			check(prefix+"keys", fmt.Errorf("duplicate kid %q", key.ID))
+		}
+		seen[key.ID] = true
+	}
+	if p.Validation.Leeway < 0 {
+		check(prefix+"validation.leeway", errors.New("must not be negative"))
+	}
+	headers := make([]string, 0, len(p.Claims.Headers))
+	for header := range p.Claims.Headers {
+		headers = append(headers, header)
+	}
+	slices.Sort(headers)
+	for _, header := range headers {
+		if !validHeaderName(header) {
+			check(prefix+"claims.headers", fmt.Errorf("%q must be a lower-case header name", header))
+		}
+		tc.claimHeaders = append(tc.claimHeaders, claimHeader{claim: p.Claims.Headers[header], header: header})
+	}
+	var err error
+	tc.routes, err = newRouteTable(p.Routes)
+	check(prefix+"routes", err)
+	return tc
+}
+
+func validHeaderName(name string) bool {
+	return name != "" && name == strings.ToLower(name) && !strings.HasPrefix(name, ":")
+}
+
+// load parses the key and binds it to its configured algorithm, or to the
+// default for its type.
+func (k keyConfig) load() (jwtverify.Key, error) {
+	value := k.PublicKeyPEM
+	switch {
+	case value != "" && k.PublicKeyPEMFile != "":
+		return jwtverify.Key{}, errors.New("public_key_pem and public_key_pem_file are mutually exclusive")
+	case k.PublicKeyPEMFile != "":
+		raw, err := os.ReadFile(k.PublicKeyPEMFile)
+		if err != nil {
+			return jwtverify.Key{}, err
+		}
+		value = string(raw)
+	case value == "":
+		return jwtverify.Key{}, errors.New("public_key_pem or public_key_pem_file is required")
+	}
+	publicKey, err := parsePublicKey(value)
+	if err != nil {
+		return jwtverify.Key{}, err
+	}
+	key := jwtverify.Key{ID: k.Kid, Algorithm: k.Alg, PublicKey: publicKey}
+	if key.Algorithm == "" {
+		switch publicKey.(type) {
+		case *rsa.PublicKey:
+			key.Algorithm = jwtverify.AlgRS256
+		case *ecdsa.PublicKey:
+			key.Algorithm = jwtverify.AlgES256
+		case ed25519.PublicKey:
+			key.Algorithm = jwtverify.AlgEdDSA
+		}
+	}
+	if _, err := jwtverify.NewVerifier([]jwtverify.Key{key}, jwtverify.Options{}); err != nil {
+		return jwtverify.Key{}, err
+	}
+	return key, nil
+}
+
+func parsePublicKey(pemString string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemString))
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unsupported PEM type: %s", block.Type)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse PKIX public key: %w", err)
+	}
+	return pub, nil
+}
+
+// writeNormalized prints c with defaults and overrides applied, the way
+// --validate-config shows it. An inline private key is redacted.
+func (c fileConfig) writeNormalized(w io.Writer) error {
+	if c.InternalToken.PrivateKeyPEM != "" {
+		c.InternalToken.PrivateKeyPEM = "REDACTED"
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
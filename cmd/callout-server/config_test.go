@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc/codes"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+// testECKey signs the ES256 tokens of the multi-key and tenant tests.
+var testECKey = func() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+func ecPublicKeyPEM(t *testing.T) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&testECKey.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal EC key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// signES256 signs claims with testECKey under kid "ec", encoding the
+// signature as the fixed-size R||S that JWS requires.
+func signES256(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]any{"alg": "ES256", "kid": "ec"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, testECKey, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signingInput + "." + b64(sig)
+}
+
+func envMap(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func TestLoadConfigFromEnvironment(t *testing.T) {
+	escaped := strings.ReplaceAll(jwtverifytest.PublicKeyPEM(), "\n", `\n`)
+	cfg, err := loadConfig("", envMap(map[string]string{
+		"PUBLIC_KEY_PEM":             escaped,
+		"AUTH_ROUTES":                "/machine/=apikey,/=jwt",
+		"API_KEYS_FILE":              writeFile(t, "keys.json", `{"keys":[{"hash":"sha256:`+strings.Repeat("0", 64)+`","owner":"ci"}]}`),
+		"CONCURRENCY_TARGET_LATENCY": "50ms",
+		"CONCURRENCY_MAX_LIMIT":      "64",
+	}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	opts, err := cfg.resolve()
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if cfg.Port != "8080" || len(cfg.Keys) != 1 || cfg.Keys[0].Alg != jwtverify.AlgRS256 {
+		t.Errorf("config = %+v, want the default port and one RS256 key", cfg)
+	}
+	if want := []routeConfig{{Prefix: "/machine/", Auth: "apikey"}, {Prefix: "/", Auth: "jwt"}}; !reflect.DeepEqual(cfg.Routes, want) {
+		t.Errorf("routes = %v, want %v", cfg.Routes, want)
+	}
+	if modes, _ := opts.server.routes.match("/machine/x"); modes != authModeAPIKey {
+		t.Errorf("/machine/x modes = %v, want apikey", modes)
+	}
+	want := concurrencyConfig{targetLatency: 50 * time.Millisecond, initialLimit: 20, minLimit: 1, maxLimit: 64}
+	if opts.concurrency == nil || *opts.concurrency != want {
+		t.Errorf("concurrency = %+v, want %+v", opts.concurrency, want)
+	}
+}
+
+const yamlConfig = `schema_version: 1
+port: "9000"
+keys:
+  - kid: rsa
+    public_key_pem_file: %s
+validation:
+  leeway: 30s
+  require_exp: true
+headers:
+  subject: x-user
+routes:
+  - prefix: /
+    auth: jwt
+logging:
+  decisions: true
+`
+
+const jsonConfig = `{
+  "schema_version": 1,
+  "port": "9000",
+  "keys": [{"kid": "rsa", "public_key_pem_file": %q}],
+  "validation": {"leeway": "30s", "require_exp": true},
+  "headers": {"subject": "x-user"},
+  "routes": [{"prefix": "/", "auth": "jwt"}],
+  "logging": {"decisions": true}
+}`
+
+func TestLoadConfigFileFormats(t *testing.T) {
+	keyFile := writeFile(t, "public.pem", jwtverifytest.PublicKeyPEM())
+	var outputs []string
+	for name, content := range map[string]string{
+		"callout.yaml": strings.Replace(yamlConfig, "%s", keyFile, 1),
+		"callout.json": strings.Replace(jsonConfig, "%q", `"`+keyFile+`"`, 1),
+	} {
+		cfg, err := loadConfig(writeFile(t, name, content), envMap(nil))
+		if err != nil {
+			t.Fatalf("%s: loadConfig: %v", name, err)
+		}
+		opts, err := cfg.resolve()
+		if err != nil {
+			t.Fatalf("%s: resolve: %v", name, err)
+		}
+		server := opts.server
+		if server.leeway != 30*time.Second || !server.requireExp || server.subjectHeader != "x-user" || !server.logDecisions {
+			t.Errorf("%s: server config = %+v", name, server)
+		}
+		if server.apiKeyHeader != defaultAPIKeyHeader || server.loadShedMode != loadShedDeny {
+			t.Errorf("%s: defaults not applied: %+v", name, server)
+		}
+		var out bytes.Buffer
+		if err := cfg.writeNormalized(&out); err != nil {
+			t.Fatalf("writeNormalized: %v", err)
+		}
+		outputs = append(outputs, out.String())
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("normalized configs differ:\n%s\n---\n%s", outputs[0], outputs[1])
+	}
+}
+
+func TestLoadConfigEnvironmentOverridesFile(t *testing.T) {
+	path := writeFile(t, "callout.yaml", "schema_version: 1\nport: \"9000\"\nheaders:\n  api_key: x-file-key\n")
+	cfg, err := loadConfig(path, envMap(map[string]string{"PORT": "7000", "LOAD_SHED_MODE": "allow"}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Port != "7000" || cfg.Limits.LoadShedMode != "allow" || cfg.Headers.APIKey != "x-file-key" {
+		t.Errorf("config = %+v, want PORT and LOAD_SHED_MODE from the environment", cfg)
+	}
+}
+
+func TestNormalizedConfigRoundTrip(t *testing.T) {
+	cfg, err := loadConfig("", envMap(map[string]string{"PUBLIC_KEY_PEM": jwtverifytest.PublicKeyPEM()}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if _, err := cfg.resolve(); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	var out bytes.Buffer
+	if err := cfg.writeNormalized(&out); err != nil {
+		t.Fatalf("writeNormalized: %v", err)
+	}
+	reloaded, err := loadConfig(writeFile(t, "normalized.yaml", out.String()), envMap(nil))
+	if err != nil {
+		t.Fatalf("reload normalized config: %v\n%s", err, out.String())
+	}
+	var again bytes.Buffer
+	if err := reloaded.writeNormalized(&again); err != nil {
+		t.Fatalf("writeNormalized: %v", err)
+	}
+	if again.String() != out.String() {
+		t.Errorf("normalized config changed after a reload:\n%s\n---\n%s", out.String(), again.String())
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	for name, content := range map[string]string{
+		"missing schema_version": "port: \"9000\"\n",
+		"future schema_version":  "schema_version: 2\n",
+		"unknown field":          "schema_version: 1\npublic_key: x\n",
+		"invalid duration":       "schema_version: 1\nvalidation:\n  leeway: soon\n",
+		"empty file":             "",
+	} {
+		if _, err := loadConfig(writeFile(t, "callout.yaml", content), envMap(nil)); err == nil {
+			t.Errorf("%s: loadConfig succeeded, want error", name)
+		}
+	}
+	if _, err := loadConfig("", envMap(map[string]string{"CONCURRENCY_MIN_LIMIT": "one"})); err == nil {
+		t.Error("loadConfig accepted CONCURRENCY_MIN_LIMIT=one")
+	}
+}
+
+func TestResolveReportsEveryError(t *testing.T) {
+	cfg := defaultFileConfig()
+	cfg.Keys = []keyConfig{{PublicKeyPEM: "not a key"}, {Alg: jwtverify.AlgES256, PublicKeyPEM: jwtverifytest.PublicKeyPEM()}}
+	cfg.Validation.Leeway = -time.Second
+	cfg.Headers.Subject = "X-Uid"
+	cfg.Routes = []routeConfig{{Prefix: "machine", Auth: "apikey"}}
+	cfg.ClientCert.Mode = "sometimes"
+	cfg.Limits.Concurrency = concurrencyLimits{TargetLatency: time.Millisecond, InitialLimit: 5, MinLimit: 10, MaxLimit: 1}
+	cfg.Limits.LoadShedMode = "drop"
+	_, err := cfg.resolve()
+	if err == nil {
+		t.Fatal("resolve succeeded, want errors")
+	}
+	for _, section := range []string{
+		"keys[0]", "keys[1]", "validation.leeway", "headers.subject", "routes",
+		"client_cert.mode", "limits.concurrency", "limits.load_shed_mode",
+	} {
+		if !strings.Contains(err.Error(), section+":") {
+			t.Errorf("error does not report %s:\n%v", section, err)
+		}
+	}
+}
+
+func TestResolveRequiresCredentials(t *testing.T) {
+	cfg := defaultFileConfig()
+	if _, err := cfg.resolve(); err == nil {
+		t.Error("resolve succeeded without keys or API keys")
+	}
+}
+
+func TestConfiguredKeysAndHeaders(t *testing.T) {
+	ecKeyFile := writeFile(t, "ec.pem", ecPublicKeyPEM(t))
+	cfg := defaultFileConfig()
+	cfg.Keys = []keyConfig{
+		{Kid: "rsa", PublicKeyPEM: jwtverifytest.PublicKeyPEM()},
+		{Kid: "ec", PublicKeyPEMFile: ecKeyFile},
+	}
+	cfg.Headers.Subject = "x-user"
+	opts, err := cfg.resolve()
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if cfg.Keys[1].Alg != jwtverify.AlgES256 {
+		t.Errorf("ec key alg = %q, want %s", cfg.Keys[1].Alg, jwtverify.AlgES256)
+	}
+	opts.server.clock = func() time.Time { return jwtverifytest.Now }
+	server, err := newCalloutServer(opts.server)
+	if err != nil {
+		t.Fatalf("newCalloutServer: %v", err)
+	}
+	token := signES256(t, map[string]any{"sub": "ec-user", "exp": jwtverifytest.Now.Add(time.Minute).Unix()})
+	resp, err := server.Check(context.Background(), &auth.CheckRequest{
+		Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+			Http: &auth.AttributeContext_HttpRequest{HeaderMap: conformanceHeaderMap(bearerPrefix + token)},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if resp.GetStatus().GetCode() != int32(codes.OK) {
+		t.Fatalf("status = %v, want OK", resp.GetStatus())
+	}
+	if got := resp.GetOkResponse().GetHeaders()[0].GetHeader(); got.GetKey() != "x-user" || got.GetValue() != "ec-user" {
+		t.Errorf("header = %v, want x-user: ec-user", got)
+	}
+}
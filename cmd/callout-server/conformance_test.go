@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc/codes"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func newConformanceServer(t testing.TB) *calloutServer {
+	t.Helper()
+	key, err := keyConfig{PublicKeyPEM: jwtverifytest.PublicKeyPEM()}.load()
+	if err != nil {
+		t.Fatalf("parse public key: %v", err)
+	}
+	server, err := newCalloutServer(serverConfig{
+		tenantConfig: tenantConfig{keys: []jwtverify.Key{key}},
+		clock:        func() time.Time { return jwtverifytest.Now },
+	})
+	if err != nil {
+		t.Fatalf("newCalloutServer: %v", err)
+	}
+	return server
+}
+
+func conformanceHeaderMap(authorization string) *core.HeaderMap {
+	headerMap := &core.HeaderMap{Headers: []*core.HeaderValue{{Key: ":path", Value: "/"}}}
+	if authorization != "" {
+		headerMap.Headers = append(headerMap.Headers, &core.HeaderValue{Key: headerAuth, RawValue: []byte(authorization)})
+	}
+	return headerMap
+}
+
+func TestCheckConformance(t *testing.T) {
+	server := newConformanceServer(t)
+	for _, tc := range jwtverifytest.Cases() {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp, err := server.Check(context.Background(), &auth.CheckRequest{
+				Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+					Http: &auth.AttributeContext_HttpRequest{HeaderMap: conformanceHeaderMap(tc.Authorization)},
+				}},
+			})
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if tc.WantReason != "" {
+				if resp.GetStatus().GetCode() != int32(codes.PermissionDenied) || resp.GetStatus().GetMessage() != tc.WantReason {
+					t.Fatalf("status = %v, want PermissionDenied %q", resp.GetStatus(), tc.WantReason)
+				}
+				return
+			}
+			headers := resp.GetOkResponse().GetHeaders()
+			if resp.GetStatus().GetCode() != int32(codes.OK) || len(headers) == 0 {
+				t.Fatalf("response = %v, want OK", resp)
+			}
+			if got := headers[0].GetHeader(); got.GetKey() != headerUID || got.GetValue() != tc.WantSubject {
+				t.Errorf("header = %v, want %s: %s", got, headerUID, tc.WantSubject)
+			}
+		})
+	}
+}
+
+func TestProcessRequestHeadersConformance(t *testing.T) {
+	server := newConformanceServer(t)
+	for _, tc := range jwtverifytest.Cases() {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp, err := server.handleProcessingRequest(&extproc.ProcessingRequest{
+				Request: &extproc.ProcessingRequest_RequestHeaders{
+					RequestHeaders: &extproc.HttpHeaders{Headers: conformanceHeaderMap(tc.Authorization)},
+				},
+			})
+			if err != nil {
+				t.Fatalf("handleProcessingRequest: %v", err)
+			}
+			if tc.WantReason != "" {
+				if got := string(resp.GetImmediateResponse().GetBody()); got != "denied: "+tc.WantReason {
+					t.Fatalf("immediate response body = %q, want %q", got, "denied: "+tc.WantReason)
+				}
+				return
+			}
+			headers := resp.GetRequestHeaders().GetResponse().GetHeaderMutation().GetSetHeaders()
+			if len(headers) == 0 {
+				t.Fatalf("response = %v, want header mutation", resp)
+			}
+			if got := headers[0].GetHeader(); got.GetKey() != headerUID || got.GetValue() != tc.WantSubject {
+				t.Errorf("header = %v, want %s: %s", got, headerUID, tc.WantSubject)
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+// Command callout-server serves the ext_authz, ext_proc and ratelimit.v3
+// callouts for the load balancer. Its settings and their defaults are
+// listed in defaultFileConfig.
+package main
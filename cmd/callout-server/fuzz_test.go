@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc/codes"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+)
+
+func FuzzParseBearer(f *testing.F) {
+	for _, sc := range clientScenarios() {
+		f.Add(sc.authorization)
+	}
+	f.Add("Bearer ")
+	f.Add("bearer abc")
+	f.Add("Bearer  abc")
+	f.Fuzz(func(t *testing.T, value string) {
+		token, err := parseBearer(value)
+		if err != nil {
+			if err != errInvalidAuthorization || strings.HasPrefix(value, bearerPrefix) {
+				t.Fatalf("parseBearer(%q) error = %v", value, err)
+			}
+			return
+		}
+		if bearerPrefix+token != value {
+			t.Fatalf("parseBearer(%q) = %q, want the value after %q", value, token, bearerPrefix)
+		}
+	})
+}
+
+func FuzzGetHeaderValueFromHeaderMap(f *testing.F) {
+	f.Add("authorization", "Bearer abc", []byte(nil), "authorization")
+	f.Add("Authorization", "", []byte("Bearer abc"), "authorization")
+	f.Add("x-api-key", "k", []byte("raw"), "X-API-KEY")
+	f.Add("", "", []byte(nil), "")
+	f.Fuzz(func(t *testing.T, key, value string, raw []byte, lookup string) {
+		headerMap := &core.HeaderMap{Headers: []*core.HeaderValue{
+			{Key: ":path", Value: "/"},
+			{Key: key, Value: value, RawValue: raw},
+			{Key: lookup, RawValue: []byte("fallback")},
+		}}
+		got := getHeaderValueFromHeaderMap(headerMap, lookup)
+		var want string
+		switch {
+		case strings.EqualFold(lookup, ":path"):
+			want = "/"
+		case strings.EqualFold(key, lookup) && value != "":
+			want = value
+		case strings.EqualFold(key, lookup) && len(raw) > 0:
+			want = string(raw)
+		default:
+			want = "fallback"
+		}
+		if got != want {
+			t.Fatalf("getHeaderValueFromHeaderMap(%q) = %q, want %q", lookup, got, want)
+		}
+		if getHeaderValueFromHeaderMap(nil, lookup) != "" {
+			t.Fatal("getHeaderValueFromHeaderMap(nil) returned a value")
+		}
+	})
+}
+
+// FuzzCheckAuthorization sends arbitrary authorization values through
+// Check: every request must be allowed with the token subject or denied
+// with one of the documented reasons.
+func FuzzCheckAuthorization(f *testing.F) {
+	for _, sc := range clientScenarios() {
+		f.Add(sc.authorization)
+	}
+	reasons := map[string]bool{errMissingAuthorization.Error(): true, errInvalidAuthorization.Error(): true}
+	for _, err := range []error{
+		jwtverify.ErrMalformed, jwtverify.ErrInvalidHeader, jwtverify.ErrUnsupportedAlgorithm,
+		jwtverify.ErrUnknownKey, jwtverify.ErrInvalidSignature, jwtverify.ErrInvalidPayload,
+		jwtverify.ErrExpired, jwtverify.ErrNotYetValid, jwtverify.ErrIssuedInFuture,
+		jwtverify.ErrMissingExpiration, jwtverify.ErrMissingSubject,
+	} {
+		reasons[err.Error()] = true
+	}
+	server := newConformanceServer(f)
+	f.Fuzz(func(t *testing.T, authorization string) {
+		resp, err := server.Check(context.Background(), &auth.CheckRequest{
+			Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+				Http: &auth.AttributeContext_HttpRequest{HeaderMap: conformanceHeaderMap(authorization)},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		switch resp.GetStatus().GetCode() {
+		case int32(codes.OK):
+			headers := resp.GetOkResponse().GetHeaders()
+			if len(headers) == 0 || headers[0].GetHeader().GetValue() == "" {
+				t.Fatalf("response = %v, want the subject in %s", resp, headerUID)
+			}
+		case int32(codes.PermissionDenied):
+			if !reasons[resp.GetStatus().GetMessage()] {
+				t.Fatalf("denial reason %q is not documented", resp.GetStatus().GetMessage())
+			}
+		default:
+			t.Fatalf("status = %v", resp.GetStatus())
+		}
+	})
+}
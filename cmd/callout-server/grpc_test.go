@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+// clientScenario is one of the requests cmd/client sends. wantReason is
+// the denial reason, or "" when the request is allowed as wantSubject.
+type clientScenario struct {
+	name          string
+	authorization string
+	wantSubject   string
+	wantReason    string
+}
+
+// clientScenarios builds the cmd/client requests with the conformance
+// server key.
+func clientScenarios() []clientScenario {
+	key := jwtverifytest.PrivateKey()
+	rs256 := map[string]any{"alg": "RS256", "typ": "JWT"}
+	exp := jwtverifytest.Now.Add(5 * time.Minute).Unix()
+	valid := jwtverifytest.SignRS256(key, rs256, map[string]any{"sub": "grpc-user", "exp": exp})
+	badSig := []byte(valid)
+	badSig[len(badSig)-2] ^= 'A' ^ 'B'
+	return []clientScenario{
+		{name: "valid", authorization: bearerPrefix + valid, wantSubject: "grpc-user"},
+		{name: "missing_auth", wantReason: errMissingAuthorization.Error()},
+		{name: "not_bearer", authorization: "Token " + valid, wantReason: errInvalidAuthorization.Error()},
+		{name: "malformed", authorization: "Bearer abc.def", wantReason: jwtverify.ErrMalformed.Error()},
+		{name: "missing_sub", authorization: bearerPrefix + jwtverifytest.SignRS256(key, rs256, map[string]any{"exp": exp}), wantReason: jwtverify.ErrMissingSubject.Error()},
+		{name: "bad_signature", authorization: bearerPrefix + string(badSig), wantReason: jwtverify.ErrInvalidSignature.Error()},
+		{name: "wrong_alg", authorization: bearerPrefix + jwtverifytest.SignRS256(key, map[string]any{"alg": "HS256"}, map[string]any{"sub": "grpc-user"}), wantReason: jwtverify.ErrUnsupportedAlgorithm.Error()},
+	}
+}
+
+// startCalloutServer serves the conformance callout server with both
+// services registered, as main does, on an in-memory listener.
+func startCalloutServer(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	server := newConformanceServer(t)
+	auth.RegisterAuthorizationServer(grpcServer, server)
+	extproc.RegisterExternalProcessorServer(grpcServer, server)
+	go func() { _ = grpcServer.Serve(lis) }()
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// lbRequestHeaders is a request header map as the load balancer sends it:
+// pseudo headers first and every value in raw_value.
+func lbRequestHeaders(authorization string) *core.HeaderMap {
+	headers := [][2]string{
+		{":method", "POST"},
+		{":path", "/api/items?limit=10"},
+		{":authority", "lb.example.com"},
+		{":scheme", "https"},
+		{"content-type", "application/json"},
+		{"user-agent", "Go-http-client/1.1"},
+		{"x-forwarded-for", "203.0.113.7"},
+	}
+	if authorization != "" {
+		headers = append(headers, [2]string{headerAuth, authorization})
+	}
+	m := &core.HeaderMap{}
+	for _, h := range headers {
+		m.Headers = append(m.Headers, &core.HeaderValue{Key: h[0], RawValue: []byte(h[1])})
+	}
+	return m
+}
+
+func assertUIDHeader(t *testing.T, headers []*core.HeaderValueOption, want string) {
+	t.Helper()
+	if len(headers) != 1 {
+		t.Fatalf("headers = %v, want only %s", headers, headerUID)
+	}
+	h := headers[0]
+	if h.GetHeader().GetKey() != headerUID || string(h.GetHeader().GetRawValue()) != want || h.GetAppend().GetValue() {
+		t.Errorf("header = %v, want %s: %s overwriting", h, headerUID, want)
+	}
+}
+
+func TestCheckOverGRPC(t *testing.T) {
+	client := auth.NewAuthorizationClient(startCalloutServer(t))
+	for _, tc := range clientScenarios() {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := client.Check(context.Background(), &auth.CheckRequest{
+				Attributes: &auth.AttributeContext{
+					Source: &auth.AttributeContext_Peer{Address: &core.Address{Address: &core.Address_SocketAddress{
+						SocketAddress: &core.SocketAddress{Address: "203.0.113.7", PortSpecifier: &core.SocketAddress_PortValue{PortValue: 52100}},
+					}}},
+					Request: &auth.AttributeContext_Request{Http: &auth.AttributeContext_HttpRequest{
+						Id:        "req-" + tc.name,
+						Method:    "POST",
+						Path:      "/api/items?limit=10",
+						Host:      "lb.example.com",
+						Scheme:    "https",
+						Protocol:  "HTTP/1.1",
+						HeaderMap: lbRequestHeaders(tc.authorization),
+					}},
+				},
+			})
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if tc.wantReason != "" {
+				if resp.GetStatus().GetCode() != int32(codes.PermissionDenied) || resp.GetStatus().GetMessage() != tc.wantReason {
+					t.Fatalf("status = %v, want PermissionDenied %q", resp.GetStatus(), tc.wantReason)
+				}
+				denied := resp.GetDeniedResponse()
+				if denied.GetStatus().GetCode() != envoytype.StatusCode_Forbidden || denied.GetBody() != "denied: "+tc.wantReason {
+					t.Errorf("denied response = %v, want 403 %q", denied, "denied: "+tc.wantReason)
+				}
+				return
+			}
+			if resp.GetStatus().GetCode() != int32(codes.OK) || resp.GetOkResponse() == nil {
+				t.Fatalf("response = %v, want OK", resp)
+			}
+			ok := resp.GetOkResponse()
+			assertUIDHeader(t, ok.GetHeaders(), tc.wantSubject)
+			if remove := ok.GetHeadersToRemove(); len(remove) != 2 || remove[0] != headerScopes || remove[1] != defaultClientCertHeader {
+				t.Errorf("headers to remove = %v, want the unset %s and %s", remove, headerScopes, defaultClientCertHeader)
+			}
+			if len(ok.GetResponseHeadersToAdd()) != 0 {
+				t.Errorf("ok response = %v, want only the identity header", ok)
+			}
+		})
+	}
+}
+
+// streamEvents is one request through a traffic extension with every
+// event enabled: the body is streamed in two chunks and both directions
+// end with trailers.
+func streamEvents(authorization string) []*extproc.ProcessingRequest {
+	return []*extproc.ProcessingRequest{
+		{Request: &extproc.ProcessingRequest_RequestHeaders{RequestHeaders: &extproc.HttpHeaders{Headers: lbRequestHeaders(authorization)}}},
+		{Request: &extproc.ProcessingRequest_RequestBody{RequestBody: &extproc.HttpBody{Body: []byte(`{"name":`)}}},
+		{Request: &extproc.ProcessingRequest_RequestBody{RequestBody: &extproc.HttpBody{Body: []byte(`"item"}`)}}},
+		{Request: &extproc.ProcessingRequest_RequestTrailers{RequestTrailers: &extproc.HttpTrailers{Trailers: &core.HeaderMap{
+			Headers: []*core.HeaderValue{{Key: "x-checksum", RawValue: []byte("abc")}},
+		}}}},
+		{Request: &extproc.ProcessingRequest_ResponseHeaders{ResponseHeaders: &extproc.HttpHeaders{Headers: &core.HeaderMap{
+			Headers: []*core.HeaderValue{{Key: ":status", RawValue: []byte("200")}, {Key: "content-type", RawValue: []byte("application/json")}},
+		}}}},
+		{Request: &extproc.ProcessingRequest_ResponseBody{ResponseBody: &extproc.HttpBody{Body: []byte(`{"ok":true}`)}}},
+		{Request: &extproc.ProcessingRequest_ResponseTrailers{ResponseTrailers: &extproc.HttpTrailers{Trailers: &core.HeaderMap{
+			Headers: []*core.HeaderValue{{Key: "grpc-status", RawValue: []byte("0")}},
+		}}}},
+	}
+}
+
+// assertContinue checks that resp answers req without modifying it.
+func assertContinue(t *testing.T, req *extproc.ProcessingRequest, resp *extproc.ProcessingResponse) {
+	t.Helper()
+	var common *extproc.CommonResponse
+	switch req.GetRequest().(type) {
+	case *extproc.ProcessingRequest_RequestBody:
+		common = resp.GetRequestBody().GetResponse()
+	case *extproc.ProcessingRequest_ResponseHeaders:
+		common = resp.GetResponseHeaders().GetResponse()
+	case *extproc.ProcessingRequest_ResponseBody:
+		common = resp.GetResponseBody().GetResponse()
+	case *extproc.ProcessingRequest_RequestTrailers:
+		if resp.GetRequestTrailers() == nil || resp.GetRequestTrailers().GetHeaderMutation() != nil {
+			t.Errorf("response = %v, want unmodified request trailers", resp)
+		}
+		return
+	case *extproc.ProcessingRequest_ResponseTrailers:
+		if resp.GetResponseTrailers() == nil || resp.GetResponseTrailers().GetHeaderMutation() != nil {
+			t.Errorf("response = %v, want unmodified response trailers", resp)
+		}
+		return
+	}
+	if common == nil || common.GetStatus() != extproc.CommonResponse_CONTINUE ||
+		common.GetHeaderMutation() != nil || common.GetBodyMutation() != nil {
+		t.Errorf("response = %v, want CONTINUE without mutations for %T", resp, req.GetRequest())
+	}
+}
+
+func TestProcessOverGRPC(t *testing.T) {
+	client := extproc.NewExternalProcessorClient(startCalloutServer(t))
+	for _, tc := range clientScenarios() {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream, err := client.Process(ctx)
+			if err != nil {
+				t.Fatalf("Process: %v", err)
+			}
+			for i, req := range streamEvents(tc.authorization) {
+				if err := stream.Send(req); err != nil {
+					t.Fatalf("Send event %d: %v", i, err)
+				}
+				resp, err := stream.Recv()
+				if err != nil {
+					t.Fatalf("Recv event %d: %v", i, err)
+				}
+				if i > 0 {
+					assertContinue(t, req, resp)
+					continue
+				}
+				if tc.wantReason != "" {
+					immediate := resp.GetImmediateResponse()
+					if immediate.GetStatus().GetCode() != envoytype.StatusCode_Forbidden || string(immediate.GetBody()) != "denied: "+tc.wantReason {
+						t.Fatalf("response = %v, want immediate 403 %q", resp, "denied: "+tc.wantReason)
+					}
+					// The load balancer sends no further events after an
+					// immediate response.
+					break
+				}
+				common := resp.GetRequestHeaders().GetResponse()
+				if common.GetStatus() != extproc.CommonResponse_CONTINUE || common.GetBodyMutation() != nil {
+					t.Fatalf("response = %v, want CONTINUE with a header mutation", resp)
+				}
+				assertUIDHeader(t, common.GetHeaderMutation().GetSetHeaders(), tc.wantSubject)
+			}
+			if err := stream.CloseSend(); err != nil {
+				t.Fatalf("CloseSend: %v", err)
+			}
+			if _, err := stream.Recv(); err != io.EOF {
+				t.Errorf("Recv after CloseSend = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+// TestProcessOverGRPCStreamsAreIndependent interleaves two streams so that a
+// denial on one does not affect the other.
+func TestProcessOverGRPCStreamsAreIndependent(t *testing.T) {
+	client := extproc.NewExternalProcessorClient(startCalloutServer(t))
+	var valid, denied clientScenario
+	for _, tc := range clientScenarios() {
+		switch tc.name {
+		case "valid":
+			valid = tc
+		case "bad_signature":
+			denied = tc
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	allowedStream, err := client.Process(ctx)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	deniedStream, err := client.Process(ctx)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	allowedEvents, deniedEvents := streamEvents(valid.authorization), streamEvents(denied.authorization)
+
+	exchange := func(stream extproc.ExternalProcessor_ProcessClient, req *extproc.ProcessingRequest) *extproc.ProcessingResponse {
+		t.Helper()
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		return resp
+	}
+	if resp := exchange(deniedStream, deniedEvents[0]); resp.GetImmediateResponse() == nil {
+		t.Fatalf("denied stream response = %v, want immediate response", resp)
+	}
+	resp := exchange(allowedStream, allowedEvents[0])
+	assertUIDHeader(t, resp.GetRequestHeaders().GetResponse().GetHeaderMutation().GetSetHeaders(), valid.wantSubject)
+	for _, req := range allowedEvents[1:] {
+		assertContinue(t, req, exchange(allowedStream, req))
+	}
+}
@@ -2,23 +2,22 @@ package main
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
-	"github.com/lestrrat-go/jwx/v3/jwa"
-	jwxjwt "github.com/lestrrat-go/jwx/v3/jwt"
 	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -29,6 +28,11 @@ const (
 	bearerPrefix = "Bearer "
 	headerAuth   = "authorization"
 	headerUID    = "x-uid"
+	headerScopes = "x-scopes"
+	headerPath   = ":path"
+
+	headerAuthority = ":authority"
+	headerHost      = "host"
 )
 
 var (
@@ -36,41 +40,289 @@ var (
 	errInvalidAuthorization = errors.New("authorization header is invalid")
 )
 
+type serverConfig struct {
+	// tenantConfig is the default tenant. Its keys verify bearer JWTs; JWT
+	// authentication is disabled without keys.
+	tenantConfig
+	// tenants are selected by request host before the default tenant.
+	tenants []tenantConfig
+
+	apiKeys      *apiKeyStore
+	apiKeyHeader string
+
+	// subjectHeader and scopesHeader carry the identity to the origin.
+	subjectHeader string
+	scopesHeader  string
+
+	clientCertMode      clientCertMode
+	clientCertAllowlist clientCertAllowlist
+	clientCertHeader    string
+
+	rateLimiter *rateLimiter
+
+	// minter sets an internal token on allowed requests; nil disables it.
+	minter *tokenMinter
+
+	loadShedMode loadShedMode
+
+	// clock is used for token, API key and rate limit decisions; time.Now
+	// when nil.
+	clock func() time.Time
+
+	// logDecisions logs every authentication decision.
+	logDecisions bool
+}
+
 type calloutServer struct {
-	publicKey *rsa.PublicKey
+	serverConfig
+	tenantTable tenantTable
 }
 
-func newCalloutServer(publicKey *rsa.PublicKey) (*calloutServer, error) {
-	if publicKey == nil {
-		return nil, errors.New("public key is nil")
-	}
-	return &calloutServer{publicKey: publicKey}, nil
+// identity is the authenticated caller of a request, regardless of which
+// authentication mode produced it.
+type identity struct {
+	subject    string
+	scopes     []string
+	clientCert string
+	// claims holds the verified JWT claims; it is nil for other modes.
+	claims map[string]any
+	// claimHeaders are the header/value pairs mapped from claims.
+	claimHeaders [][2]string
+	// tenant is the tenant of the request host, whichever mode
+	// authenticated it.
+	tenant *tenant
 }
 
-func (s *calloutServer) Check(ctx context.Context, req *auth.CheckRequest) (*auth.CheckResponse, error) {
-	bearer, err := bearerFromRequest(req)
+// requestInfo is the part of an ext_authz or ext_proc request that the
+// authentication modes need.
+type requestInfo struct {
+	headers *core.HeaderMap
+	// path is the percent-decoded request path without the query string.
+	// nonCanonicalPath is set when it has dot segments, empty segments or
+	// encoded separators, which denies the request.
+	path             string
+	nonCanonicalPath bool
+	// host is the request :authority, which selects the tenant.
+	host string
+	// certificate and principal come from the ext_authz peer attributes and
+	// are empty for ext_proc, which does not carry them.
+	certificate string
+	principal   string
+}
+
+func newCalloutServer(cfg serverConfig) (*calloutServer, error) {
+	if len(cfg.keys) == 0 && len(cfg.tenants) == 0 && cfg.apiKeys == nil && cfg.clientCertMode != clientCertInstead {
+		return nil, errors.New("public key or API keys are required")
+	}
+	if cfg.apiKeyHeader == "" {
+		cfg.apiKeyHeader = defaultAPIKeyHeader
+	}
+	if cfg.subjectHeader == "" {
+		cfg.subjectHeader = headerUID
+	}
+	if cfg.scopesHeader == "" {
+		cfg.scopesHeader = headerScopes
+	}
+	if cfg.clientCertHeader == "" {
+		cfg.clientCertHeader = defaultClientCertHeader
+	}
+	if cfg.clientCertMode != clientCertOff && cfg.clientCertAllowlist.empty() {
+		return nil, errors.New("client certificate allowlist is empty")
+	}
+	if cfg.name == "" {
+		cfg.name = defaultTenantName
+	}
+	if cfg.clock == nil {
+		cfg.clock = time.Now
+	}
+	fallback, err := newTenant(cfg.tenantConfig, cfg.apiKeys != nil, cfg.clock)
 	if err != nil {
-		return buildDeniedResponse(int32(codes.PermissionDenied), err.Error()), nil
+		return nil, err
 	}
+	tenants := make([]*tenant, 0, len(cfg.tenants))
+	for _, tc := range cfg.tenants {
+		t, err := newTenant(tc, cfg.apiKeys != nil, cfg.clock)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", tc.name, err)
+		}
+		tenants = append(tenants, t)
+	}
+	table, err := newTenantTable(fallback, tenants)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.apiKeys != nil {
+		names := map[string]bool{fallback.name: true}
+		for _, t := range tenants {
+			names[t.name] = true
+		}
+		if err := cfg.apiKeys.checkTenants(names); err != nil {
+			return nil, err
+		}
+	}
+	return &calloutServer{serverConfig: cfg, tenantTable: table}, nil
+}
 
-	token, err := jwxjwt.Parse([]byte(bearer), jwxjwt.WithKey(jwa.RS256(), s.publicKey), jwxjwt.WithValidate(true))
+func (s *calloutServer) Check(ctx context.Context, req *auth.CheckRequest) (*auth.CheckResponse, error) {
+	info := requestInfoFromCheckRequest(req)
+	id, err := s.authenticate(info)
 	if err != nil {
+		s.logDecision("ext_authz", info, nil, err)
 		return buildDeniedResponse(int32(codes.PermissionDenied), err.Error()), nil
 	}
-	sub, ok := token.Subject()
-	if !ok || sub == "" {
-		return buildDeniedResponse(int32(codes.PermissionDenied), "subject is missing"), nil
+	if limited := s.rateLimit(info, id); limited != nil {
+		s.logDecision("ext_authz", info, id, limited)
+		return buildRateLimitedResponse(limited), nil
 	}
+	headers, remove, err := s.identityHeaders(id)
+	if err != nil {
+		s.logDecision("ext_authz", info, id, err)
+		return buildDeniedResponse(int32(codes.Internal), err.Error()), nil
+	}
+	s.logDecision("ext_authz", info, id, nil)
+	resp := buildOkResponse(headers)
+	resp.GetOkResponse().HeadersToRemove = remove
+	return resp, nil
+}
 
-	return buildOkResponse(sub), nil
+// logDecision logs the outcome of a request when logging.decisions is set.
+// The query string is dropped from the path.
+func (s *calloutServer) logDecision(api string, info requestInfo, id *identity, err error) {
+	if !s.logDecisions {
+		return
+	}
+	var subject string
+	if id != nil {
+		subject = id.subject
+	}
+	tenant := s.tenantTable.match(info.host).name
+	if err != nil {
+		log.Printf("%s deny tenant=%q path=%q subject=%q reason=%q", api, tenant, info.path, subject, err)
+		return
+	}
+	log.Printf("%s allow tenant=%q path=%q subject=%q", api, tenant, info.path, subject)
 }
 
-func bearerFromRequest(req *auth.CheckRequest) (string, error) {
+func requestInfoFromCheckRequest(req *auth.CheckRequest) requestInfo {
 	httpAttrs := req.GetAttributes().GetRequest().GetHttp()
 	// Service Extensions ext_authz can populate header_map instead of headers,
 	// so we read from header_map here. If your environment fills headers,
 	// adjust this to read the headers field instead.
-	return bearerFromHeaderMap(httpAttrs.GetHeaderMap())
+	headerMap := httpAttrs.GetHeaderMap()
+	path := httpAttrs.GetPath()
+	if path == "" {
+		path = getHeaderValueFromHeaderMap(headerMap, headerPath)
+	}
+	host := httpAttrs.GetHost()
+	if host == "" {
+		host = requestHost(headerMap)
+	}
+	path, canonical := canonicalPath(path)
+	source := req.GetAttributes().GetSource()
+	return requestInfo{
+		headers:          headerMap,
+		path:             path,
+		nonCanonicalPath: !canonical,
+		host:             host,
+		certificate:      source.GetCertificate(),
+		principal:        source.GetPrincipal(),
+	}
+}
+
+func requestInfoFromHttpHeaders(headers *extproc.HttpHeaders) requestInfo {
+	headerMap := headers.GetHeaders()
+	path, canonical := canonicalPath(getHeaderValueFromHeaderMap(headerMap, headerPath))
+	return requestInfo{
+		headers:          headerMap,
+		path:             path,
+		nonCanonicalPath: !canonical,
+		host:             requestHost(headerMap),
+	}
+}
+
+func requestHost(headerMap *core.HeaderMap) string {
+	if host := getHeaderValueFromHeaderMap(headerMap, headerAuthority); host != "" {
+		return host
+	}
+	return getHeaderValueFromHeaderMap(headerMap, headerHost)
+}
+
+// authenticate checks the client certificate according to clientCertMode and
+// then runs the credential-based authentication unless the certificate
+// replaces it.
+func (s *calloutServer) authenticate(req requestInfo) (*identity, error) {
+	if req.nonCanonicalPath {
+		// Routes and API key prefixes cannot be matched reliably.
+		return nil, errInvalidPath
+	}
+	t := s.tenantTable.match(req.host)
+	var certID string
+	if s.clientCertMode != clientCertOff {
+		var err error
+		if certID, err = s.authenticateClientCert(req); err != nil {
+			return nil, err
+		}
+	}
+	if s.clientCertMode == clientCertInstead {
+		return &identity{subject: certID, clientCert: certID, tenant: t}, nil
+	}
+	id, err := s.authenticateCredentials(t, req)
+	if err != nil {
+		return nil, err
+	}
+	id.clientCert = certID
+	id.tenant = t
+	return id, nil
+}
+
+// authenticateCredentials runs the authentication modes allowed for the
+// request host and path. An API key takes precedence when the header is
+// present and the route accepts API keys; otherwise the request must carry a
+// bearer JWT.
+func (s *calloutServer) authenticateCredentials(t *tenant, req requestInfo) (*identity, error) {
+	modes := s.modesFor(t, req.path)
+	if modes == 0 {
+		// Only the default tenant can have neither keys nor API keys.
+		return nil, errUnknownHost
+	}
+	if modes.has(authModeAPIKey) {
+		if key := getHeaderValueFromHeaderMap(req.headers, s.apiKeyHeader); key != "" {
+			return s.apiKeys.authenticate(key, t.name, req.path, s.clock())
+		}
+		if !modes.has(authModeJWT) {
+			return nil, errMissingAPIKey
+		}
+	}
+	return s.authenticateJWT(t, req)
+}
+
+func (s *calloutServer) modesFor(t *tenant, path string) authModes {
+	if modes, ok := t.routes.match(path); ok {
+		return modes
+	}
+	var modes authModes
+	if t.verifier != nil {
+		modes |= authModeJWT
+	}
+	if s.apiKeys != nil {
+		modes |= authModeAPIKey
+	}
+	return modes
+}
+
+func (s *calloutServer) authenticateJWT(t *tenant, req requestInfo) (*identity, error) {
+	bearer, err := bearerFromHeaderMap(req.headers)
+	if err != nil {
+		return nil, err
+	}
+	return t.verify(bearer)
+}
+
+func (s *calloutServer) rateLimit(req requestInfo, id *identity) *rateLimitedError {
+	if s.rateLimiter == nil {
+		return nil
+	}
+	return s.rateLimiter.allow(req, id, s.clock())
 }
 
 func bearerFromHeaderMap(headerMap *core.HeaderMap) (string, error) {
@@ -106,17 +358,72 @@ func getHeaderValueFromHeaderMap(headerMap *core.HeaderMap, key string) string {
 	return ""
 }
 
-func buildOkResponse(uid string) *auth.CheckResponse {
+// identityHeaders returns the headers that carry id to the origin and the
+// identity headers to remove because id does not set them, so that clients
+// cannot supply their own scopes, certificate identity or tenant claim
+// headers.
+func (s *calloutServer) identityHeaders(id *identity) ([]*core.HeaderValueOption, []string, error) {
+	set := [][2]string{{s.subjectHeader, id.subject}}
+	var remove []string
+	for _, h := range id.tenant.claimHeaders {
+		if !slices.ContainsFunc(id.claimHeaders, func(pair [2]string) bool { return pair[0] == h.header }) {
+			remove = append(remove, h.header)
+		}
+	}
+	if len(id.scopes) > 0 {
+		set = append(set, [2]string{s.scopesHeader, strings.Join(id.scopes, " ")})
+	} else {
+		remove = append(remove, s.scopesHeader)
+	}
+	if id.clientCert != "" {
+		set = append(set, [2]string{s.clientCertHeader, id.clientCert})
+	} else {
+		remove = append(remove, s.clientCertHeader)
+	}
+	set = append(set, id.claimHeaders...)
+	if s.minter != nil {
+		token, err := s.minter.mint(id, s.clock())
+		if err != nil {
+			log.Printf("mint internal token error: %v", err)
+			return nil, nil, errMintInternalToken
+		}
+		set = append(set, [2]string{s.minter.header, token})
+	}
+	return headerValueOptions(set), remove, nil
+}
+
+// identityHeaderNames are the headers that carry an authenticated identity
+// to the origin, removed from requests forwarded without one.
+func (s *calloutServer) identityHeaderNames() []string {
+	names := []string{s.subjectHeader, s.scopesHeader, s.clientCertHeader}
+	if s.minter != nil {
+		names = append(names, s.minter.header)
+	}
+	for _, t := range append([]tenantConfig{s.tenantConfig}, s.tenants...) {
+		for _, h := range t.claimHeaders {
+			names = append(names, h.header)
+		}
+	}
+	return names
+}
+
+func headerValueOptions(pairs [][2]string) []*core.HeaderValueOption {
+	headers := make([]*core.HeaderValueOption, 0, len(pairs))
+	for _, h := range pairs {
+		headers = append(headers, &core.HeaderValueOption{
+			Header: &core.HeaderValue{Key: h[0], Value: h[1], RawValue: []byte(h[1])},
+			Append: wrapperspb.Bool(false),
+		})
+	}
+	return headers
+}
+
+func buildOkResponse(headers []*core.HeaderValueOption) *auth.CheckResponse {
 	return &auth.CheckResponse{
 		Status: &status.Status{Code: int32(codes.OK)},
 		HttpResponse: &auth.CheckResponse_OkResponse{
 			OkResponse: &auth.OkHttpResponse{
-				Headers: []*core.HeaderValueOption{
-					{
-						Header: &core.HeaderValue{Key: headerUID, Value: uid, RawValue: []byte(uid)},
-						Append: wrapperspb.Bool(false),
-					},
-				},
+				Headers: headers,
 			},
 		},
 	}
@@ -134,30 +441,30 @@ func buildDeniedResponse(code int32, msg string) *auth.CheckResponse {
 	}
 }
 
-func parseRSAPublicKey(pemString string) (*rsa.PublicKey, error) {
-	block, _ := pem.Decode([]byte(pemString))
-	if block == nil {
-		return nil, errors.New("invalid PEM data")
-	}
-
-	if block.Type != "PUBLIC KEY" {
-		return nil, fmt.Errorf("unsupported PEM type: %s", block.Type)
-	}
-
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("parse PKIX public key: %w", err)
-	}
-	rsaPub, ok := pub.(*rsa.PublicKey)
-	if !ok {
-		return nil, errors.New("invalid key type")
+func buildRateLimitedResponse(limited *rateLimitedError) *auth.CheckResponse {
+	headers := headerValueOptions(limited.headers())
+	return &auth.CheckResponse{
+		Status: &status.Status{Code: int32(codes.ResourceExhausted), Message: limited.Error()},
+		HttpResponse: &auth.CheckResponse_DeniedResponse{
+			DeniedResponse: &auth.DeniedHttpResponse{
+				Status:  &envoytype.HttpStatus{Code: envoytype.StatusCode_TooManyRequests},
+				Headers: headers,
+				Body:    fmt.Sprintf("denied: %s", limited.Error()),
+			},
+		},
 	}
-	return rsaPub, nil
 }
 
 func (s *calloutServer) Process(stream extproc.ExternalProcessor_ProcessServer) error {
+	return serveProcess(stream, s.handleProcessingRequest)
+}
+
+// serveProcess answers the messages of a Process stream with handle until
+// the client closes it.
+func serveProcess(stream grpc.ServerStream, handle func(*extproc.ProcessingRequest) (*extproc.ProcessingResponse, error)) error {
 	for {
-		req, err := stream.Recv()
+		req := new(extproc.ProcessingRequest)
+		err := stream.RecvMsg(req)
 		if err == io.EOF {
 			return nil
 		}
@@ -165,14 +472,14 @@ func (s *calloutServer) Process(stream extproc.ExternalProcessor_ProcessServer)
 			return err
 		}
 
-		resp, err := s.handleProcessingRequest(req)
+		resp, err := handle(req)
 		if err != nil {
 			return err
 		}
 		if resp == nil {
 			continue
 		}
-		if err := stream.Send(resp); err != nil {
+		if err := stream.SendMsg(resp); err != nil {
 			return err
 		}
 	}
@@ -186,21 +493,25 @@ func (s *calloutServer) handleProcessingRequest(req *extproc.ProcessingRequest)
 }
 
 func (s *calloutServer) handleRequestHeaders(headers *extproc.HttpHeaders) (*extproc.ProcessingResponse, error) {
-	bearer, err := bearerFromHeaderMap(headers.GetHeaders())
+	info := requestInfoFromHttpHeaders(headers)
+	id, err := s.authenticate(info)
 	if err != nil {
+		s.logDecision("ext_proc", info, nil, err)
 		return buildImmediateDeniedProcessingResponse(err.Error()), nil
 	}
-
-	token, err := jwxjwt.Parse([]byte(bearer), jwxjwt.WithKey(jwa.RS256(), s.publicKey), jwxjwt.WithValidate(true))
+	if limited := s.rateLimit(info, id); limited != nil {
+		s.logDecision("ext_proc", info, id, limited)
+		return buildImmediateRateLimitedProcessingResponse(limited), nil
+	}
+	set, remove, err := s.identityHeaders(id)
 	if err != nil {
+		s.logDecision("ext_proc", info, id, err)
 		return buildImmediateDeniedProcessingResponse(err.Error()), nil
 	}
-	sub, ok := token.Subject()
-	if !ok || sub == "" {
-		return buildImmediateDeniedProcessingResponse("subject is missing"), nil
-	}
-
-	return buildRequestHeadersProcessingResponse(sub), nil
+	s.logDecision("ext_proc", info, id, nil)
+	resp := buildRequestHeadersProcessingResponse(set)
+	resp.GetRequestHeaders().GetResponse().GetHeaderMutation().RemoveHeaders = remove
+	return resp, nil
 }
 
 func buildContinueProcessingResponse(req *extproc.ProcessingRequest) *extproc.ProcessingResponse {
@@ -254,19 +565,14 @@ func buildContinueProcessingResponse(req *extproc.ProcessingRequest) *extproc.Pr
 	}
 }
 
-func buildRequestHeadersProcessingResponse(uid string) *extproc.ProcessingResponse {
+func buildRequestHeadersProcessingResponse(headers []*core.HeaderValueOption) *extproc.ProcessingResponse {
 	return &extproc.ProcessingResponse{
 		Response: &extproc.ProcessingResponse_RequestHeaders{
 			RequestHeaders: &extproc.HeadersResponse{
 				Response: &extproc.CommonResponse{
 					Status: extproc.CommonResponse_CONTINUE,
 					HeaderMutation: &extproc.HeaderMutation{
-						SetHeaders: []*core.HeaderValueOption{
-							{
-								Header: &core.HeaderValue{Key: headerUID, Value: uid, RawValue: []byte(uid)},
-								Append: wrapperspb.Bool(false),
-							},
-						},
+						SetHeaders: headers,
 					},
 				},
 			},
@@ -285,37 +591,82 @@ func buildImmediateDeniedProcessingResponse(msg string) *extproc.ProcessingRespo
 	}
 }
 
+func buildImmediateRateLimitedProcessingResponse(limited *rateLimitedError) *extproc.ProcessingResponse {
+	headers := headerValueOptions(limited.headers())
+	return &extproc.ProcessingResponse{
+		Response: &extproc.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &extproc.ImmediateResponse{
+				Status:  &envoytype.HttpStatus{Code: envoytype.StatusCode_TooManyRequests},
+				Headers: &extproc.HeaderMutation{SetHeaders: headers},
+				Body:    []byte(fmt.Sprintf("denied: %s", limited.Error())),
+			},
+		},
+	}
+}
+
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	configFile := flag.String("config", "", "YAML or JSON config file; environment variables override it")
+	validateOnly := flag.Bool("validate-config", false, "validate the config, print it normalized and exit")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile, os.Getenv)
+	var opts *options
+	if err == nil {
+		opts, err = cfg.resolve()
 	}
-	publicKeyPEM := os.Getenv("PUBLIC_KEY_PEM")
-	if publicKeyPEM == "" {
-		log.Fatalf("config error: PUBLIC_KEY_PEM is required")
+	if *validateOnly {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+			os.Exit(1)
+		}
+		if err := cfg.writeNormalized(os.Stdout); err != nil {
+			log.Fatalf("print config error: %v", err)
+		}
+		return
 	}
-
-	publicKeyPEM = strings.ReplaceAll(publicKeyPEM, "\\n", "\n")
-	publicKey, err := parseRSAPublicKey(publicKeyPEM)
 	if err != nil {
-		log.Fatalf("read public key error: %v", err)
+		log.Fatalf("config error: %v", err)
 	}
 
-	server, err := newCalloutServer(publicKey)
+	var unaryLimiter, processLimiter *adaptiveLimiter
+	if opts.concurrency != nil {
+		if unaryLimiter, err = newAdaptiveLimiter("unary", *opts.concurrency); err != nil {
+			log.Fatalf("config error: %v", err)
+		}
+		if processLimiter, err = newAdaptiveLimiter("process", *opts.concurrency); err != nil {
+			log.Fatalf("config error: %v", err)
+		}
+	}
+
+	server, err := newCalloutServer(opts.server)
 	if err != nil {
 		log.Fatalf("callout server error: %v", err)
 	}
 
-	listener, err := net.Listen("tcp", ":"+port)
+	listener, err := net.Listen("tcp", ":"+cfg.Port)
 	if err != nil {
 		log.Fatalf("listen error: %v", err)
 	}
 
-	grpcServer := grpc.NewServer()
+	if cfg.AdminPort != "" {
+		go serveAdmin(cfg.AdminPort, opts.server.minter)
+	}
+
+	var serverOpts []grpc.ServerOption
+	if unaryLimiter != nil {
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(unaryLimiter.unaryInterceptor(server.shedUnary)),
+			grpc.ChainStreamInterceptor(processLimiter.streamInterceptor(server.shedProcess)),
+		)
+	}
+	grpcServer := grpc.NewServer(serverOpts...)
 	auth.RegisterAuthorizationServer(grpcServer, server)
 	extproc.RegisterExternalProcessorServer(grpcServer, server)
+	if opts.rls != nil {
+		rls.RegisterRateLimitServiceServer(grpcServer, opts.rls)
+	}
 
-	log.Printf("callout-server listening on :%s", port)
+	log.Printf("callout-server listening on :%s", cfg.Port)
 	if err := grpcServer.Serve(listener); err != nil {
 		log.Fatalf("grpc server error: %v", err)
 	}
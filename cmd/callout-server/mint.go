@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+)
+
+const (
+	defaultInternalTokenHeader = "x-internal-token"
+	defaultInternalTokenIssuer = "callout-server"
+	defaultInternalTokenTTL    = time.Minute
+
+	// jwksPath serves the internal token keys on the admin port.
+	jwksPath = "/.well-known/jwks.json"
+)
+
+var errMintInternalToken = errors.New("internal token could not be minted")
+
+// internalTokenClaims are set by the minter and cannot be copied from the
+// client token.
+var internalTokenClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "iat": true, "nbf": true, "exp": true, "act": true, "scope": true,
+}
+
+// internalTokenConfig is the internal_token section of the config file.
+// Minting is disabled without a private key.
+type internalTokenConfig struct {
+	// PrivateKeyPEM or PrivateKeyPEMFile is an RSA (RS256), P-256 (ES256)
+	// or Ed25519 (EdDSA) key in PKCS#8, PKCS#1 or SEC 1 PEM. Env:
+	// INTERNAL_TOKEN_PRIVATE_KEY_PEM.
+	PrivateKeyPEM     string `yaml:"private_key_pem,omitempty"`
+	PrivateKeyPEMFile string `yaml:"private_key_pem_file,omitempty"`
+	// Kid defaults to the RFC 7638 thumbprint of the public key.
+	Kid string `yaml:"kid"`
+	// Issuer is the iss claim.
+	Issuer string `yaml:"issuer"`
+	// Audience is the aud claim, the backend the token is for. Env:
+	// INTERNAL_TOKEN_AUDIENCE.
+	Audience string `yaml:"audience"`
+	// Actor is the act.sub claim naming the edge; the issuer when empty.
+	Actor string        `yaml:"actor"`
+	TTL   time.Duration `yaml:"ttl"`
+	// Header carries the token to the origin.
+	Header string `yaml:"header"`
+	// Claims are copied from the verified client token when present.
+	Claims []string `yaml:"claims"`
+}
+
+func (c internalTokenConfig) enabled() bool {
+	return c.PrivateKeyPEM != "" || c.PrivateKeyPEMFile != ""
+}
+
+// tokenMinter signs the internal JWTs set on allowed requests, so origins
+// can verify the caller instead of trusting a plain x-uid header.
+type tokenMinter struct {
+	key      crypto.PrivateKey
+	alg      string
+	kid      string
+	issuer   string
+	audience string
+	actor    string
+	ttl      time.Duration
+	header   string
+	claims   []string
+	// jwks is the public JWKS document served at jwksPath.
+	jwks []byte
+}
+
+func newTokenMinter(cfg internalTokenConfig) (*tokenMinter, error) {
+	value := cfg.PrivateKeyPEM
+	if cfg.PrivateKeyPEMFile != "" {
+		if value != "" {
+			return nil, errors.New("private_key_pem and private_key_pem_file are mutually exclusive")
+		}
+		raw, err := os.ReadFile(cfg.PrivateKeyPEMFile)
+		if err != nil {
+			return nil, err
+		}
+		value = string(raw)
+	}
+	key, err := parsePrivateKey(value)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Audience == "" {
+		return nil, errors.New("audience is required")
+	}
+	if cfg.TTL < 0 {
+		return nil, errors.New("ttl must not be negative")
+	}
+	for _, claim := range cfg.Claims {
+		if claim == "" || internalTokenClaims[claim] {
+			return nil, fmt.Errorf("claim %q cannot be copied", claim)
+		}
+	}
+	m := &tokenMinter{
+		key:      key,
+		kid:      cfg.Kid,
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		actor:    cfg.Actor,
+		ttl:      cfg.TTL,
+		header:   cfg.Header,
+		claims:   cfg.Claims,
+	}
+	if m.issuer == "" {
+		m.issuer = defaultInternalTokenIssuer
+	}
+	if m.actor == "" {
+		m.actor = m.issuer
+	}
+	if m.ttl == 0 {
+		m.ttl = defaultInternalTokenTTL
+	}
+	if m.header == "" {
+		m.header = defaultInternalTokenHeader
+	}
+
+	jwk, err := m.publicJWK()
+	if err != nil {
+		return nil, err
+	}
+	if m.kid == "" {
+		m.kid = jwkThumbprint(jwk)
+	}
+	jwk.Kid = m.kid
+	if m.jwks, err = json.Marshal(jwtverify.JWKS{Keys: []jwtverify.JWK{jwk}}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parsePrivateKey accepts the PEM encodings produced by openssl for the
+// supported key types.
+func parsePrivateKey(pemString string) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemString))
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+	var key crypto.PrivateKey
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	return key, nil
+}
+
+// publicJWK sets m.alg from the key type and returns the public key as a
+// JWK without kid.
+func (m *tokenMinter) publicJWK() (jwtverify.JWK, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	var jwk jwtverify.JWK
+	var pub crypto.PublicKey
+	switch k := m.key.(type) {
+	case *rsa.PrivateKey:
+		m.alg, pub = jwtverify.AlgRS256, &k.PublicKey
+		jwk = jwtverify.JWK{Kty: "RSA", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return jwk, errors.New("EC private key must use P-256")
+		}
+		m.alg, pub = jwtverify.AlgES256, &k.PublicKey
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		jwk = jwtverify.JWK{Kty: "EC", Crv: "P-256", X: b64(x), Y: b64(y)}
+	case ed25519.PrivateKey:
+		m.alg, pub = jwtverify.AlgEdDSA, k.Public()
+		jwk = jwtverify.JWK{Kty: "OKP", Crv: "Ed25519", X: b64(k.Public().(ed25519.PublicKey))}
+	default:
+		return jwk, fmt.Errorf("unsupported private key type %T", m.key)
+	}
+	// The verifier applies the same key checks as the origins will.
+	if _, err := jwtverify.NewVerifier([]jwtverify.Key{{Algorithm: m.alg, PublicKey: pub}}, jwtverify.Options{}); err != nil {
+		return jwk, err
+	}
+	jwk.Alg = m.alg
+	jwk.Use = "sig"
+	return jwk, nil
+}
+
+// jwkThumbprint is the RFC 7638 SHA-256 thumbprint: the required members in
+// lexicographic order without whitespace, which json.Marshal produces for a
+// map.
+func jwkThumbprint(jwk jwtverify.JWK) string {
+	members := map[string]string{"kty": jwk.Kty}
+	switch jwk.Kty {
+	case "RSA":
+		members["n"], members["e"] = jwk.N, jwk.E
+	case "EC":
+		members["crv"], members["x"], members["y"] = jwk.Crv, jwk.X, jwk.Y
+	case "OKP":
+		members["crv"], members["x"] = jwk.Crv, jwk.X
+	}
+	raw, _ := json.Marshal(members)
+	sum := sha256.Sum256(raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// mint returns an internal token for id: sub is the authenticated subject,
+// act names the edge, scope carries the API key scopes and the configured
+// claims are copied from the client token.
+func (m *tokenMinter) mint(id *identity, now time.Time) (string, error) {
+	claims := make(map[string]any, len(m.claims)+7)
+	for _, name := range m.claims {
+		if value, ok := id.claims[name]; ok {
+			claims[name] = value
+		}
+	}
+	if len(id.scopes) > 0 {
+		claims["scope"] = strings.Join(id.scopes, " ")
+	}
+	claims["iss"] = m.issuer
+	claims["sub"] = id.subject
+	claims["aud"] = m.audience
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(m.ttl).Unix()
+	claims["act"] = map[string]string{"sub": m.actor}
+
+	header, err := json.Marshal(jwtverify.Header{Alg: m.alg, Kid: m.kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	signingInput := b64(header) + "." + b64(payload)
+	sig, err := m.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + b64(sig), nil
+}
+
+func (m *tokenMinter) sign(signingInput []byte) ([]byte, error) {
+	digest := sha256.Sum256(signingInput)
+	switch k := m.key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS uses the fixed-size R||S encoding, not ASN.1.
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, signingInput), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", m.key)
+	}
+}
+
+// serveJWKS serves the public key of the internal tokens. Origins may cache
+// it for five minutes.
+func (m *tokenMinter) serveJWKS(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_, _ = w.Write(m.jwks)
+}
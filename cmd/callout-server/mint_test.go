@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc/codes"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func privateKeyPEMs(t *testing.T) map[string]string {
+	t.Helper()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate Ed25519 key: %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatalf("marshal Ed25519 key: %v", err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(testECKey)
+	if err != nil {
+		t.Fatalf("marshal EC key: %v", err)
+	}
+	encode := func(typ string, der []byte) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}))
+	}
+	return map[string]string{
+		jwtverify.AlgRS256: encode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(jwtverifytest.PrivateKey())),
+		jwtverify.AlgES256: encode("EC PRIVATE KEY", sec1),
+		jwtverify.AlgEdDSA: encode("PRIVATE KEY", pkcs8),
+	}
+}
+
+// fetchJWKSVerifier builds the verifier an origin would from the admin
+// JWKS endpoint.
+func fetchJWKSVerifier(t *testing.T, minter *tokenMinter) *jwtverify.Verifier {
+	t.Helper()
+	admin := httptest.NewServer(adminHandler(minter))
+	defer admin.Close()
+	resp, err := http.Get(admin.URL + jwksPath)
+	if err != nil {
+		t.Fatalf("GET %s: %v", jwksPath, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("GET %s = %d %q", jwksPath, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	keys, err := jwtverify.ParseJWKS(body)
+	if err != nil {
+		t.Fatalf("ParseJWKS: %v\n%s", err, body)
+	}
+	verifier, err := jwtverify.NewVerifier(keys, jwtverify.Options{Now: func() time.Time { return jwtverifytest.Now }})
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	return verifier
+}
+
+func TestInternalTokenMinting(t *testing.T) {
+	for alg, keyPEM := range privateKeyPEMs(t) {
+		t.Run(alg, func(t *testing.T) {
+			minter, err := newTokenMinter(internalTokenConfig{
+				PrivateKeyPEM: keyPEM,
+				Audience:      "backend",
+				Actor:         "edge",
+				TTL:           30 * time.Second,
+				Claims:        []string{"email", "missing"},
+			})
+			if err != nil {
+				t.Fatalf("newTokenMinter: %v", err)
+			}
+			if minter.alg != alg {
+				t.Errorf("alg = %q, want %q", minter.alg, alg)
+			}
+			key, err := keyConfig{PublicKeyPEM: jwtverifytest.PublicKeyPEM()}.load()
+			if err != nil {
+				t.Fatalf("load key: %v", err)
+			}
+			server, err := newCalloutServer(serverConfig{
+				tenantConfig: tenantConfig{keys: []jwtverify.Key{key}},
+				minter:       minter,
+				clock:        func() time.Time { return jwtverifytest.Now },
+			})
+			if err != nil {
+				t.Fatalf("newCalloutServer: %v", err)
+			}
+			client := signRS256(map[string]any{"sub": "u1", "email": "u1@example.com", "role": "admin"})
+			resp, err := server.Check(context.Background(), &auth.CheckRequest{
+				Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+					Http: &auth.AttributeContext_HttpRequest{HeaderMap: conformanceHeaderMap(bearerPrefix + client)},
+				}},
+			})
+			if err != nil || resp.GetStatus().GetCode() != int32(codes.OK) {
+				t.Fatalf("Check = %v, %v; want OK", resp.GetStatus(), err)
+			}
+			var token string
+			for _, h := range resp.GetOkResponse().GetHeaders() {
+				if h.GetHeader().GetKey() == defaultInternalTokenHeader {
+					token = h.GetHeader().GetValue()
+				}
+			}
+			if token == "" {
+				t.Fatalf("headers = %v, want %s", resp.GetOkResponse().GetHeaders(), defaultInternalTokenHeader)
+			}
+
+			claims, err := fetchJWKSVerifier(t, minter).Verify(token)
+			if err != nil {
+				t.Fatalf("verify internal token: %v", err)
+			}
+			if claims.Subject != "u1" || claims.Issuer != defaultInternalTokenIssuer || len(claims.Audience) != 1 || claims.Audience[0] != "backend" {
+				t.Errorf("claims = %+v", claims)
+			}
+			if got := claims.ExpiresAt.Sub(*claims.IssuedAt); got != 30*time.Second {
+				t.Errorf("exp - iat = %v, want 30s", got)
+			}
+			if act, _ := claims.Raw["act"].(map[string]any); act["sub"] != "edge" {
+				t.Errorf("act = %v, want sub edge", claims.Raw["act"])
+			}
+			if claims.Raw["email"] != "u1@example.com" || claims.Raw["role"] != nil || claims.Raw["missing"] != nil {
+				t.Errorf("copied claims = %v, want only email", claims.Raw)
+			}
+		})
+	}
+}
+
+func TestInternalTokenKidIsThumbprint(t *testing.T) {
+	minter, err := newTokenMinter(internalTokenConfig{PrivateKeyPEM: privateKeyPEMs(t)[jwtverify.AlgRS256], Audience: "backend"})
+	if err != nil {
+		t.Fatalf("newTokenMinter: %v", err)
+	}
+	jwk, err := minter.publicJWK()
+	if err != nil {
+		t.Fatalf("publicJWK: %v", err)
+	}
+	if got := jwkThumbprint(jwk); got != minter.kid || !strings.Contains(string(minter.jwks), `"kid":"`+got+`"`) {
+		t.Errorf("kid = %q, thumbprint = %q, jwks = %s", minter.kid, got, minter.jwks)
+	}
+	// The example of RFC 7638 section 3.1.
+	rfc := jwtverify.JWK{
+		Kty: "RSA",
+		E:   "AQAB",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMs" +
+			"tn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91" +
+			"CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+	}
+	if got := jwkThumbprint(rfc); got != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("RFC 7638 example thumbprint = %q", got)
+	}
+}
+
+func TestInternalTokenConfig(t *testing.T) {
+	keyPEM := privateKeyPEMs(t)[jwtverify.AlgES256]
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate P-384 key: %v", err)
+	}
+	der, _ := x509.MarshalECPrivateKey(p384)
+	p384PEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	for name, cfg := range map[string]internalTokenConfig{
+		"missing audience":   {PrivateKeyPEM: keyPEM},
+		"reserved claim":     {PrivateKeyPEM: keyPEM, Audience: "backend", Claims: []string{"sub"}},
+		"negative ttl":       {PrivateKeyPEM: keyPEM, Audience: "backend", TTL: -time.Second},
+		"P-384 key":          {PrivateKeyPEM: p384PEM, Audience: "backend"},
+		"public key":         {PrivateKeyPEM: jwtverifytest.PublicKeyPEM(), Audience: "backend"},
+		"inline and file":    {PrivateKeyPEM: keyPEM, PrivateKeyPEMFile: "key.pem", Audience: "backend"},
+		"missing key file":   {PrivateKeyPEMFile: "does-not-exist.pem", Audience: "backend"},
+		"invalid PEM inline": {PrivateKeyPEM: "not a key", Audience: "backend"},
+	} {
+		if _, err := newTokenMinter(cfg); err == nil {
+			t.Errorf("%s: newTokenMinter succeeded, want error", name)
+		}
+	}
+
+	escaped := strings.ReplaceAll(keyPEM, "\n", `\n`)
+	cfg, err := loadConfig(writeFile(t, "callout.yaml", "schema_version: 1\ninternal_token:\n  audience: from-file\n  header: x-edge-token\n"),
+		envMap(map[string]string{
+			"PUBLIC_KEY_PEM":                 jwtverifytest.PublicKeyPEM(),
+			"INTERNAL_TOKEN_PRIVATE_KEY_PEM": escaped,
+			"INTERNAL_TOKEN_AUDIENCE":        "backend",
+		}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	opts, err := cfg.resolve()
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if m := opts.server.minter; m == nil || m.audience != "backend" || m.header != "x-edge-token" || m.alg != jwtverify.AlgES256 {
+		t.Errorf("minter = %+v", opts.server.minter)
+	}
+	var out bytes.Buffer
+	if err := cfg.writeNormalized(&out); err != nil {
+		t.Fatalf("writeNormalized: %v", err)
+	}
+	if strings.Contains(out.String(), "PRIVATE KEY") {
+		t.Errorf("normalized config prints the private key:\n%s", out.String())
+	}
+}
+
+func TestShedRemovesIdentityHeaders(t *testing.T) {
+	minter, err := newTokenMinter(internalTokenConfig{PrivateKeyPEM: privateKeyPEMs(t)[jwtverify.AlgEdDSA], Audience: "backend"})
+	if err != nil {
+		t.Fatalf("newTokenMinter: %v", err)
+	}
+	server := newTenantsServer(t)
+	server.minter = minter
+	server.loadShedMode = loadShedAllow
+	resp, err := server.shedUnary(&auth.CheckRequest{})
+	if err != nil {
+		t.Fatalf("shedUnary: %v", err)
+	}
+	got := resp.(*auth.CheckResponse).GetOkResponse().GetHeadersToRemove()
+	want := []string{headerUID, headerScopes, defaultClientCertHeader, defaultInternalTokenHeader, "x-org"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("headers to remove = %v, want %v", got, want)
+	}
+}
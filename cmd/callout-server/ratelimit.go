@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerRetryAfter         = "retry-after"
+	headerRateLimitLimit     = "x-ratelimit-limit"
+	headerRateLimitRemaining = "x-ratelimit-remaining"
+	headerRateLimitReset     = "x-ratelimit-reset"
+
+	// bucketSweepInterval is how many new buckets are created between sweeps
+	// of idle (fully refilled) buckets.
+	bucketSweepInterval = 1024
+)
+
+var (
+	rateLimitAllowed = expvar.NewMap("ratelimit_allowed_total")
+	rateLimitLimited = expvar.NewMap("ratelimit_limited_total")
+)
+
+// rateLimitFile is the on-disk format of RATE_LIMIT_FILE. Each rule applies to
+// a path prefix (longest prefix wins) and keys its buckets by the subject or a
+// verified JWT claim ("claim:<name>"). Request headers cannot be keys: the
+// client picks their values and would get a fresh bucket with each one.
+type rateLimitFile struct {
+	Rules []rateLimitRuleConfig `json:"rules"`
+}
+
+type rateLimitRuleConfig struct {
+	Prefix            string  `json:"prefix"`
+	Key               string  `json:"key,omitempty"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+type rateLimitKeyKind int
+
+const (
+	rateLimitKeySubject rateLimitKeyKind = iota
+	rateLimitKeyClaim
+)
+
+type rateLimitRule struct {
+	prefix  string
+	keyKind rateLimitKeyKind
+	keyName string
+	rate    float64
+	burst   float64
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*tokenBucket
+	created int
+}
+
+// bucketKey scopes a key to the tenant of the request, so the same subject
+// on two tenants has two buckets.
+type bucketKey struct {
+	tenant string
+	value  string
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is an in-process token-bucket limiter. Buckets live in memory
+// of a single callout-server instance, so limits are per instance.
+type rateLimiter struct {
+	rules []*rateLimitRule
+}
+
+// rateLimitedError is returned when a request exceeds its bucket.
+type rateLimitedError struct {
+	limit      int
+	remaining  int
+	retryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return "rate limit exceeded"
+}
+
+func loadRateLimiter(path string) (*rateLimiter, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file rateLimitFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parse rate limit file: %w", err)
+	}
+	return newRateLimiter(file.Rules)
+}
+
+func newRateLimiter(configs []rateLimitRuleConfig) (*rateLimiter, error) {
+	limiter := &rateLimiter{}
+	for i, cfg := range configs {
+		if !strings.HasPrefix(cfg.Prefix, "/") {
+			return nil, fmt.Errorf("rule %d: prefix must start with /", i)
+		}
+		if cfg.RequestsPerSecond <= 0 || cfg.Burst <= 0 {
+			return nil, fmt.Errorf("rule %d: requests_per_second and burst must be positive", i)
+		}
+		rule := &rateLimitRule{
+			prefix:  cfg.Prefix,
+			rate:    cfg.RequestsPerSecond,
+			burst:   float64(cfg.Burst),
+			buckets: make(map[bucketKey]*tokenBucket),
+		}
+		kind, name, _ := strings.Cut(cfg.Key, ":")
+		switch {
+		case cfg.Key == "" || cfg.Key == "subject":
+			rule.keyKind = rateLimitKeySubject
+		case kind == "claim" && name != "":
+			rule.keyKind, rule.keyName = rateLimitKeyClaim, name
+		case kind == "header":
+			return nil, fmt.Errorf("rule %d: header keys are chosen by the client; use subject or claim:<name>", i)
+		default:
+			return nil, fmt.Errorf("rule %d: invalid key %q", i, cfg.Key)
+		}
+		limiter.rules = append(limiter.rules, rule)
+	}
+	sort.SliceStable(limiter.rules, func(i, j int) bool {
+		return len(limiter.rules[i].prefix) > len(limiter.rules[j].prefix)
+	})
+	return limiter, nil
+}
+
+// ruleFor returns the rule with the longest prefix of path, a canonical path
+// as in requestInfo.
+func (l *rateLimiter) ruleFor(path string) *rateLimitRule {
+	for _, rule := range l.rules {
+		if hasPathPrefix(path, rule.prefix) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// allow takes a token for the request. Requests on paths without a rule are
+// not limited. When the configured claim is absent the subject is used as the
+// key; claims are verified, so a caller cannot pick a fresh bucket.
+func (l *rateLimiter) allow(req requestInfo, id *identity, now time.Time) *rateLimitedError {
+	rule := l.ruleFor(req.path)
+	if rule == nil {
+		return nil
+	}
+	key := ""
+	if rule.keyKind == rateLimitKeyClaim {
+		if value, ok := id.claims[rule.keyName]; ok {
+			key = fmt.Sprint(value)
+		}
+	}
+	if key == "" {
+		key = id.subject
+	}
+	bucket := bucketKey{value: key}
+	if id.tenant != nil {
+		bucket.tenant = id.tenant.name
+	}
+	if err := rule.take(bucket, now); err != nil {
+		rateLimitLimited.Add(rule.prefix, 1)
+		return err
+	}
+	rateLimitAllowed.Add(rule.prefix, 1)
+	return nil
+}
+
+func (r *rateLimitRule) take(key bucketKey, now time.Time) *rateLimitedError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		r.created++
+		if r.created%bucketSweepInterval == 0 {
+			r.sweep(now)
+		}
+		bucket = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(r.burst, bucket.tokens+elapsed*r.rate)
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / r.rate * float64(time.Second))
+		return &rateLimitedError{limit: int(r.burst), remaining: 0, retryAfter: wait}
+	}
+	bucket.tokens--
+	return nil
+}
+
+// sweep drops buckets that would be full by now; recreating them later is
+// equivalent.
+func (r *rateLimitRule) sweep(now time.Time) {
+	for key, bucket := range r.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// headers returns the Retry-After and x-ratelimit-* response headers. Both
+// Retry-After and the reset value are whole seconds, rounded up.
+func (e *rateLimitedError) headers() [][2]string {
+	seconds := strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds())))
+	return [][2]string{
+		{headerRetryAfter, seconds},
+		{headerRateLimitLimit, strconv.Itoa(e.limit)},
+		{headerRateLimitRemaining, strconv.Itoa(e.remaining)},
+		{headerRateLimitReset, seconds},
+	}
+}
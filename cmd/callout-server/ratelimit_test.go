@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc/codes"
+)
+
+func newTestRateLimiter(t *testing.T) *rateLimiter {
+	t.Helper()
+	limiter, err := newRateLimiter([]rateLimitRuleConfig{
+		{Prefix: "/", Key: "claim:org", RequestsPerSecond: 1, Burst: 3},
+		{Prefix: "/api/", RequestsPerSecond: 2, Burst: 2},
+	})
+	if err != nil {
+		t.Fatalf("newRateLimiter: %v", err)
+	}
+	return limiter
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	limiter := newTestRateLimiter(t)
+	now := apiKeyTestNow
+	take := func(path, subject string, claims map[string]any) *rateLimitedError {
+		return limiter.allow(requestInfo{path: path}, &identity{subject: subject, claims: claims}, now)
+	}
+
+	// /api/ is the longest prefix: two requests per subject, then 429.
+	for i := 0; i < 2; i++ {
+		if limited := take("/api/items", "u1", nil); limited != nil {
+			t.Fatalf("request %d limited: %v", i, limited)
+		}
+	}
+	limited := take("/api/items", "u1", nil)
+	if limited == nil {
+		t.Fatal("third request allowed, want limited")
+	}
+	if limited.limit != 2 || limited.remaining != 0 || limited.retryAfter != 500*time.Millisecond {
+		t.Errorf("limited = %+v, want limit 2 and retry after 500ms", limited)
+	}
+	if take("/api/items", "u2", nil) != nil {
+		t.Error("other subject limited, want its own bucket")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if take("/api/items", "u1", nil) != nil {
+		t.Error("request after the refill limited")
+	}
+
+	// The / rule is keyed by the org claim, shared by its subjects.
+	acme := map[string]any{"org": "acme"}
+	for i, subject := range []string{"a", "b", "c"} {
+		if take("/", subject, acme) != nil {
+			t.Fatalf("org request %d limited", i)
+		}
+	}
+	if take("/", "d", acme) == nil {
+		t.Error("fourth acme request allowed, want the org bucket to be empty")
+	}
+	// Without the claim the subject is the key.
+	if take("/", "d", nil) != nil {
+		t.Error("request without the claim limited, want the subject bucket")
+	}
+}
+
+func TestRateLimiterRuleFor(t *testing.T) {
+	limiter, err := newRateLimiter([]rateLimitRuleConfig{
+		{Prefix: "/", RequestsPerSecond: 1, Burst: 1},
+		{Prefix: "/api", RequestsPerSecond: 1, Burst: 1},
+	})
+	if err != nil {
+		t.Fatalf("newRateLimiter: %v", err)
+	}
+	for path, want := range map[string]string{
+		"/api":        "/api",
+		"/api/items":  "/api",
+		"/apix":       "/",
+		"/apix/items": "/",
+		"/":           "/",
+	} {
+		if rule := limiter.ruleFor(path); rule == nil || rule.prefix != want {
+			t.Errorf("ruleFor(%q) = %+v, want prefix %s", path, rule, want)
+		}
+	}
+}
+
+func TestRateLimiterRejectsRules(t *testing.T) {
+	for name, rule := range map[string]rateLimitRuleConfig{
+		"relative prefix": {Prefix: "api", RequestsPerSecond: 1, Burst: 1},
+		"zero rate":       {Prefix: "/", Burst: 1},
+		"zero burst":      {Prefix: "/", RequestsPerSecond: 1},
+		"header key":      {Prefix: "/", Key: "header:x-client-id", RequestsPerSecond: 1, Burst: 1},
+		"empty claim":     {Prefix: "/", Key: "claim:", RequestsPerSecond: 1, Burst: 1},
+		"unknown key":     {Prefix: "/", Key: "ip", RequestsPerSecond: 1, Burst: 1},
+	} {
+		if _, err := newRateLimiter([]rateLimitRuleConfig{rule}); err == nil {
+			t.Errorf("%s: newRateLimiter succeeded, want error", name)
+		}
+	}
+}
+
+func TestCheckRateLimited(t *testing.T) {
+	server, err := newCalloutServer(serverConfig{apiKeys: newTestAPIKeyStore(t), rateLimiter: newTestRateLimiter(t)})
+	if err != nil {
+		t.Fatalf("newCalloutServer: %v", err)
+	}
+	check := func() *auth.CheckResponse {
+		resp, err := server.Check(context.Background(), &auth.CheckRequest{
+			Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+				Http: &auth.AttributeContext_HttpRequest{Path: "/api/items", HeaderMap: &core.HeaderMap{Headers: []*core.HeaderValue{
+					{Key: defaultAPIKeyHeader, Value: "plain-key"},
+				}}},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		return resp
+	}
+	check()
+	check()
+	resp := check()
+	denied := resp.GetDeniedResponse()
+	if resp.GetStatus().GetCode() != int32(codes.ResourceExhausted) || denied.GetStatus().GetCode() != envoytype.StatusCode_TooManyRequests {
+		t.Fatalf("response = %v, want 429", resp)
+	}
+	got := make(map[string]string)
+	for _, h := range denied.GetHeaders() {
+		got[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+	}
+	want := map[string]string{headerRetryAfter: "1", headerRateLimitLimit: "2", headerRateLimitRemaining: "0", headerRateLimitReset: "1"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
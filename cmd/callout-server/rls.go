@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitcommon "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	rlsAlgorithmFixedWindow   = "fixed_window"
+	rlsAlgorithmSlidingWindow = "sliding_window"
+
+	// rlsSweepInterval is how many new counters are created between sweeps of
+	// expired windows.
+	rlsSweepInterval = 1024
+)
+
+var rlsOverLimit = expvar.NewMap("rls_over_limit_total")
+
+// rlsConfig is the YAML format of RLS_CONFIG_FILE. Descriptors follow the
+// envoyproxy/ratelimit layout: nested key/value entries, where an entry
+// without a value matches any value and gets a counter per distinct value.
+type rlsConfig struct {
+	Domains []rlsDomainConfig `yaml:"domains"`
+}
+
+type rlsDomainConfig struct {
+	Domain      string                `yaml:"domain"`
+	Descriptors []rlsDescriptorConfig `yaml:"descriptors"`
+}
+
+type rlsDescriptorConfig struct {
+	Key         string                `yaml:"key"`
+	Value       string                `yaml:"value"`
+	RateLimit   *rlsRateLimitConfig   `yaml:"rate_limit"`
+	Descriptors []rlsDescriptorConfig `yaml:"descriptors"`
+}
+
+type rlsRateLimitConfig struct {
+	Unit            string `yaml:"unit"`
+	RequestsPerUnit uint32 `yaml:"requests_per_unit"`
+	Algorithm       string `yaml:"algorithm"`
+}
+
+type rlsLimit struct {
+	name            string
+	requestsPerUnit uint32
+	unit            rls.RateLimitResponse_RateLimit_Unit
+	window          time.Duration
+	sliding         bool
+}
+
+type rlsNode struct {
+	limit    *rlsLimit
+	children map[rlsEntry]*rlsNode
+}
+
+// rlsEntry is a descriptor key and value; an empty value is the wildcard.
+type rlsEntry struct {
+	key, value string
+}
+
+type rlsWindow struct {
+	start     time.Time
+	length    time.Duration
+	count     uint64
+	prevCount uint64
+}
+
+// rateLimitService implements envoy.service.ratelimit.v3.RateLimitService
+// with in-memory counters, so limits apply per callout-server instance.
+type rateLimitService struct {
+	rls.UnimplementedRateLimitServiceServer
+
+	domains map[string]*rlsNode
+	now     func() time.Time
+
+	mu       sync.Mutex
+	counters map[string]*rlsWindow
+	created  int
+}
+
+func loadRateLimitService(path string) (*rateLimitService, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg rlsConfig
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("parse rate limit service config: %w", err)
+	}
+	return newRateLimitService(cfg)
+}
+
+func newRateLimitService(cfg rlsConfig) (*rateLimitService, error) {
+	svc := &rateLimitService{
+		domains:  make(map[string]*rlsNode),
+		now:      time.Now,
+		counters: make(map[string]*rlsWindow),
+	}
+	for _, domain := range cfg.Domains {
+		if domain.Domain == "" {
+			return nil, errors.New("domain is required")
+		}
+		if _, ok := svc.domains[domain.Domain]; ok {
+			return nil, fmt.Errorf("duplicate domain %q", domain.Domain)
+		}
+		root := &rlsNode{}
+		if err := root.add(domain.Domain, domain.Descriptors); err != nil {
+			return nil, err
+		}
+		svc.domains[domain.Domain] = root
+	}
+	return svc, nil
+}
+
+func (n *rlsNode) add(path string, descriptors []rlsDescriptorConfig) error {
+	for _, desc := range descriptors {
+		if desc.Key == "" {
+			return fmt.Errorf("%s: descriptor key is required", path)
+		}
+		childPath := path + "." + desc.Key + "=" + desc.Value
+		if n.children == nil {
+			n.children = make(map[rlsEntry]*rlsNode)
+		}
+		nodeKey := rlsEntry{desc.Key, desc.Value}
+		if _, ok := n.children[nodeKey]; ok {
+			return fmt.Errorf("%s: duplicate descriptor", childPath)
+		}
+		child := &rlsNode{}
+		if desc.RateLimit != nil {
+			limit, err := parseRLSLimit(childPath, desc.RateLimit)
+			if err != nil {
+				return err
+			}
+			child.limit = limit
+		}
+		if err := child.add(childPath, desc.Descriptors); err != nil {
+			return err
+		}
+		n.children[nodeKey] = child
+	}
+	return nil
+}
+
+func parseRLSLimit(name string, cfg *rlsRateLimitConfig) (*rlsLimit, error) {
+	limit := &rlsLimit{name: name, requestsPerUnit: cfg.RequestsPerUnit}
+	switch strings.ToLower(cfg.Unit) {
+	case "second":
+		limit.unit, limit.window = rls.RateLimitResponse_RateLimit_SECOND, time.Second
+	case "minute":
+		limit.unit, limit.window = rls.RateLimitResponse_RateLimit_MINUTE, time.Minute
+	case "hour":
+		limit.unit, limit.window = rls.RateLimitResponse_RateLimit_HOUR, time.Hour
+	case "day":
+		limit.unit, limit.window = rls.RateLimitResponse_RateLimit_DAY, 24*time.Hour
+	default:
+		return nil, fmt.Errorf("%s: unsupported unit %q", name, cfg.Unit)
+	}
+	switch cfg.Algorithm {
+	case "", rlsAlgorithmFixedWindow:
+	case rlsAlgorithmSlidingWindow:
+		limit.sliding = true
+	default:
+		return nil, fmt.Errorf("%s: unsupported algorithm %q", name, cfg.Algorithm)
+	}
+	return limit, nil
+}
+
+// match walks the descriptor tree, preferring an exact key/value entry over a
+// key-only wildcard at each level. It returns the limit of the final node and
+// the counter key, or nil when the descriptor has no configured limit.
+// Each component of the counter key is length-prefixed, since keys and values
+// come from the request and may contain any separator.
+func (n *rlsNode) match(domain string, entries []*ratelimitcommon.RateLimitDescriptor_Entry) (*rlsLimit, string) {
+	node := n
+	key := appendRLSKeyPart(nil, domain)
+	for _, entry := range entries {
+		child, ok := node.children[rlsEntry{entry.GetKey(), entry.GetValue()}]
+		if !ok {
+			child, ok = node.children[rlsEntry{entry.GetKey(), ""}]
+		}
+		if !ok {
+			return nil, ""
+		}
+		node = child
+		key = appendRLSKeyPart(key, entry.GetKey())
+		key = appendRLSKeyPart(key, entry.GetValue())
+	}
+	return node.limit, string(key)
+}
+
+func appendRLSKeyPart(key []byte, part string) []byte {
+	key = strconv.AppendInt(key, int64(len(part)), 10)
+	key = append(key, ':')
+	return append(key, part...)
+}
+
+func (s *rateLimitService) ShouldRateLimit(ctx context.Context, req *rls.RateLimitRequest) (*rls.RateLimitResponse, error) {
+	root, ok := s.domains[req.GetDomain()]
+	if !ok {
+		return nil, grpcstatus.Errorf(codes.InvalidArgument, "unknown rate limit domain: %q", req.GetDomain())
+	}
+	now := s.now()
+	resp := &rls.RateLimitResponse{OverallCode: rls.RateLimitResponse_OK}
+	var tightest *rls.RateLimitResponse_DescriptorStatus
+
+	for _, desc := range req.GetDescriptors() {
+		hits := uint64(req.GetHitsAddend())
+		if desc.GetHitsAddend() != nil {
+			hits = desc.GetHitsAddend().GetValue()
+		}
+		if hits == 0 {
+			hits = 1
+		}
+		status := &rls.RateLimitResponse_DescriptorStatus{Code: rls.RateLimitResponse_OK}
+		if limit, key := root.match(req.GetDomain(), desc.GetEntries()); limit != nil {
+			status = s.take(limit, key, hits, now)
+			if status.GetCode() == rls.RateLimitResponse_OVER_LIMIT {
+				resp.OverallCode = rls.RateLimitResponse_OVER_LIMIT
+				rlsOverLimit.Add(req.GetDomain(), 1)
+			}
+			if tightest == nil || tighter(status, tightest) {
+				tightest = status
+			}
+		}
+		resp.Statuses = append(resp.Statuses, status)
+	}
+
+	if tightest != nil {
+		resp.ResponseHeadersToAdd = rlsHeaders(tightest)
+	}
+	if resp.GetOverallCode() == rls.RateLimitResponse_OVER_LIMIT {
+		resp.RawBody = []byte("denied: rate limit exceeded")
+	}
+	return resp, nil
+}
+
+// tighter reports whether a is more restrictive than b: an OVER_LIMIT status
+// always wins, so the response headers carry its Retry-After.
+func tighter(a, b *rls.RateLimitResponse_DescriptorStatus) bool {
+	aOver := a.GetCode() == rls.RateLimitResponse_OVER_LIMIT
+	if bOver := b.GetCode() == rls.RateLimitResponse_OVER_LIMIT; aOver != bOver {
+		return aOver
+	}
+	return a.GetLimitRemaining() < b.GetLimitRemaining()
+}
+
+// take adds hits to the counter when they fit in the limit. The sliding window
+// is approximated by weighting the previous fixed window by the part of it
+// that still overlaps the sliding window.
+func (s *rateLimitService) take(limit *rlsLimit, key string, hits uint64, now time.Time) *rls.RateLimitResponse_DescriptorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := now.Truncate(limit.window)
+	w, ok := s.counters[key]
+	if !ok {
+		s.created++
+		if s.created%rlsSweepInterval == 0 {
+			s.sweep(now)
+		}
+		w = &rlsWindow{start: start, length: limit.window}
+		s.counters[key] = w
+	}
+	if !w.start.Equal(start) {
+		if start.Sub(w.start) == limit.window {
+			w.prevCount = w.count
+		} else {
+			w.prevCount = 0
+		}
+		w.count = 0
+		w.start = start
+	}
+
+	elapsed := now.Sub(start)
+	used := float64(w.count)
+	if limit.sliding {
+		used += float64(w.prevCount) * (1 - float64(elapsed)/float64(limit.window))
+	}
+	code := rls.RateLimitResponse_OK
+	if used+float64(hits) > float64(limit.requestsPerUnit) {
+		code = rls.RateLimitResponse_OVER_LIMIT
+	} else {
+		w.count += hits
+		used += float64(hits)
+	}
+	remaining := math.Max(0, float64(limit.requestsPerUnit)-math.Ceil(used))
+
+	return &rls.RateLimitResponse_DescriptorStatus{
+		Code: code,
+		CurrentLimit: &rls.RateLimitResponse_RateLimit{
+			Name:            limit.name,
+			RequestsPerUnit: limit.requestsPerUnit,
+			Unit:            limit.unit,
+		},
+		LimitRemaining:     uint32(remaining),
+		DurationUntilReset: durationpb.New(limit.window - elapsed),
+	}
+}
+
+// sweep drops counters whose windows can no longer affect a decision: once
+// two windows have passed, neither the current nor the previous count is used.
+func (s *rateLimitService) sweep(now time.Time) {
+	for key, w := range s.counters {
+		if now.Sub(w.start) >= 2*w.length {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// rlsHeaders returns x-ratelimit-* headers for the most restrictive descriptor.
+func rlsHeaders(status *rls.RateLimitResponse_DescriptorStatus) []*core.HeaderValue {
+	reset := int(math.Ceil(status.GetDurationUntilReset().AsDuration().Seconds()))
+	headers := []*core.HeaderValue{
+		{Key: headerRateLimitLimit, Value: strconv.FormatUint(uint64(status.GetCurrentLimit().GetRequestsPerUnit()), 10)},
+		{Key: headerRateLimitRemaining, Value: strconv.FormatUint(uint64(status.GetLimitRemaining()), 10)},
+		{Key: headerRateLimitReset, Value: strconv.Itoa(reset)},
+	}
+	if status.GetCode() == rls.RateLimitResponse_OVER_LIMIT {
+		headers = append(headers, &core.HeaderValue{Key: headerRetryAfter, Value: strconv.Itoa(reset)})
+	}
+	return headers
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ratelimitcommon "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"gopkg.in/yaml.v3"
+)
+
+const testRLSConfig = `
+domains:
+  - domain: sext
+    descriptors:
+      - key: user
+        rate_limit:
+          unit: minute
+          requests_per_unit: 2
+      - key: user
+        value: vip
+        rate_limit:
+          unit: minute
+          requests_per_unit: 5
+      - key: path
+        value: /api
+        descriptors:
+          - key: user
+            rate_limit:
+              unit: second
+              requests_per_unit: 4
+              algorithm: sliding_window
+      - key: path
+        value: /public
+`
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestRateLimitService(t *testing.T) (*rateLimitService, *fakeClock) {
+	t.Helper()
+	var cfg rlsConfig
+	if err := yaml.Unmarshal([]byte(testRLSConfig), &cfg); err != nil {
+		t.Fatalf("unmarshal config: %v", err)
+	}
+	svc, err := newRateLimitService(cfg)
+	if err != nil {
+		t.Fatalf("newRateLimitService: %v", err)
+	}
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	svc.now = clock.Now
+	return svc, clock
+}
+
+func descriptor(kv ...string) *ratelimitcommon.RateLimitDescriptor {
+	desc := &ratelimitcommon.RateLimitDescriptor{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		desc.Entries = append(desc.Entries, &ratelimitcommon.RateLimitDescriptor_Entry{Key: kv[i], Value: kv[i+1]})
+	}
+	return desc
+}
+
+func shouldRateLimit(t *testing.T, svc *rateLimitService, req *rls.RateLimitRequest) *rls.RateLimitResponse {
+	t.Helper()
+	resp, err := svc.ShouldRateLimit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("ShouldRateLimit: %v", err)
+	}
+	return resp
+}
+
+func headerValue(resp *rls.RateLimitResponse, key string) string {
+	for _, h := range resp.GetResponseHeadersToAdd() {
+		if h.GetKey() == key {
+			return h.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestShouldRateLimitFixedWindow(t *testing.T) {
+	svc, clock := newTestRateLimitService(t)
+	req := &rls.RateLimitRequest{Domain: "sext", Descriptors: []*ratelimitcommon.RateLimitDescriptor{descriptor("user", "alice")}}
+
+	for i, want := range []rls.RateLimitResponse_Code{rls.RateLimitResponse_OK, rls.RateLimitResponse_OK, rls.RateLimitResponse_OVER_LIMIT} {
+		resp := shouldRateLimit(t, svc, req)
+		if resp.GetOverallCode() != want {
+			t.Fatalf("request %d: overall code = %v, want %v", i, resp.GetOverallCode(), want)
+		}
+	}
+
+	resp := shouldRateLimit(t, svc, req)
+	if got := headerValue(resp, headerRateLimitLimit); got != "2" {
+		t.Errorf("%s = %q, want 2", headerRateLimitLimit, got)
+	}
+	if got := headerValue(resp, headerRateLimitRemaining); got != "0" {
+		t.Errorf("%s = %q, want 0", headerRateLimitRemaining, got)
+	}
+	if got := headerValue(resp, headerRetryAfter); got != "60" {
+		t.Errorf("%s = %q, want 60", headerRetryAfter, got)
+	}
+	if len(resp.GetRawBody()) == 0 {
+		t.Error("raw body is empty for OVER_LIMIT")
+	}
+
+	other := &rls.RateLimitRequest{Domain: "sext", Descriptors: []*ratelimitcommon.RateLimitDescriptor{descriptor("user", "bob")}}
+	if resp := shouldRateLimit(t, svc, other); resp.GetOverallCode() != rls.RateLimitResponse_OK {
+		t.Errorf("wildcard value shares a counter across users: %v", resp.GetOverallCode())
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	if resp := shouldRateLimit(t, svc, req); resp.GetOverallCode() != rls.RateLimitResponse_OK {
+		t.Errorf("next window: overall code = %v, want OK", resp.GetOverallCode())
+	}
+}
+
+func TestShouldRateLimitExactValueWinsOverWildcard(t *testing.T) {
+	svc, _ := newTestRateLimitService(t)
+	req := &rls.RateLimitRequest{Domain: "sext", Descriptors: []*ratelimitcommon.RateLimitDescriptor{descriptor("user", "vip")}}
+
+	resp := shouldRateLimit(t, svc, req)
+	if got := resp.GetStatuses()[0].GetCurrentLimit().GetRequestsPerUnit(); got != 5 {
+		t.Fatalf("current limit = %d, want 5", got)
+	}
+	if got := resp.GetStatuses()[0].GetLimitRemaining(); got != 4 {
+		t.Errorf("limit remaining = %d, want 4", got)
+	}
+}
+
+func TestShouldRateLimitSlidingWindow(t *testing.T) {
+	svc, clock := newTestRateLimitService(t)
+	req := &rls.RateLimitRequest{Domain: "sext", Descriptors: []*ratelimitcommon.RateLimitDescriptor{descriptor("path", "/api", "user", "alice")}}
+
+	for i := 0; i < 4; i++ {
+		if resp := shouldRateLimit(t, svc, req); resp.GetOverallCode() != rls.RateLimitResponse_OK {
+			t.Fatalf("request %d: overall code = %v, want OK", i, resp.GetOverallCode())
+		}
+	}
+
+	// A quarter into the next window, 3 of the previous 4 hits still count.
+	clock.now = clock.now.Add(1250 * time.Millisecond)
+	if resp := shouldRateLimit(t, svc, req); resp.GetOverallCode() != rls.RateLimitResponse_OK {
+		t.Fatalf("first hit in next window: overall code = %v, want OK", resp.GetOverallCode())
+	}
+	if resp := shouldRateLimit(t, svc, req); resp.GetOverallCode() != rls.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("second hit in next window: overall code = %v, want OVER_LIMIT", resp.GetOverallCode())
+	}
+}
+
+func TestShouldRateLimitUnmatchedDescriptor(t *testing.T) {
+	svc, _ := newTestRateLimitService(t)
+	req := &rls.RateLimitRequest{Domain: "sext", Descriptors: []*ratelimitcommon.RateLimitDescriptor{
+		descriptor("path", "/public"),
+		descriptor("tenant", "acme"),
+	}}
+
+	resp := shouldRateLimit(t, svc, req)
+	if resp.GetOverallCode() != rls.RateLimitResponse_OK {
+		t.Fatalf("overall code = %v, want OK", resp.GetOverallCode())
+	}
+	if len(resp.GetStatuses()) != 2 {
+		t.Fatalf("statuses = %d, want 2", len(resp.GetStatuses()))
+	}
+	for i, status := range resp.GetStatuses() {
+		if status.GetCurrentLimit() != nil {
+			t.Errorf("status %d: current limit = %v, want nil", i, status.GetCurrentLimit())
+		}
+	}
+	if len(resp.GetResponseHeadersToAdd()) != 0 {
+		t.Errorf("headers = %v, want none", resp.GetResponseHeadersToAdd())
+	}
+}
+
+func TestShouldRateLimitHitsAddend(t *testing.T) {
+	svc, _ := newTestRateLimitService(t)
+	desc := descriptor("user", "carol")
+	desc.HitsAddend = wrapperspb.UInt64(3)
+	req := &rls.RateLimitRequest{Domain: "sext", Descriptors: []*ratelimitcommon.RateLimitDescriptor{desc}}
+
+	if resp := shouldRateLimit(t, svc, req); resp.GetOverallCode() != rls.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("overall code = %v, want OVER_LIMIT", resp.GetOverallCode())
+	}
+
+	req = &rls.RateLimitRequest{Domain: "sext", HitsAddend: 2, Descriptors: []*ratelimitcommon.RateLimitDescriptor{descriptor("user", "carol")}}
+	if resp := shouldRateLimit(t, svc, req); resp.GetOverallCode() != rls.RateLimitResponse_OK {
+		t.Fatalf("overall code = %v, want OK", resp.GetOverallCode())
+	}
+}
+
+func TestShouldRateLimitHeadersPreferOverLimit(t *testing.T) {
+	svc, _ := newTestRateLimitService(t)
+	alice := &rls.RateLimitRequest{Domain: "sext", Descriptors: []*ratelimitcommon.RateLimitDescriptor{descriptor("user", "alice")}}
+	shouldRateLimit(t, svc, alice)
+	shouldRateLimit(t, svc, alice)
+	shouldRateLimit(t, svc, &rls.RateLimitRequest{Domain: "sext", Descriptors: []*ratelimitcommon.RateLimitDescriptor{descriptor("user", "bob")}})
+
+	// bob is OK with nothing remaining, as tight as alice's OVER_LIMIT.
+	resp := shouldRateLimit(t, svc, &rls.RateLimitRequest{Domain: "sext", Descriptors: []*ratelimitcommon.RateLimitDescriptor{
+		descriptor("user", "bob"),
+		descriptor("user", "alice"),
+	}})
+	if resp.GetOverallCode() != rls.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("overall code = %v, want OVER_LIMIT", resp.GetOverallCode())
+	}
+	if got := headerValue(resp, headerRetryAfter); got != "60" {
+		t.Errorf("%s = %q, want 60 from the OVER_LIMIT descriptor", headerRetryAfter, got)
+	}
+}
+
+func TestShouldRateLimitSeparatorsInValues(t *testing.T) {
+	limit := &rlsRateLimitConfig{Unit: "minute", RequestsPerUnit: 1}
+	svc, err := newRateLimitService(rlsConfig{Domains: []rlsDomainConfig{{Domain: "d", Descriptors: []rlsDescriptorConfig{
+		{Key: "user", RateLimit: limit, Descriptors: []rlsDescriptorConfig{{Key: "org", RateLimit: limit}}},
+		// Distinct from the wildcard key "a=b".
+		{Key: "a", Value: "b=", RateLimit: limit},
+		{Key: "a=b", RateLimit: limit},
+	}}}})
+	if err != nil {
+		t.Fatalf("newRateLimitService: %v", err)
+	}
+	for i, desc := range []*ratelimitcommon.RateLimitDescriptor{
+		descriptor("user", "x|org=y"),
+		descriptor("user", "x", "org", "y"),
+		descriptor("a", "b="),
+		descriptor("a=b", ""),
+	} {
+		req := &rls.RateLimitRequest{Domain: "d", Descriptors: []*ratelimitcommon.RateLimitDescriptor{desc}}
+		if resp := shouldRateLimit(t, svc, req); resp.GetOverallCode() != rls.RateLimitResponse_OK {
+			t.Errorf("descriptor %d: overall code = %v, want OK from its own counter", i, resp.GetOverallCode())
+		}
+	}
+}
+
+func TestShouldRateLimitUnknownDomain(t *testing.T) {
+	svc, _ := newTestRateLimitService(t)
+	_, err := svc.ShouldRateLimit(context.Background(), &rls.RateLimitRequest{Domain: "other"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestNewRateLimitServiceRejectsInvalidConfig(t *testing.T) {
+	tests := map[string]rlsConfig{
+		"missing domain": {Domains: []rlsDomainConfig{{}}},
+		"bad unit": {Domains: []rlsDomainConfig{{Domain: "d", Descriptors: []rlsDescriptorConfig{
+			{Key: "k", RateLimit: &rlsRateLimitConfig{Unit: "fortnight", RequestsPerUnit: 1}},
+		}}}},
+		"bad algorithm": {Domains: []rlsDomainConfig{{Domain: "d", Descriptors: []rlsDescriptorConfig{
+			{Key: "k", RateLimit: &rlsRateLimitConfig{Unit: "second", RequestsPerUnit: 1, Algorithm: "leaky"}},
+		}}}},
+		"duplicate descriptor": {Domains: []rlsDomainConfig{{Domain: "d", Descriptors: []rlsDescriptorConfig{
+			{Key: "k"}, {Key: "k"},
+		}}}},
+	}
+	for name, cfg := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newRateLimitService(cfg); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
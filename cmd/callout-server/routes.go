@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+var errInvalidPath = errors.New("request path is not canonical")
+
+type authModes uint8
+
+const (
+	authModeJWT authModes = 1 << iota
+	authModeAPIKey
+)
+
+func (m authModes) has(mode authModes) bool {
+	return m&mode != 0
+}
+
+func parseAuthModes(value string) (authModes, error) {
+	var modes authModes
+	for _, name := range strings.Split(value, "|") {
+		switch strings.TrimSpace(name) {
+		case "jwt":
+			modes |= authModeJWT
+		case "apikey":
+			modes |= authModeAPIKey
+		default:
+			return 0, fmt.Errorf("unknown auth mode: %q", name)
+		}
+	}
+	return modes, nil
+}
+
+type route struct {
+	prefix string
+	modes  authModes
+}
+
+// routeTable selects authentication modes by path prefix. Routes are kept
+// sorted by descending prefix length so the longest prefix wins.
+type routeTable []route
+
+// routeConfig is one route of the config file. Auth is a "|"-separated
+// list of modes, e.g. "jwt|apikey".
+type routeConfig struct {
+	Prefix string `yaml:"prefix" json:"prefix"`
+	Auth   string `yaml:"auth" json:"auth"`
+}
+
+// parseRouteEntries parses AUTH_ROUTES, a comma-separated list of
+// prefix=modes entries such as "/machine/=apikey,/=jwt|apikey".
+func parseRouteEntries(value string) ([]routeConfig, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var entries []routeConfig
+	for _, entry := range strings.Split(value, ",") {
+		prefix, modes, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid route entry: %q", entry)
+		}
+		entries = append(entries, routeConfig{Prefix: prefix, Auth: modes})
+	}
+	return entries, nil
+}
+
+func newRouteTable(entries []routeConfig) (routeTable, error) {
+	var routes routeTable
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Prefix, "/") {
+			return nil, fmt.Errorf("invalid route prefix: %q", entry.Prefix)
+		}
+		modes, err := parseAuthModes(entry.Auth)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route{prefix: entry.Prefix, modes: modes})
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+	return routes, nil
+}
+
+// match returns the modes of the longest route prefix of p, a canonical
+// path.
+func (t routeTable) match(p string) (authModes, bool) {
+	for _, r := range t {
+		if hasPathPrefix(p, r.prefix) {
+			return r.modes, true
+		}
+	}
+	return 0, false
+}
+
+// hasPathPrefix reports whether p starts with prefix at a segment boundary,
+// so "/machine" matches "/machine" and "/machine/jobs" but not "/machinery".
+func hasPathPrefix(p, prefix string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	return len(p) == len(prefix) || strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/'
+}
+
+// canonicalPath strips the query from p, percent-decodes it and reports
+// whether the result is already canonical. Dot segments, empty segments,
+// backslashes and encoded separators are rejected rather than resolved,
+// since the origin may resolve them differently, e.g. "/machine/%2e%2e/admin"
+// to "/admin".
+func canonicalPath(p string) (string, bool) {
+	p = stripQuery(p)
+	if p == "" {
+		return "", true
+	}
+	lower := strings.ToLower(p)
+	if strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c") {
+		return p, false
+	}
+	decoded, err := url.PathUnescape(p)
+	if err != nil || strings.Contains(decoded, `\`) {
+		return p, false
+	}
+	cleaned := path.Clean(decoded)
+	if strings.HasSuffix(decoded, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return decoded, cleaned == decoded
+}
+
+func stripQuery(path string) string {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+)
+
+const defaultTenantName = "default"
+
+var (
+	errUnknownHost     = errors.New("request host is not served")
+	errInvalidIssuer   = errors.New("token issuer is not accepted")
+	errInvalidAudience = errors.New("token audience is not accepted")
+)
+
+// tenantConfig is the JWT policy of one tenant. serverConfig embeds the
+// default tenant, which serves every host that no tenant lists.
+type tenantConfig struct {
+	name string
+	// hosts select the tenant by request host, e.g. "api.example.com" or
+	// "*.example.com" for any subdomain. The default tenant has none.
+	hosts []string
+
+	keys       []jwtverify.Key
+	leeway     time.Duration
+	requireExp bool
+	// issuer and audiences, when set, must match the token iss and one of
+	// its aud values.
+	issuer    string
+	audiences []string
+	// subjectClaim is the string claim used as the subject; "sub" when
+	// empty.
+	subjectClaim string
+	// claimHeaders copy string claims to request headers. The headers are
+	// removed when the claim is absent or another mode authenticated the
+	// request.
+	claimHeaders []claimHeader
+
+	routes routeTable
+}
+
+type claimHeader struct {
+	claim  string
+	header string
+}
+
+// tenant is a tenantConfig with its verifier; verifier is nil when the
+// tenant has no keys.
+type tenant struct {
+	tenantConfig
+	verifier *jwtverify.Verifier
+}
+
+func newTenant(cfg tenantConfig, apiKeys bool, clock func() time.Time) (*tenant, error) {
+	for _, route := range cfg.routes {
+		if route.modes.has(authModeJWT) && len(cfg.keys) == 0 {
+			return nil, fmt.Errorf("route %q uses jwt but public key is nil", route.prefix)
+		}
+		if route.modes.has(authModeAPIKey) && !apiKeys {
+			return nil, fmt.Errorf("route %q uses apikey but API keys are not configured", route.prefix)
+		}
+	}
+	for _, h := range cfg.claimHeaders {
+		if h.claim == "" || h.header == "" {
+			return nil, errors.New("claim headers need a claim and a header name")
+		}
+	}
+	t := &tenant{tenantConfig: cfg}
+	if len(cfg.keys) > 0 {
+		verifier, err := jwtverify.NewVerifier(cfg.keys, jwtverify.Options{
+			Leeway:            cfg.leeway,
+			RequireExpiration: cfg.requireExp,
+			Now:               clock,
+		})
+		if err != nil {
+			return nil, err
+		}
+		t.verifier = verifier
+	}
+	return t, nil
+}
+
+// verify checks the token with the tenant keys, then the tenant issuer and
+// audiences, and maps the claims to an identity.
+func (t *tenant) verify(token string) (*identity, error) {
+	claims, err := t.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if t.issuer != "" && claims.Issuer != t.issuer {
+		return nil, errInvalidIssuer
+	}
+	if len(t.audiences) > 0 && !slices.ContainsFunc(claims.Audience, func(aud string) bool {
+		return slices.Contains(t.audiences, aud)
+	}) {
+		return nil, errInvalidAudience
+	}
+	id := &identity{subject: claims.Subject, claims: claims.Raw}
+	if t.subjectClaim != "" {
+		subject, _ := claims.Raw[t.subjectClaim].(string)
+		if subject == "" {
+			return nil, jwtverify.ErrMissingSubject
+		}
+		id.subject = subject
+	}
+	for _, h := range t.claimHeaders {
+		if value, ok := claims.Raw[h.claim].(string); ok && value != "" {
+			id.claimHeaders = append(id.claimHeaders, [2]string{h.header, value})
+		}
+	}
+	return id, nil
+}
+
+// tenantTable selects a tenant by request host: exact hosts first, then the
+// longest matching "*." suffix, then the default tenant.
+type tenantTable struct {
+	exact     map[string]*tenant
+	wildcards []tenantWildcard
+	fallback  *tenant
+}
+
+type tenantWildcard struct {
+	// suffix includes the leading dot, e.g. ".example.com".
+	suffix string
+	tenant *tenant
+}
+
+func newTenantTable(fallback *tenant, tenants []*tenant) (tenantTable, error) {
+	table := tenantTable{exact: make(map[string]*tenant), fallback: fallback}
+	names := map[string]bool{fallback.name: true}
+	hosts := make(map[string]string)
+	for _, t := range tenants {
+		if t.name == "" {
+			return table, errors.New("tenant name is required")
+		}
+		if names[t.name] {
+			return table, fmt.Errorf("duplicate tenant %q", t.name)
+		}
+		names[t.name] = true
+		if len(t.hosts) == 0 {
+			return table, fmt.Errorf("tenant %q has no hosts", t.name)
+		}
+		if t.verifier == nil {
+			return table, fmt.Errorf("tenant %q has no keys", t.name)
+		}
+		for _, host := range t.hosts {
+			host = strings.ToLower(host)
+			if other, ok := hosts[host]; ok {
+				return table, fmt.Errorf("host %q is listed by tenants %q and %q", host, other, t.name)
+			}
+			hosts[host] = t.name
+			if suffix, ok := strings.CutPrefix(host, "*"); ok {
+				if !strings.HasPrefix(suffix, ".") || strings.Contains(suffix, "*") {
+					return table, fmt.Errorf("tenant %q: invalid host pattern %q", t.name, host)
+				}
+				table.wildcards = append(table.wildcards, tenantWildcard{suffix: suffix, tenant: t})
+				continue
+			}
+			table.exact[host] = t
+		}
+	}
+	slices.SortStableFunc(table.wildcards, func(a, b tenantWildcard) int { return len(b.suffix) - len(a.suffix) })
+	return table, nil
+}
+
+func (t tenantTable) match(host string) *tenant {
+	host = normalizeHost(host)
+	if tenant, ok := t.exact[host]; ok {
+		return tenant
+	}
+	for _, w := range t.wildcards {
+		if strings.HasSuffix(host, w.suffix) {
+			return w.tenant
+		}
+	}
+	return t.fallback
+}
+
+// normalizeHost lower-cases host and drops the port and a trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
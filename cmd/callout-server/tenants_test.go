@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc/codes"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+const tenantsConfig = `schema_version: 1
+tenants:
+  - name: api
+    hosts: [api.example.com]
+    keys:
+      - public_key_pem_file: %RSA%
+    issuer: https://issuer.example.com
+    audiences: [api]
+    claims:
+      subject: email
+      headers:
+        x-org: org
+  - name: partners
+    hosts: ["*.partners.example.com"]
+    keys:
+      - public_key_pem_file: %EC%
+`
+
+func newTenantsServer(t *testing.T) *calloutServer {
+	t.Helper()
+	content := strings.NewReplacer(
+		"%RSA%", writeFile(t, "rsa.pem", jwtverifytest.PublicKeyPEM()),
+		"%EC%", writeFile(t, "ec.pem", ecPublicKeyPEM(t)),
+	).Replace(tenantsConfig)
+	cfg, err := loadConfig(writeFile(t, "callout.yaml", content), envMap(nil))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	opts, err := cfg.resolve()
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	opts.server.clock = func() time.Time { return jwtverifytest.Now }
+	server, err := newCalloutServer(opts.server)
+	if err != nil {
+		t.Fatalf("newCalloutServer: %v", err)
+	}
+	return server
+}
+
+func signRS256(claims map[string]any) string {
+	claims["exp"] = jwtverifytest.Now.Add(time.Minute).Unix()
+	return jwtverifytest.SignRS256(jwtverifytest.PrivateKey(), map[string]any{"alg": "RS256"}, claims)
+}
+
+func TestTenantSelection(t *testing.T) {
+	server := newTenantsServer(t)
+	for host, want := range map[string]string{
+		"api.example.com":          "api",
+		"API.Example.com:443":      "api",
+		"api.example.com.":         "api",
+		"a.partners.example.com":   "partners",
+		"a.b.partners.example.com": "partners",
+		"partners.example.com":     defaultTenantName,
+		"other.example.com":        defaultTenantName,
+		"":                         defaultTenantName,
+	} {
+		if got := server.tenantTable.match(host).name; got != want {
+			t.Errorf("tenant for %q = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestTenantPolicies(t *testing.T) {
+	server := newTenantsServer(t)
+	valid := map[string]any{"sub": "u1", "email": "u1@example.com", "org": "acme", "iss": "https://issuer.example.com", "aud": "api"}
+	with := func(key string, value any) map[string]any {
+		claims := map[string]any{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	ecToken := signES256(t, map[string]any{"sub": "partner", "exp": jwtverifytest.Now.Add(time.Minute).Unix()})
+
+	tests := []struct {
+		name       string
+		host       string
+		token      string
+		wantReason string
+		wantHeader [][2]string
+		wantRemove []string
+	}{
+		{name: "api", host: "api.example.com", token: signRS256(with("aud", []string{"other", "api"})),
+			wantHeader: [][2]string{{headerUID, "u1@example.com"}, {"x-org", "acme"}}},
+		{name: "wrong issuer", host: "api.example.com", token: signRS256(with("iss", "https://other.example.com")), wantReason: errInvalidIssuer.Error()},
+		{name: "missing audience", host: "api.example.com", token: signRS256(with("aud", nil)), wantReason: errInvalidAudience.Error()},
+		{name: "missing mapped claim", host: "api.example.com", token: signRS256(with("org", nil)),
+			wantHeader: [][2]string{{headerUID, "u1@example.com"}}, wantRemove: []string{"x-org"}},
+		{name: "missing subject claim", host: "api.example.com", token: signRS256(with("email", nil)), wantReason: jwtverify.ErrMissingSubject.Error()},
+		{name: "partner", host: "eu.partners.example.com", token: ecToken, wantHeader: [][2]string{{headerUID, "partner"}}},
+		{name: "other tenant key", host: "eu.partners.example.com", token: signRS256(with("sub", "u1"))},
+		{name: "unknown host", host: "other.example.com", token: ecToken, wantReason: errUnknownHost.Error()},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := server.Check(context.Background(), &auth.CheckRequest{
+				Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+					Http: &auth.AttributeContext_HttpRequest{Host: tc.host, HeaderMap: conformanceHeaderMap(bearerPrefix + tc.token)},
+				}},
+			})
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if tc.wantHeader == nil {
+				if resp.GetStatus().GetCode() != int32(codes.PermissionDenied) {
+					t.Fatalf("status = %v, want denied", resp.GetStatus())
+				}
+				if tc.wantReason != "" && resp.GetStatus().GetMessage() != tc.wantReason {
+					t.Errorf("reason = %q, want %q", resp.GetStatus().GetMessage(), tc.wantReason)
+				}
+				return
+			}
+			if resp.GetStatus().GetCode() != int32(codes.OK) {
+				t.Fatalf("status = %v, want OK", resp.GetStatus())
+			}
+			var got [][2]string
+			for _, h := range resp.GetOkResponse().GetHeaders() {
+				got = append(got, [2]string{h.GetHeader().GetKey(), h.GetHeader().GetValue()})
+			}
+			if len(got) != len(tc.wantHeader) {
+				t.Fatalf("headers = %v, want %v", got, tc.wantHeader)
+			}
+			for i := range got {
+				if got[i] != tc.wantHeader[i] {
+					t.Errorf("headers = %v, want %v", got, tc.wantHeader)
+				}
+			}
+			// Requests authenticated by JWT alone never set scopes or a
+			// certificate identity.
+			wantRemove := append(tc.wantRemove, headerScopes, defaultClientCertHeader)
+			if remove := resp.GetOkResponse().GetHeadersToRemove(); !slices.Equal(remove, wantRemove) {
+				t.Errorf("headers to remove = %v, want %v", remove, wantRemove)
+			}
+		})
+	}
+}
+
+func TestTenantSelectionByAuthorityOverExtProc(t *testing.T) {
+	server := newTenantsServer(t)
+	token := signES256(t, map[string]any{"sub": "partner", "exp": jwtverifytest.Now.Add(time.Minute).Unix()})
+	for authority, wantAllowed := range map[string]bool{"eu.partners.example.com": true, "api.example.com": false} {
+		resp, err := server.handleRequestHeaders(&extproc.HttpHeaders{Headers: &core.HeaderMap{Headers: []*core.HeaderValue{
+			{Key: ":path", Value: "/"},
+			{Key: ":authority", Value: authority},
+			{Key: headerAuth, Value: bearerPrefix + token},
+		}}})
+		if err != nil {
+			t.Fatalf("handleRequestHeaders: %v", err)
+		}
+		if allowed := resp.GetImmediateResponse() == nil; allowed != wantAllowed {
+			t.Errorf("%s: allowed = %v, want %v", authority, allowed, wantAllowed)
+		}
+	}
+}
+
+func TestNewCalloutServerRejectsTenants(t *testing.T) {
+	key, err := keyConfig{PublicKeyPEM: jwtverifytest.PublicKeyPEM()}.load()
+	if err != nil {
+		t.Fatalf("load key: %v", err)
+	}
+	keys := []jwtverify.Key{key}
+	for name, tenants := range map[string][]tenantConfig{
+		"missing name":        {{hosts: []string{"a.example.com"}, keys: keys}},
+		"default name":        {{name: defaultTenantName, hosts: []string{"a.example.com"}, keys: keys}},
+		"duplicate name":      {{name: "a", hosts: []string{"a.example.com"}, keys: keys}, {name: "a", hosts: []string{"b.example.com"}, keys: keys}},
+		"no hosts":            {{name: "a", keys: keys}},
+		"no keys":             {{name: "a", hosts: []string{"a.example.com"}}},
+		"duplicate host":      {{name: "a", hosts: []string{"a.example.com"}, keys: keys}, {name: "b", hosts: []string{"A.example.com"}, keys: keys}},
+		"invalid wildcard":    {{name: "a", hosts: []string{"*example.com"}, keys: keys}},
+		"apikey route":        {{name: "a", hosts: []string{"a.example.com"}, keys: keys, routes: routeTable{{prefix: "/", modes: authModeAPIKey}}}},
+		"empty claim mapping": {{name: "a", hosts: []string{"a.example.com"}, keys: keys, claimHeaders: []claimHeader{{header: "x-org"}}}},
+	} {
+		if _, err := newCalloutServer(serverConfig{tenants: tenants}); err == nil {
+			t.Errorf("%s: newCalloutServer succeeded, want error", name)
+		}
+	}
+}
+
+func TestTenantClaimHeadersStrippedForOtherModes(t *testing.T) {
+	spoofed := func(server *calloutServer, headers ...*core.HeaderValue) *auth.CheckResponse {
+		t.Helper()
+		resp, err := server.Check(context.Background(), &auth.CheckRequest{
+			Attributes: &auth.AttributeContext{
+				Source: &auth.AttributeContext_Peer{Principal: "spiffe://example.org/ns/prod/sa/batch"},
+				Request: &auth.AttributeContext_Request{Http: &auth.AttributeContext_HttpRequest{
+					Host:      "api.example.com",
+					Path:      "/",
+					HeaderMap: &core.HeaderMap{Headers: append(headers, &core.HeaderValue{Key: "x-org", Value: "victim"})},
+				}},
+			},
+		})
+		if err != nil || resp.GetStatus().GetCode() != int32(codes.OK) {
+			t.Fatalf("Check = %v, %v; want OK", resp.GetStatus(), err)
+		}
+		return resp
+	}
+
+	apiKey := newTenantsServer(t)
+	apiKey.apiKeys = newTestAPIKeyStore(t)
+	cert := newTenantsServer(t)
+	cert.clientCertMode = clientCertInstead
+	cert.clientCertAllowlist = parseClientCertAllowlist("spiffe://example.org/ns/prod/*")
+	for name, resp := range map[string]*auth.CheckResponse{
+		"api key":            spoofed(apiKey, &core.HeaderValue{Key: defaultAPIKeyHeader, Value: "plain-key"}),
+		"client certificate": spoofed(cert),
+	} {
+		if remove := resp.GetOkResponse().GetHeadersToRemove(); !slices.Contains(remove, "x-org") {
+			t.Errorf("%s: headers to remove = %v, want the tenant claim header x-org", name, remove)
+		}
+	}
+}
+
+func TestTenantRateLimitBuckets(t *testing.T) {
+	server := newTenantsServer(t)
+	limiter, err := newRateLimiter([]rateLimitRuleConfig{{Prefix: "/", RequestsPerSecond: 1, Burst: 1}})
+	if err != nil {
+		t.Fatalf("newRateLimiter: %v", err)
+	}
+	server.rateLimiter = limiter
+	// The same subject on both tenants.
+	apiToken := signRS256(map[string]any{"sub": "u1", "email": "same", "iss": "https://issuer.example.com", "aud": "api"})
+	partnerToken := signES256(t, map[string]any{"sub": "same", "exp": jwtverifytest.Now.Add(time.Minute).Unix()})
+	for i, tc := range []struct {
+		host  string
+		token string
+		want  codes.Code
+	}{
+		{host: "api.example.com", token: apiToken, want: codes.OK},
+		{host: "eu.partners.example.com", token: partnerToken, want: codes.OK},
+		{host: "api.example.com", token: apiToken, want: codes.ResourceExhausted},
+	} {
+		resp, err := server.Check(context.Background(), &auth.CheckRequest{
+			Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+				Http: &auth.AttributeContext_HttpRequest{Host: tc.host, HeaderMap: conformanceHeaderMap(bearerPrefix + tc.token)},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		if got := codes.Code(resp.GetStatus().GetCode()); got != tc.want {
+			t.Errorf("request %d to %s = %v, want %v", i, tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestAPIKeyTenants(t *testing.T) {
+	store, err := newAPIKeyStore([]apiKeyEntry{
+		{Hash: sha256Hash("api-key"), Owner: "ci", Tenants: []string{"api"}},
+		{Hash: sha256Hash("shared-key"), Owner: "ops"},
+	})
+	if err != nil {
+		t.Fatalf("newAPIKeyStore: %v", err)
+	}
+	server := newTenantsServer(t)
+	server.apiKeys = store
+	for _, tc := range []struct {
+		host string
+		key  string
+		want codes.Code
+	}{
+		{host: "api.example.com", key: "api-key", want: codes.OK},
+		{host: "eu.partners.example.com", key: "api-key", want: codes.PermissionDenied},
+		{host: "other.example.com", key: "api-key", want: codes.PermissionDenied},
+		// Keys without tenants cross tenants.
+		{host: "eu.partners.example.com", key: "shared-key", want: codes.OK},
+		{host: "other.example.com", key: "shared-key", want: codes.OK},
+	} {
+		resp, err := server.Check(context.Background(), &auth.CheckRequest{
+			Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+				Http: &auth.AttributeContext_HttpRequest{
+					Host:      tc.host,
+					Path:      "/",
+					HeaderMap: &core.HeaderMap{Headers: []*core.HeaderValue{{Key: defaultAPIKeyHeader, Value: tc.key}}},
+				},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		if got := codes.Code(resp.GetStatus().GetCode()); got != tc.want {
+			t.Errorf("%s on %s = %v, want %v", tc.key, tc.host, got, tc.want)
+		}
+	}
+
+	store, err = newAPIKeyStore([]apiKeyEntry{{Hash: sha256Hash("api-key"), Owner: "ci", Tenants: []string{"apis"}}})
+	if err != nil {
+		t.Fatalf("newAPIKeyStore: %v", err)
+	}
+	if _, err := newCalloutServer(serverConfig{apiKeys: store}); err == nil {
+		t.Error("newCalloutServer with an unknown API key tenant succeeded, want error")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// authzExtension calls ext_authz Check like an authz extension with
+// wireFormat EXT_AUTHZ_GRPC. Only forwardHeaders are sent, in header_map.
+type authzExtension struct {
+	service        string
+	client         auth.AuthorizationClient
+	forwardHeaders map[string]bool
+	failOpen       bool
+	timeout        time.Duration
+}
+
+func newAuthzExtension(cfg authzExtensionConfig) (*authzExtension, error) {
+	conn, err := dialService(cfg.Service, cfg.Authority)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseTimeout(cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	a := &authzExtension{
+		service:  cfg.Service,
+		client:   auth.NewAuthorizationClient(conn),
+		failOpen: cfg.FailOpen,
+		timeout:  timeout,
+	}
+	if len(cfg.ForwardHeaders) > 0 {
+		a.forwardHeaders = make(map[string]bool, len(cfg.ForwardHeaders))
+		for _, h := range cfg.ForwardHeaders {
+			a.forwardHeaders[strings.ToLower(h)] = true
+		}
+	}
+	return a, nil
+}
+
+func dialService(service, authority string) (*grpc.ClientConn, error) {
+	if service == "" {
+		return nil, errors.New("service is required")
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if authority != "" {
+		opts = append(opts, grpc.WithAuthority(authority))
+	}
+	return grpc.NewClient(service, opts...)
+}
+
+// check authorizes r. On success it applies the returned request header
+// mutations to r and returns the headers to add to the response; otherwise
+// it returns the local response to send. A failed call is ignored when
+// failOpen is set and denied with 403 otherwise.
+func (a *authzExtension) check(r *http.Request) ([]*core.HeaderValueOption, *localResponse) {
+	ctx, cancel := context.WithTimeout(r.Context(), a.timeout)
+	defer cancel()
+
+	var include func(string) bool
+	if a.forwardHeaders != nil {
+		include = func(key string) bool { return a.forwardHeaders[key] }
+	}
+	resp, err := a.client.Check(ctx, &auth.CheckRequest{
+		Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+			Http: &auth.AttributeContext_HttpRequest{
+				Method:    r.Method,
+				Path:      r.URL.RequestURI(),
+				Host:      r.Host,
+				Scheme:    "http",
+				Protocol:  r.Proto,
+				HeaderMap: headerMap(nil, r.Header, include),
+			},
+		}},
+	})
+	if err != nil {
+		log.Printf("authz extension %s failed (failOpen=%v): %v", a.service, a.failOpen, err)
+		if a.failOpen {
+			return nil, nil
+		}
+		return nil, &localResponse{status: http.StatusForbidden, body: []byte("authz extension failed")}
+	}
+
+	if resp.GetStatus().GetCode() == int32(codes.OK) {
+		ok := resp.GetOkResponse()
+		applyHeaderMutation(r.Header, ok.GetHeaders(), ok.GetHeadersToRemove())
+		return ok.GetResponseHeadersToAdd(), nil
+	}
+	denied := resp.GetDeniedResponse()
+	local := &localResponse{status: http.StatusForbidden, headers: http.Header{}, body: []byte(denied.GetBody())}
+	if code := denied.GetStatus().GetCode(); code != 0 {
+		local.status = int(code)
+	}
+	applyHeaderMutation(local.headers, denied.GetHeaders(), nil)
+	return nil, local
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+// startCalloutServer builds cmd/callout-server and runs it with env on a
+// free local port, returning its address.
+func startCalloutServer(t testing.TB, env ...string) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds callout-server")
+	}
+	bin := filepath.Join(t.TempDir(), "callout-server")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	build.Dir = filepath.Join("..", "callout-server")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build callout-server: %v\n%s", err, out)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := lis.Addr().(*net.TCPAddr)
+	lis.Close()
+
+	var logs bytes.Buffer
+	cmd := exec.Command(bin)
+	cmd.Env = append(os.Environ(), append(env, "PORT="+strconv.Itoa(addr.Port))...)
+	cmd.Stdout, cmd.Stderr = &logs, &logs
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start callout-server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		conn, err := net.DialTimeout("tcp", addr.String(), time.Second)
+		if err == nil {
+			conn.Close()
+			return addr.String()
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("callout-server did not start: %v\n%s", err, logs.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// differentialListeners returns two load balancers in front of the same
+// origin: one calling callout-server over ext_authz and one running the Wasm
+// plugin, both configured with the fixture key.
+func differentialListeners(t testing.TB) (authz, wasm *listener) {
+	t.Helper()
+	origin := startOrigin(t)
+	service := startCalloutServer(t, "PUBLIC_KEY_PEM="+jwtverifytest.PublicKeyPEM())
+	conn, err := dialService(service, "")
+	if err != nil {
+		t.Fatalf("dial callout-server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	pluginConfig, _ := json.Marshal(map[string]any{"schema_version": 1, "public_key_pem": jwtverifytest.PublicKeyPEM()})
+	plugin, err := newWasmPlugin(context.Background(), wasmPluginConfig{Module: buildPlugin(t), PluginConfig: string(pluginConfig)})
+	if err != nil {
+		t.Fatalf("newWasmPlugin: %v", err)
+	}
+	authz = &listener{name: "authz", origin: origin, authz: &authzExtension{
+		service: service,
+		client:  auth.NewAuthorizationClient(conn),
+		timeout: 5 * time.Second,
+	}}
+	return authz, &listener{name: "wasm", origin: origin, wasm: plugin}
+}
+
+// assertSameDecision sends the same request through both listeners and
+// fails when callout-server and the plugin disagree on the status, the
+// denial body or the x-uid the origin receives.
+func assertSameDecision(t *testing.T, authz, wasm *listener, headers map[string]string) {
+	t.Helper()
+	var got [2]simResponse
+	for i, l := range []*listener{authz, wasm} {
+		req := httptest.NewRequest(http.MethodGet, "http://lb.example.com/api", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		got[i] = serve(t, l, req)
+	}
+	callout, plugin := got[0], got[1]
+	if callout.status != plugin.status {
+		t.Fatalf("headers %q: callout-server %d %q, plugin %d %q", headers, callout.status, callout.body, plugin.status, plugin.body)
+	}
+	if callout.status != http.StatusOK {
+		if callout.body != plugin.body {
+			t.Fatalf("headers %q: callout-server denies with %q, plugin with %q", headers, callout.body, plugin.body)
+		}
+		return
+	}
+	if a, b := callout.echo.Headers.Values("X-Uid"), plugin.echo.Headers.Values("X-Uid"); !slices.Equal(a, b) {
+		t.Fatalf("headers %q: origin x-uid from callout-server %q, from plugin %q", headers, a, b)
+	}
+}
+
+// validHeaderValue reports whether a load balancer would forward v; both
+// paths receive it unchanged, so only values a client can send are compared.
+func validHeaderValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return v == "" || v[0] != ' ' && v[0] != '\t' && v[len(v)-1] != ' ' && v[len(v)-1] != '\t'
+}
+
+// FuzzAuthorizationDifferential sends arbitrary authorization and spoofed
+// x-uid values through callout-server's Check and the Wasm plugin.
+func FuzzAuthorizationDifferential(f *testing.F) {
+	key := jwtverifytest.PrivateKey()
+	exp := time.Now().Add(24 * time.Hour).Unix()
+	valid := jwtverifytest.SignRS256(key, map[string]any{"alg": "RS256"}, map[string]any{"sub": "fuzz", "exp": exp})
+	f.Add("Bearer "+valid, "")
+	f.Add("Bearer "+valid, "spoofed")
+	f.Add("bearer "+valid, "")
+	f.Add("Bearer "+jwtverifytest.SignRS256(key, map[string]any{"alg": "RS256"}, map[string]any{"exp": exp}), "")
+	f.Add("Bearer "+jwtverifytest.SignRS256(key, map[string]any{"alg": "RS256"}, map[string]any{"sub": "fuzz", "exp": 1767225600}), "")
+	f.Add("Bearer abc.def", "spoofed")
+	f.Add("Bearer", "")
+	f.Add("", "spoofed")
+	authz, wasm := differentialListeners(f)
+	f.Fuzz(func(t *testing.T, authorization, uid string) {
+		if !validHeaderValue(authorization) || !validHeaderValue(uid) {
+			t.Skip("not a header value a client can send")
+		}
+		headers := map[string]string{}
+		if authorization != "" {
+			headers["Authorization"] = authorization
+		}
+		if uid != "" {
+			headers["X-Uid"] = uid
+		}
+		assertSameDecision(t, authz, wasm, headers)
+	})
+}
+
+// FuzzSignedClaimsDifferential signs arbitrary header and payload bytes
+// with the fixture key so that both sides get past the signature check and
+// disagreements in claim decoding and validation surface.
+func FuzzSignedClaimsDifferential(f *testing.F) {
+	f.Add([]byte(`{"alg":"RS256","typ":"JWT"}`), []byte(`{"sub":"fuzz"}`))
+	f.Add([]byte(`{"alg":"RS256","kid":"other"}`), []byte(`{"sub":"fuzz","aud":"a","exp":1767225660}`))
+	f.Add([]byte(`{"alg":"RS256"}`), []byte(`{"sub":"fuzz","iat":1767225600.5,"nbf":-1}`))
+	f.Add([]byte(`{"alg":"RS256"}`), []byte(`{"sub":"","exp":1e400}`))
+	f.Add([]byte(`{"alg":"ES256"}`), []byte(`{"sub":"fuzz"}`))
+	key := jwtverifytest.PrivateKey()
+	authz, wasm := differentialListeners(f)
+	f.Fuzz(func(t *testing.T, header, payload []byte) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		signingInput := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signingInput))
+		sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		assertSameDecision(t, authz, wasm, map[string]string{"Authorization": "Bearer " + signingInput + "." + b64(sig)})
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+const (
+	eventRequestHeaders  = "REQUEST_HEADERS"
+	eventRequestBody     = "REQUEST_BODY"
+	eventResponseHeaders = "RESPONSE_HEADERS"
+	eventResponseBody    = "RESPONSE_BODY"
+)
+
+// trafficExtension streams ext_proc events like a traffic extension. Only
+// supportedEvents are sent; bodies are buffered and sent in one message.
+type trafficExtension struct {
+	service  string
+	client   extproc.ExternalProcessorClient
+	failOpen bool
+	timeout  time.Duration
+	events   map[string]bool
+}
+
+func newTrafficExtension(cfg trafficExtensionConfig) (*trafficExtension, error) {
+	conn, err := dialService(cfg.Service, cfg.Authority)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseTimeout(cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.SupportedEvents) == 0 {
+		return nil, errors.New("supportedEvents is required")
+	}
+	t := &trafficExtension{
+		service:  cfg.Service,
+		client:   extproc.NewExternalProcessorClient(conn),
+		failOpen: cfg.FailOpen,
+		timeout:  timeout,
+		events:   make(map[string]bool, len(cfg.SupportedEvents)),
+	}
+	for _, event := range cfg.SupportedEvents {
+		switch event {
+		case eventRequestHeaders, eventRequestBody, eventResponseHeaders, eventResponseBody:
+			t.events[event] = true
+		case "REQUEST_TRAILERS", "RESPONSE_TRAILERS":
+			return nil, fmt.Errorf("supportedEvents: %s is not supported by lb-sim", event)
+		default:
+			return nil, fmt.Errorf("supportedEvents: unknown event %q", event)
+		}
+	}
+	return t, nil
+}
+
+// processStream is the Process stream of one HTTP request. Each message
+// must be answered within the extension timeout. After a failure the
+// remaining events are skipped: with failOpen the request continues
+// unmodified, otherwise the failing event returns 500.
+type processStream struct {
+	ext    *trafficExtension
+	stream extproc.ExternalProcessor_ProcessClient
+	cancel context.CancelFunc
+	err    error
+}
+
+// open starts the stream of a request. When it cannot be started the
+// returned local response is sent unless failOpen is set.
+func (t *trafficExtension) open(ctx context.Context) (*processStream, *localResponse) {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &processStream{ext: t, cancel: cancel}
+	stream, err := t.client.Process(ctx)
+	if err != nil {
+		return s, s.fail("open", err)
+	}
+	s.stream = stream
+	return s, nil
+}
+
+func (s *processStream) close() {
+	if s.stream != nil {
+		_ = s.stream.CloseSend()
+	}
+	s.cancel()
+}
+
+func (s *processStream) enabled(event string) bool {
+	return s.ext.events[event] && s.err == nil
+}
+
+// call sends one event and returns the common response to apply, or the
+// local response to send instead.
+func (s *processStream) call(event string, req *extproc.ProcessingRequest) (*extproc.CommonResponse, *localResponse) {
+	resp, err := s.exchange(req)
+	if err != nil {
+		return nil, s.fail(event, err)
+	}
+	if immediate := resp.GetImmediateResponse(); immediate != nil {
+		return nil, immediateLocalResponse(immediate)
+	}
+	var headers *extproc.HeadersResponse
+	var body *extproc.BodyResponse
+	switch event {
+	case eventRequestHeaders:
+		headers = resp.GetRequestHeaders()
+	case eventResponseHeaders:
+		headers = resp.GetResponseHeaders()
+	case eventRequestBody:
+		body = resp.GetRequestBody()
+	case eventResponseBody:
+		body = resp.GetResponseBody()
+	}
+	switch {
+	case headers != nil:
+		return headers.GetResponse(), nil
+	case body != nil:
+		return body.GetResponse(), nil
+	}
+	return nil, s.fail(event, fmt.Errorf("unexpected response %T", resp.GetResponse()))
+}
+
+func (s *processStream) exchange(req *extproc.ProcessingRequest) (*extproc.ProcessingResponse, error) {
+	timer := time.AfterFunc(s.ext.timeout, s.cancel)
+	defer timer.Stop()
+	if err := s.stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp, err := s.stream.Recv()
+	if err != nil && !timer.Stop() {
+		return nil, fmt.Errorf("timed out after %v", s.ext.timeout)
+	}
+	return resp, err
+}
+
+func (s *processStream) fail(event string, err error) *localResponse {
+	s.err = err
+	s.cancel()
+	log.Printf("traffic extension %s failed on %s (failOpen=%v): %v", s.ext.service, event, s.ext.failOpen, err)
+	if s.ext.failOpen {
+		return nil
+	}
+	return &localResponse{status: http.StatusInternalServerError, body: []byte("traffic extension failed")}
+}
+
+func (s *processStream) requestHeaders(r *http.Request) *localResponse {
+	if !s.enabled(eventRequestHeaders) {
+		return nil
+	}
+	common, local := s.call(eventRequestHeaders, &extproc.ProcessingRequest{
+		Request: &extproc.ProcessingRequest_RequestHeaders{RequestHeaders: &extproc.HttpHeaders{
+			Headers:     headerMap(requestPseudoHeaders(r), r.Header, nil),
+			EndOfStream: r.ContentLength == 0,
+		}},
+	})
+	if local != nil {
+		return local
+	}
+	mutation := common.GetHeaderMutation()
+	applyHeaderMutation(r.Header, mutation.GetSetHeaders(), mutation.GetRemoveHeaders())
+	return nil
+}
+
+func (s *processStream) requestBody(r *http.Request) *localResponse {
+	if !s.enabled(eventRequestBody) || r.ContentLength == 0 {
+		return nil
+	}
+	data, err := readBody(r.Body)
+	r.Body, r.ContentLength = replaceBody(r.Header, data)
+	if err != nil {
+		return s.fail(eventRequestBody, err)
+	}
+	common, local := s.call(eventRequestBody, &extproc.ProcessingRequest{
+		Request: &extproc.ProcessingRequest_RequestBody{RequestBody: &extproc.HttpBody{Body: data, EndOfStream: true}},
+	})
+	if local != nil {
+		return local
+	}
+	mutation := common.GetHeaderMutation()
+	applyHeaderMutation(r.Header, mutation.GetSetHeaders(), mutation.GetRemoveHeaders())
+	r.Body, r.ContentLength = replaceBody(r.Header, mutateBody(data, common.GetBodyMutation()))
+	return nil
+}
+
+func (s *processStream) responseHeaders(resp *http.Response) *localResponse {
+	if !s.enabled(eventResponseHeaders) {
+		return nil
+	}
+	common, local := s.call(eventResponseHeaders, &extproc.ProcessingRequest{
+		Request: &extproc.ProcessingRequest_ResponseHeaders{ResponseHeaders: &extproc.HttpHeaders{
+			Headers:     headerMap([][2]string{{":status", strconv.Itoa(resp.StatusCode)}}, resp.Header, nil),
+			EndOfStream: resp.ContentLength == 0,
+		}},
+	})
+	if local != nil {
+		return local
+	}
+	mutation := common.GetHeaderMutation()
+	applyHeaderMutation(resp.Header, mutation.GetSetHeaders(), mutation.GetRemoveHeaders())
+	return nil
+}
+
+func (s *processStream) responseBody(resp *http.Response) *localResponse {
+	if !s.enabled(eventResponseBody) || resp.ContentLength == 0 {
+		return nil
+	}
+	data, err := readBody(resp.Body)
+	resp.Body, resp.ContentLength = replaceBody(resp.Header, data)
+	if err != nil {
+		return s.fail(eventResponseBody, err)
+	}
+	common, local := s.call(eventResponseBody, &extproc.ProcessingRequest{
+		Request: &extproc.ProcessingRequest_ResponseBody{ResponseBody: &extproc.HttpBody{Body: data, EndOfStream: true}},
+	})
+	if local != nil {
+		return local
+	}
+	mutation := common.GetHeaderMutation()
+	applyHeaderMutation(resp.Header, mutation.GetSetHeaders(), mutation.GetRemoveHeaders())
+	resp.Body, resp.ContentLength = replaceBody(resp.Header, mutateBody(data, common.GetBodyMutation()))
+	return nil
+}
+
+func mutateBody(data []byte, mutation *extproc.BodyMutation) []byte {
+	switch {
+	case mutation.GetClearBody():
+		return nil
+	case mutation.GetBody() != nil:
+		return mutation.GetBody()
+	}
+	return data
+}
+
+func immediateLocalResponse(immediate *extproc.ImmediateResponse) *localResponse {
+	local := &localResponse{status: http.StatusOK, headers: http.Header{}, body: immediate.GetBody()}
+	if code := immediate.GetStatus().GetCode(); code != 0 {
+		local.status = int(code)
+	}
+	mutation := immediate.GetHeaders()
+	applyHeaderMutation(local.headers, mutation.GetSetHeaders(), mutation.GetRemoveHeaders())
+	return local
+}
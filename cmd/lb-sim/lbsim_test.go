@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// fakeAuthz answers Check with check.
+type fakeAuthz struct {
+	auth.UnimplementedAuthorizationServer
+	check func(*auth.CheckRequest) *auth.CheckResponse
+}
+
+func (f *fakeAuthz) Check(ctx context.Context, req *auth.CheckRequest) (*auth.CheckResponse, error) {
+	return f.check(req), nil
+}
+
+// fakeProc answers every ProcessingRequest with process and records the
+// events it received.
+type fakeProc struct {
+	extproc.UnimplementedExternalProcessorServer
+	process func(*extproc.ProcessingRequest) *extproc.ProcessingResponse
+
+	mu     sync.Mutex
+	events []string
+}
+
+func (f *fakeProc) Process(stream extproc.ExternalProcessor_ProcessServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		f.mu.Lock()
+		f.events = append(f.events, eventName(req))
+		f.mu.Unlock()
+		if err := stream.Send(f.process(req)); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *fakeProc) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = nil
+}
+
+func (f *fakeProc) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.events...)
+}
+
+func eventName(req *extproc.ProcessingRequest) string {
+	switch req.GetRequest().(type) {
+	case *extproc.ProcessingRequest_RequestHeaders:
+		return eventRequestHeaders
+	case *extproc.ProcessingRequest_RequestBody:
+		return eventRequestBody
+	case *extproc.ProcessingRequest_ResponseHeaders:
+		return eventResponseHeaders
+	case *extproc.ProcessingRequest_ResponseBody:
+		return eventResponseBody
+	}
+	return "unknown"
+}
+
+// startGRPC serves register on an in-memory listener and returns a client
+// connection to it.
+func startGRPC(t *testing.T, register func(*grpc.Server)) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	register(server)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// startOrigin is an origin-server stand-in echoing the request headers and
+// body as JSON.
+func startOrigin(t testing.TB) *url.URL {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Origin", "1")
+		_ = json.NewEncoder(w).Encode(map[string]any{"headers": r.Header, "body": string(body)})
+	}))
+	t.Cleanup(origin.Close)
+	u, _ := url.Parse(origin.URL)
+	return u
+}
+
+type simResponse struct {
+	status  int
+	headers http.Header
+	body    string
+	// echo is the request seen by the origin, when the request reached it.
+	echo struct {
+		Headers http.Header `json:"headers"`
+		Body    string      `json:"body"`
+	}
+}
+
+func serve(t *testing.T, l *listener, req *http.Request) simResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, req)
+	resp := simResponse{status: rec.Code, headers: rec.Header(), body: rec.Body.String()}
+	if rec.Header().Get("X-Origin") != "" {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp.echo); err != nil {
+			t.Fatalf("decode origin echo: %v", err)
+		}
+	}
+	return resp
+}
+
+func setHeader(key, value string) *core.HeaderValueOption {
+	return &core.HeaderValueOption{
+		Header: &core.HeaderValue{Key: key, RawValue: []byte(value)},
+		Append: wrapperspb.Bool(false),
+	}
+}
+
+func TestAuthzExtension(t *testing.T) {
+	var got *auth.CheckRequest
+	authz := &fakeAuthz{check: func(req *auth.CheckRequest) *auth.CheckResponse {
+		got = req
+		if headerMapValue(req.GetAttributes().GetRequest().GetHttp().GetHeaderMap(), "authorization") != "Bearer good" {
+			return &auth.CheckResponse{
+				Status: &status.Status{Code: int32(codes.PermissionDenied)},
+				HttpResponse: &auth.CheckResponse_DeniedResponse{DeniedResponse: &auth.DeniedHttpResponse{
+					Status:  &envoytype.HttpStatus{Code: envoytype.StatusCode_TooManyRequests},
+					Headers: []*core.HeaderValueOption{setHeader("retry-after", "1")},
+					Body:    "denied: rate limit exceeded",
+				}},
+			}
+		}
+		return &auth.CheckResponse{
+			Status: &status.Status{Code: int32(codes.OK)},
+			HttpResponse: &auth.CheckResponse_OkResponse{OkResponse: &auth.OkHttpResponse{
+				Headers:              []*core.HeaderValueOption{setHeader("x-uid", "demo-user")},
+				HeadersToRemove:      []string{"x-remove-me"},
+				ResponseHeadersToAdd: []*core.HeaderValueOption{setHeader("x-authz", "ok")},
+			}},
+		}
+	}}
+	conn := startGRPC(t, func(s *grpc.Server) { auth.RegisterAuthorizationServer(s, authz) })
+	l := &listener{name: "authz", origin: startOrigin(t), authz: &authzExtension{
+		service:        "fake",
+		client:         auth.NewAuthorizationClient(conn),
+		forwardHeaders: map[string]bool{"authorization": true},
+		timeout:        time.Second,
+	}}
+
+	t.Run("allowed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "http://lb.example.com/api?x=1", nil)
+		req.Header.Set("Authorization", "Bearer good")
+		req.Header.Set("X-Uid", "spoofed")
+		req.Header.Set("X-Remove-Me", "1")
+		resp := serve(t, l, req)
+		if resp.status != http.StatusOK {
+			t.Fatalf("status = %d, body %q", resp.status, resp.body)
+		}
+		if uid := resp.echo.Headers.Values("X-Uid"); len(uid) != 1 || uid[0] != "demo-user" {
+			t.Errorf("origin x-uid = %v, want [demo-user]", uid)
+		}
+		if v := resp.echo.Headers.Get("X-Remove-Me"); v != "" {
+			t.Errorf("origin x-remove-me = %q, want removed", v)
+		}
+		if v := resp.headers.Get("X-Authz"); v != "ok" {
+			t.Errorf("response x-authz = %q, want ok", v)
+		}
+		httpAttrs := got.GetAttributes().GetRequest().GetHttp()
+		if httpAttrs.GetPath() != "/api?x=1" || httpAttrs.GetMethod() != "GET" || httpAttrs.GetHost() != "lb.example.com" {
+			t.Errorf("http attributes = %v", httpAttrs)
+		}
+		if n := len(httpAttrs.GetHeaderMap().GetHeaders()); n != 1 {
+			t.Errorf("header_map has %d headers, want only forwardHeaders", n)
+		}
+	})
+	t.Run("denied", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "http://lb.example.com/", nil)
+		resp := serve(t, l, req)
+		if resp.status != http.StatusTooManyRequests || resp.body != "denied: rate limit exceeded" || resp.headers.Get("Retry-After") != "1" {
+			t.Errorf("response = %d %q %v, want denied response", resp.status, resp.body, resp.headers)
+		}
+	})
+}
+
+func TestAuthzExtensionFailure(t *testing.T) {
+	authz := &fakeAuthz{check: func(*auth.CheckRequest) *auth.CheckResponse {
+		time.Sleep(200 * time.Millisecond)
+		return &auth.CheckResponse{Status: &status.Status{Code: int32(codes.OK)}}
+	}}
+	conn := startGRPC(t, func(s *grpc.Server) { auth.RegisterAuthorizationServer(s, authz) })
+	origin := startOrigin(t)
+	for _, tc := range []struct {
+		failOpen   bool
+		wantStatus int
+	}{
+		{failOpen: false, wantStatus: http.StatusForbidden},
+		{failOpen: true, wantStatus: http.StatusOK},
+	} {
+		l := &listener{origin: origin, authz: &authzExtension{
+			service:  "fake",
+			client:   auth.NewAuthorizationClient(conn),
+			failOpen: tc.failOpen,
+			timeout:  20 * time.Millisecond,
+		}}
+		resp := serve(t, l, httptest.NewRequest(http.MethodGet, "http://lb.example.com/", nil))
+		if resp.status != tc.wantStatus {
+			t.Errorf("failOpen=%v: status = %d, want %d", tc.failOpen, resp.status, tc.wantStatus)
+		}
+	}
+}
+
+func continueResponse(req *extproc.ProcessingRequest, common *extproc.CommonResponse) *extproc.ProcessingResponse {
+	switch req.GetRequest().(type) {
+	case *extproc.ProcessingRequest_RequestHeaders:
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_RequestHeaders{RequestHeaders: &extproc.HeadersResponse{Response: common}}}
+	case *extproc.ProcessingRequest_ResponseHeaders:
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ResponseHeaders{ResponseHeaders: &extproc.HeadersResponse{Response: common}}}
+	case *extproc.ProcessingRequest_RequestBody:
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_RequestBody{RequestBody: &extproc.BodyResponse{Response: common}}}
+	default:
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ResponseBody{ResponseBody: &extproc.BodyResponse{Response: common}}}
+	}
+}
+
+func newTraffic(conn *grpc.ClientConn, failOpen bool, timeout time.Duration, events ...string) *trafficExtension {
+	t := &trafficExtension{
+		service:  "fake",
+		client:   extproc.NewExternalProcessorClient(conn),
+		failOpen: failOpen,
+		timeout:  timeout,
+		events:   make(map[string]bool),
+	}
+	for _, e := range events {
+		t.events[e] = true
+	}
+	return t
+}
+
+func TestTrafficExtensionEvents(t *testing.T) {
+	proc := &fakeProc{process: func(req *extproc.ProcessingRequest) *extproc.ProcessingResponse {
+		common := &extproc.CommonResponse{}
+		switch eventName(req) {
+		case eventRequestHeaders:
+			if headerMapValue(req.GetRequestHeaders().GetHeaders(), ":path") != "/echo" {
+				return continueResponse(req, common)
+			}
+			common.HeaderMutation = &extproc.HeaderMutation{SetHeaders: []*core.HeaderValueOption{setHeader("x-uid", "demo-user")}}
+		case eventRequestBody:
+			common.BodyMutation = &extproc.BodyMutation{Mutation: &extproc.BodyMutation_Body{Body: []byte(strings.ToUpper(string(req.GetRequestBody().GetBody())))}}
+		case eventResponseHeaders:
+			common.HeaderMutation = &extproc.HeaderMutation{RemoveHeaders: []string{"x-origin"}, SetHeaders: []*core.HeaderValueOption{setHeader("x-proc", "1")}}
+		}
+		return continueResponse(req, common)
+	}}
+	conn := startGRPC(t, func(s *grpc.Server) { extproc.RegisterExternalProcessorServer(s, proc) })
+	origin := startOrigin(t)
+
+	t.Run("request headers only", func(t *testing.T) {
+		proc.reset()
+		l := &listener{origin: origin, traffic: newTraffic(conn, false, time.Second, eventRequestHeaders)}
+		resp := serve(t, l, httptest.NewRequest(http.MethodPost, "http://lb.example.com/echo", strings.NewReader("hello")))
+		if got := resp.echo.Headers.Get("X-Uid"); got != "demo-user" {
+			t.Errorf("origin x-uid = %q, want demo-user", got)
+		}
+		if resp.echo.Body != "hello" {
+			t.Errorf("origin body = %q, want it unmodified", resp.echo.Body)
+		}
+		if got := proc.received(); len(got) != 1 || got[0] != eventRequestHeaders {
+			t.Errorf("events = %v, want only %s", got, eventRequestHeaders)
+		}
+	})
+	t.Run("all events", func(t *testing.T) {
+		proc.reset()
+		l := &listener{origin: origin, traffic: newTraffic(conn, false, time.Second,
+			eventRequestHeaders, eventRequestBody, eventResponseHeaders, eventResponseBody)}
+		resp := serve(t, l, httptest.NewRequest(http.MethodPost, "http://lb.example.com/echo", strings.NewReader("hello")))
+		if resp.headers.Get("X-Proc") != "1" || resp.headers.Get("X-Origin") != "" {
+			t.Errorf("response headers = %v, want x-proc set and x-origin removed", resp.headers)
+		}
+		if !strings.Contains(resp.body, `"body":"HELLO"`) {
+			t.Errorf("response body = %q, want the mutated request body echoed", resp.body)
+		}
+		want := []string{eventRequestHeaders, eventRequestBody, eventResponseHeaders, eventResponseBody}
+		if got := proc.received(); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("events = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestTrafficExtensionImmediateResponse(t *testing.T) {
+	proc := &fakeProc{process: func(*extproc.ProcessingRequest) *extproc.ProcessingResponse {
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ImmediateResponse{ImmediateResponse: &extproc.ImmediateResponse{
+			Status:  &envoytype.HttpStatus{Code: envoytype.StatusCode_Forbidden},
+			Headers: &extproc.HeaderMutation{SetHeaders: []*core.HeaderValueOption{setHeader("x-denied", "1")}},
+			Body:    []byte("denied: authorization header is missing"),
+		}}}
+	}}
+	conn := startGRPC(t, func(s *grpc.Server) { extproc.RegisterExternalProcessorServer(s, proc) })
+	l := &listener{origin: startOrigin(t), traffic: newTraffic(conn, false, time.Second, eventRequestHeaders, eventResponseHeaders)}
+	resp := serve(t, l, httptest.NewRequest(http.MethodGet, "http://lb.example.com/", nil))
+	if resp.status != http.StatusForbidden || resp.body != "denied: authorization header is missing" || resp.headers.Get("X-Denied") != "1" {
+		t.Errorf("response = %d %q %v, want the immediate response", resp.status, resp.body, resp.headers)
+	}
+	if got := proc.received(); len(got) != 1 {
+		t.Errorf("events = %v, want processing to stop after the immediate response", got)
+	}
+}
+
+func TestTrafficExtensionFailure(t *testing.T) {
+	proc := &fakeProc{process: func(req *extproc.ProcessingRequest) *extproc.ProcessingResponse {
+		time.Sleep(200 * time.Millisecond)
+		return continueResponse(req, &extproc.CommonResponse{})
+	}}
+	conn := startGRPC(t, func(s *grpc.Server) { extproc.RegisterExternalProcessorServer(s, proc) })
+	origin := startOrigin(t)
+	for _, tc := range []struct {
+		failOpen   bool
+		wantStatus int
+	}{
+		{failOpen: false, wantStatus: http.StatusInternalServerError},
+		{failOpen: true, wantStatus: http.StatusOK},
+	} {
+		l := &listener{origin: origin, traffic: newTraffic(conn, tc.failOpen, 20*time.Millisecond, eventRequestHeaders, eventResponseHeaders)}
+		resp := serve(t, l, httptest.NewRequest(http.MethodGet, "http://lb.example.com/", nil))
+		if resp.status != tc.wantStatus {
+			t.Errorf("failOpen=%v: status = %d, want %d", tc.failOpen, resp.status, tc.wantStatus)
+		}
+	}
+}
+
+func TestNewTrafficExtensionRejectsEvents(t *testing.T) {
+	for _, events := range [][]string{nil, {"REQUEST_TRAILERS"}, {"REQUEST_HEADER"}} {
+		_, err := newTrafficExtension(trafficExtensionConfig{Service: "localhost:9000", Timeout: "0.2s", SupportedEvents: events})
+		if err == nil {
+			t.Errorf("newTrafficExtension(%v) succeeded, want error", events)
+		}
+	}
+}
+
+func headerMapValue(m *core.HeaderMap, key string) string {
+	for _, h := range m.GetHeaders() {
+		if h.GetKey() == key {
+			return headerValue(h)
+		}
+	}
+	return ""
+}
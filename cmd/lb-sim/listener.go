@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// maxBufferedBody bounds request and response bodies sent to ext_proc body
+// events.
+const maxBufferedBody = 1 << 20
+
+// listener is one simulated load balancer: the extensions it calls and the
+// origin it forwards to.
+type listener struct {
+	name    string
+	origin  *url.URL
+	authz   *authzExtension
+	wasm    *wasmPlugin
+	traffic *trafficExtension
+}
+
+// localResponse is a response generated by the load balancer instead of the
+// origin: a denial, an immediate response or an extension failure.
+type localResponse struct {
+	status  int
+	headers http.Header
+	body    []byte
+}
+
+// localResponseError carries a local response out of ReverseProxy's
+// ModifyResponse.
+type localResponseError struct {
+	resp *localResponse
+}
+
+func (e *localResponseError) Error() string {
+	return "local response " + strconv.Itoa(e.resp.status)
+}
+
+func (r *localResponse) write(w http.ResponseWriter) {
+	for key, values := range r.headers {
+		for _, v := range values {
+			w.Header().Add(key, v)
+		}
+	}
+	if w.Header().Get("content-type") == "" {
+		w.Header().Set("content-type", "text/plain")
+	}
+	w.Header().Set("content-length", strconv.Itoa(len(r.body)))
+	w.WriteHeader(r.status)
+	_, _ = w.Write(r.body)
+}
+
+func (l *listener) describe() string {
+	var parts []string
+	if l.authz != nil {
+		parts = append(parts, "authz "+l.authz.service)
+	}
+	if l.wasm != nil {
+		parts = append(parts, "wasm "+l.wasm.name)
+	}
+	if l.traffic != nil {
+		parts = append(parts, "traffic "+l.traffic.service)
+	}
+	if len(parts) == 0 {
+		return "no extensions"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var responseHeaders []*core.HeaderValueOption
+	if l.authz != nil {
+		headers, local := l.authz.check(r)
+		if local != nil {
+			local.write(w)
+			return
+		}
+		responseHeaders = headers
+	}
+
+	var plugin *wasmHTTPContext
+	if l.wasm != nil {
+		var err error
+		if plugin, err = l.wasm.open(r.Context()); err != nil {
+			log.Printf("listener %q: wasm plugin failed: %v", l.name, err)
+			(&localResponse{status: http.StatusInternalServerError, body: []byte("wasm plugin failed")}).write(w)
+			return
+		}
+		defer plugin.close(r.Context())
+		if local := plugin.onRequestHeaders(r.Context(), r); local != nil {
+			local.write(w)
+			return
+		}
+	}
+
+	var stream *processStream
+	if l.traffic != nil {
+		var local *localResponse
+		stream, local = l.traffic.open(r.Context())
+		defer stream.close()
+		if local != nil {
+			local.write(w)
+			return
+		}
+		if local := stream.requestHeaders(r); local != nil {
+			local.write(w)
+			return
+		}
+		if local := stream.requestBody(r); local != nil {
+			local.write(w)
+			return
+		}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(l.origin)
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			applyHeaderMutation(resp.Header, responseHeaders, nil)
+			if plugin != nil {
+				if local := plugin.onResponseHeaders(resp.Request.Context(), resp); local != nil {
+					return &localResponseError{resp: local}
+				}
+			}
+			if stream == nil {
+				return nil
+			}
+			if local := stream.responseHeaders(resp); local != nil {
+				return &localResponseError{resp: local}
+			}
+			if local := stream.responseBody(resp); local != nil {
+				return &localResponseError{resp: local}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var local *localResponseError
+			if errors.As(err, &local) {
+				local.resp.write(w)
+				return
+			}
+			log.Printf("listener %q: origin error: %v", l.name, err)
+			(&localResponse{status: http.StatusBadGateway, body: []byte("upstream connect error")}).write(w)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// headerMap converts headers to an Envoy header map with lower-case keys
+// and values in raw_value, the way the load balancer sends them. pseudo
+// headers are added first.
+func headerMap(pseudo [][2]string, headers http.Header, include func(string) bool) *core.HeaderMap {
+	m := &core.HeaderMap{}
+	for _, h := range pseudo {
+		m.Headers = append(m.Headers, &core.HeaderValue{Key: h[0], RawValue: []byte(h[1])})
+	}
+	for key, values := range headers {
+		key = strings.ToLower(key)
+		if include != nil && !include(key) {
+			continue
+		}
+		for _, v := range values {
+			m.Headers = append(m.Headers, &core.HeaderValue{Key: key, RawValue: []byte(v)})
+		}
+	}
+	return m
+}
+
+func requestPseudoHeaders(r *http.Request) [][2]string {
+	return [][2]string{
+		{":method", r.Method},
+		{":path", r.URL.RequestURI()},
+		{":authority", r.Host},
+		{":scheme", "http"},
+	}
+}
+
+func headerValue(h *core.HeaderValue) string {
+	if len(h.GetRawValue()) > 0 {
+		return string(h.GetRawValue())
+	}
+	return h.GetValue()
+}
+
+// applyHeaderMutation applies set and remove operations to h. Mutations of
+// pseudo headers are ignored. An explicit append flag takes precedence over
+// append_action, as in Envoy.
+func applyHeaderMutation(h http.Header, set []*core.HeaderValueOption, remove []string) {
+	for _, name := range remove {
+		if !strings.HasPrefix(name, ":") {
+			h.Del(name)
+		}
+	}
+	for _, opt := range set {
+		key := opt.GetHeader().GetKey()
+		if key == "" || strings.HasPrefix(key, ":") {
+			continue
+		}
+		value := headerValue(opt.GetHeader())
+		action := opt.GetAppendAction()
+		if opt.GetAppend() != nil {
+			action = core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD
+			if opt.GetAppend().GetValue() {
+				action = core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD
+			}
+		}
+		_, exists := h[http.CanonicalHeaderKey(key)]
+		switch action {
+		case core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD:
+			h.Add(key, value)
+		case core.HeaderValueOption_ADD_IF_ABSENT:
+			if !exists {
+				h.Set(key, value)
+			}
+		case core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD:
+			h.Set(key, value)
+		case core.HeaderValueOption_OVERWRITE_IF_EXISTS:
+			if exists {
+				h.Set(key, value)
+			}
+		}
+	}
+}
+
+// readBody buffers body up to maxBufferedBody.
+func readBody(body io.ReadCloser) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, maxBufferedBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBufferedBody {
+		return nil, errors.New("body exceeds " + strconv.Itoa(maxBufferedBody) + " bytes")
+	}
+	return data, nil
+}
+
+func replaceBody(h http.Header, data []byte) (io.ReadCloser, int64) {
+	h.Set("content-length", strconv.Itoa(len(data)))
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data))
+}
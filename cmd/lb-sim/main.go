@@ -0,0 +1,145 @@
+// Command lb-sim is a local stand-in for the load balancers created by
+// deploy/gcloud. Each listener reverse-proxies to origin-server and calls
+// callout-server the way the authz extension (ext_authz Check) or the
+// traffic extension (ext_proc Process) of the templates does, or runs the
+// proxy_wasm plugin, so cmd/client can run every scenario without GCP.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// simConfig is the YAML format of LB_SIM_CONFIG. The extension blocks use
+// the field names of deploy/gcloud/templates, with service set to the
+// callout-server gRPC address instead of a backend service.
+type simConfig struct {
+	// Origin is the default upstream of every listener.
+	Origin    string           `yaml:"origin"`
+	Listeners []listenerConfig `yaml:"listeners"`
+}
+
+type listenerConfig struct {
+	Name   string `yaml:"name"`
+	Addr   string `yaml:"addr"`
+	Origin string `yaml:"origin"`
+	// Extensions run in this order when several are set.
+	AuthzExtension   *authzExtensionConfig   `yaml:"authzExtension"`
+	WasmPlugin       *wasmPluginConfig       `yaml:"wasmPlugin"`
+	TrafficExtension *trafficExtensionConfig `yaml:"trafficExtension"`
+}
+
+type authzExtensionConfig struct {
+	Service        string   `yaml:"service"`
+	Authority      string   `yaml:"authority"`
+	ForwardHeaders []string `yaml:"forwardHeaders"`
+	FailOpen       bool     `yaml:"failOpen"`
+	Timeout        string   `yaml:"timeout"`
+}
+
+type trafficExtensionConfig struct {
+	Service         string   `yaml:"service"`
+	Authority       string   `yaml:"authority"`
+	FailOpen        bool     `yaml:"failOpen"`
+	Timeout         string   `yaml:"timeout"`
+	SupportedEvents []string `yaml:"supportedEvents"`
+}
+
+func loadSimConfig(path string) (*simConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg simConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse lb-sim config: %w", err)
+	}
+	if len(cfg.Listeners) == 0 {
+		return nil, errors.New("at least one listener is required")
+	}
+	return &cfg, nil
+}
+
+// parseTimeout reads a template timeout such as "0.2s".
+func parseTimeout(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, errors.New("timeout is required")
+	}
+	timeout, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("timeout: %w", err)
+	}
+	if timeout <= 0 {
+		return 0, errors.New("timeout must be positive")
+	}
+	return timeout, nil
+}
+
+func newListener(cfg listenerConfig, defaultOrigin string) (*listener, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("addr is required")
+	}
+	originURL := cfg.Origin
+	if originURL == "" {
+		originURL = defaultOrigin
+	}
+	origin, err := url.Parse(originURL)
+	if err != nil || origin.Scheme == "" || origin.Host == "" {
+		return nil, fmt.Errorf("origin %q is not an absolute URL", originURL)
+	}
+	l := &listener{name: cfg.Name, origin: origin}
+	if cfg.AuthzExtension != nil {
+		if l.authz, err = newAuthzExtension(*cfg.AuthzExtension); err != nil {
+			return nil, fmt.Errorf("authzExtension: %w", err)
+		}
+	}
+	if cfg.WasmPlugin != nil {
+		if l.wasm, err = newWasmPlugin(context.Background(), *cfg.WasmPlugin); err != nil {
+			return nil, fmt.Errorf("wasmPlugin: %w", err)
+		}
+	}
+	if cfg.TrafficExtension != nil {
+		if l.traffic, err = newTrafficExtension(*cfg.TrafficExtension); err != nil {
+			return nil, fmt.Errorf("trafficExtension: %w", err)
+		}
+	}
+	return l, nil
+}
+
+func main() {
+	configFile := os.Getenv("LB_SIM_CONFIG")
+	if configFile == "" {
+		log.Fatalf("config error: LB_SIM_CONFIG is required")
+	}
+	cfg, err := loadSimConfig(configFile)
+	if err != nil {
+		log.Fatalf("read config error: %v", err)
+	}
+
+	errs := make(chan error, len(cfg.Listeners))
+	for i, lc := range cfg.Listeners {
+		l, err := newListener(lc, cfg.Origin)
+		if err != nil {
+			log.Fatalf("config error: listeners[%d]: %v", i, err)
+		}
+		server := &http.Server{
+			Addr:              lc.Addr,
+			Handler:           l,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		log.Printf("lb-sim listener %q on %s -> %s (%s)", lc.Name, lc.Addr, l.origin, l.describe())
+		go func() { errs <- server.ListenAndServe() }()
+	}
+	log.Fatalf("server error: %v", <-errs)
+}
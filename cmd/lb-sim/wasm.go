@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// proxy-wasm ABI values used by the host functions.
+const (
+	wasmStatusOK            = 0
+	wasmStatusNotFound      = 1
+	wasmStatusBadArgument   = 2
+	wasmStatusCasMismatch   = 8
+	wasmStatusUnimplemented = 12
+
+	wasmMapRequestHeaders  = 0
+	wasmMapResponseHeaders = 2
+
+	wasmBufferPluginConfiguration = 7
+
+	wasmActionContinue = 0
+)
+
+var wasmLogLevels = []string{"trace", "debug", "info", "warn", "error", "critical"}
+
+// wasmPlugin runs a proxy-wasm module like a Wasm plugin of the load
+// balancer. It implements the ABI subset plugins/wasm-jwt uses: logs,
+// plugin configuration, request and response headers, local responses,
+// shared data and metrics. HTTP callouts are not supported and ticks are
+// not delivered, so a remote JWKS (jwks_cluster) is never fetched.
+//
+// One VM serves every request; calls into it are serialized.
+type wasmPlugin struct {
+	name string
+
+	mu     sync.Mutex
+	module api.Module
+	rootID uint32
+	nextID uint32
+	// current is the HTTP context of the callback in progress.
+	current *wasmHTTPContext
+
+	pluginConfig []byte
+	shared       map[string]wasmSharedValue
+	nextCas      uint32
+	metrics      []wasmMetric
+	metricIDs    map[string]uint32
+}
+
+type wasmPluginConfig struct {
+	// Module is the path of the compiled plugin, e.g. plugin.wasm built by
+	// plugins/wasm-jwt/package/cloudbuild.yaml.
+	Module string `yaml:"module"`
+	// PluginConfig is the plugin configuration; PluginConfigFile reads it
+	// from a file like deploy-wasm.sh's --plugin-config-file.
+	PluginConfig     string `yaml:"pluginConfig"`
+	PluginConfigFile string `yaml:"pluginConfigFile"`
+}
+
+type wasmSharedValue struct {
+	data []byte
+	cas  uint32
+}
+
+type wasmMetric struct {
+	name  string
+	value uint64
+}
+
+// wasmHTTPContext is the plugin's HTTP context of one request.
+type wasmHTTPContext struct {
+	plugin          *wasmPlugin
+	id              uint32
+	requestHeaders  [][2]string
+	responseHeaders [][2]string
+	local           *localResponse
+}
+
+func newWasmPlugin(ctx context.Context, cfg wasmPluginConfig) (*wasmPlugin, error) {
+	if cfg.Module == "" {
+		return nil, errors.New("module is required")
+	}
+	code, err := os.ReadFile(cfg.Module)
+	if err != nil {
+		return nil, err
+	}
+	p := &wasmPlugin{
+		name:         cfg.Module,
+		pluginConfig: []byte(cfg.PluginConfig),
+		shared:       make(map[string]wasmSharedValue),
+		metricIDs:    make(map[string]uint32),
+	}
+	if cfg.PluginConfigFile != "" {
+		if cfg.PluginConfig != "" {
+			return nil, errors.New("pluginConfig and pluginConfigFile are mutually exclusive")
+		}
+		if p.pluginConfig, err = os.ReadFile(cfg.PluginConfigFile); err != nil {
+			return nil, err
+		}
+	}
+
+	runtime := wazero.NewRuntime(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+	if _, err := p.hostModule(runtime).Instantiate(ctx); err != nil {
+		return nil, fmt.Errorf("instantiate host functions: %w", err)
+	}
+	// Go wasip1 c-shared modules are reactors initialized by _initialize.
+	moduleConfig := wazero.NewModuleConfig().
+		WithStartFunctions("_initialize").
+		WithStdout(os.Stdout).
+		WithStderr(os.Stderr).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader)
+	if p.module, err = runtime.InstantiateWithConfig(ctx, code, moduleConfig); err != nil {
+		return nil, fmt.Errorf("instantiate %s: %w", cfg.Module, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rootID = p.newContextID()
+	if _, err := p.call(ctx, "proxy_on_context_create", uint64(p.rootID), 0); err != nil {
+		return nil, err
+	}
+	if ok, err := p.call(ctx, "proxy_on_vm_start", uint64(p.rootID), 0); err != nil {
+		return nil, err
+	} else if ok != 1 {
+		return nil, errors.New("VM start failed")
+	}
+	if ok, err := p.call(ctx, "proxy_on_configure", uint64(p.rootID), uint64(len(p.pluginConfig))); err != nil {
+		return nil, err
+	} else if ok != 1 {
+		return nil, errors.New("plugin start failed, see the plugin logs")
+	}
+	return p, nil
+}
+
+func (p *wasmPlugin) newContextID() uint32 {
+	p.nextID++
+	return p.nextID
+}
+
+// call runs an exported function and returns its first result.
+func (p *wasmPlugin) call(ctx context.Context, name string, params ...uint64) (uint64, error) {
+	fn := p.module.ExportedFunction(name)
+	if fn == nil {
+		return 0, fmt.Errorf("module does not export %s", name)
+	}
+	results, err := fn.Call(ctx, params...)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(results) == 0 {
+		return 0, nil
+	}
+	return results[0], nil
+}
+
+// open creates the HTTP context of a request.
+func (p *wasmPlugin) open(ctx context.Context) (*wasmHTTPContext, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := &wasmHTTPContext{plugin: p, id: p.newContextID()}
+	if _, err := p.call(ctx, "proxy_on_context_create", uint64(c.id), uint64(p.rootID)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// invoke runs an HTTP callback with c as the current context. A paused
+// stream must have sent a local response; pausing to wait for a callout
+// is not supported.
+func (c *wasmHTTPContext) invoke(ctx context.Context, name string, numHeaders int) *localResponse {
+	p := c.plugin
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = c
+	defer func() { p.current = nil }()
+	action, err := p.call(ctx, name, uint64(c.id), uint64(numHeaders), 1)
+	if err != nil {
+		log.Printf("wasm plugin %s failed: %v", p.name, err)
+		return &localResponse{status: http.StatusInternalServerError, body: []byte("wasm plugin failed")}
+	}
+	if c.local != nil {
+		return c.local
+	}
+	if action != wasmActionContinue {
+		log.Printf("wasm plugin %s paused %s without a local response", p.name, name)
+		return &localResponse{status: http.StatusInternalServerError, body: []byte("wasm plugin paused the request")}
+	}
+	return nil
+}
+
+func (c *wasmHTTPContext) onRequestHeaders(ctx context.Context, r *http.Request) *localResponse {
+	c.requestHeaders = headerPairs(requestPseudoHeaders(r), r.Header)
+	if local := c.invoke(ctx, "proxy_on_request_headers", len(c.requestHeaders)); local != nil {
+		return local
+	}
+	r.Header = pairsToHeader(c.requestHeaders)
+	return nil
+}
+
+func (c *wasmHTTPContext) onResponseHeaders(ctx context.Context, resp *http.Response) *localResponse {
+	c.responseHeaders = headerPairs([][2]string{{":status", strconv.Itoa(resp.StatusCode)}}, resp.Header)
+	if local := c.invoke(ctx, "proxy_on_response_headers", len(c.responseHeaders)); local != nil {
+		return local
+	}
+	resp.Header = pairsToHeader(c.responseHeaders)
+	return nil
+}
+
+func (c *wasmHTTPContext) close(ctx context.Context) {
+	p := c.plugin
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, name := range []string{"proxy_on_log", "proxy_on_done", "proxy_on_delete"} {
+		if _, err := p.call(ctx, name, uint64(c.id)); err != nil {
+			log.Printf("wasm plugin %s failed: %v", p.name, err)
+			return
+		}
+	}
+}
+
+func headerPairs(pseudo [][2]string, headers http.Header) [][2]string {
+	pairs := append([][2]string(nil), pseudo...)
+	for key, values := range headers {
+		for _, v := range values {
+			pairs = append(pairs, [2]string{strings.ToLower(key), v})
+		}
+	}
+	return pairs
+}
+
+func pairsToHeader(pairs [][2]string) http.Header {
+	h := http.Header{}
+	for _, kv := range pairs {
+		if !strings.HasPrefix(kv[0], ":") {
+			h.Add(kv[0], kv[1])
+		}
+	}
+	return h
+}
+
+// hostModule defines the "env" imports of the plugin. Every function
+// returns a proxy-wasm status.
+func (p *wasmPlugin) hostModule(runtime wazero.Runtime) wazero.HostModuleBuilder {
+	b := runtime.NewHostModuleBuilder("env")
+	export := func(name string, fn any) {
+		b.NewFunctionBuilder().WithFunc(fn).Export(name)
+	}
+
+	export("proxy_log", func(ctx context.Context, m api.Module, level, ptr, size uint32) uint32 {
+		name := "unknown"
+		if int(level) < len(wasmLogLevels) {
+			name = wasmLogLevels[level]
+		}
+		log.Printf("wasm %s [%s]: %s", p.name, name, read(m, ptr, size))
+		return wasmStatusOK
+	})
+	export("proxy_get_buffer_bytes", func(ctx context.Context, m api.Module, bufferType, start, maxSize, retPtr, retSize uint32) uint32 {
+		if bufferType != wasmBufferPluginConfiguration {
+			return wasmStatusNotFound
+		}
+		data := p.pluginConfig
+		if int(start) > len(data) {
+			return wasmStatusBadArgument
+		}
+		data = data[start:]
+		if int(maxSize) < len(data) {
+			data = data[:maxSize]
+		}
+		return writeBytes(ctx, m, data, retPtr, retSize)
+	})
+
+	export("proxy_get_header_map_value", func(ctx context.Context, m api.Module, mapType, keyPtr, keySize, retPtr, retSize uint32) uint32 {
+		pairs := p.headerMap(mapType)
+		if pairs == nil {
+			return wasmStatusNotFound
+		}
+		key := strings.ToLower(string(read(m, keyPtr, keySize)))
+		for _, kv := range *pairs {
+			if kv[0] == key {
+				return writeBytes(ctx, m, []byte(kv[1]), retPtr, retSize)
+			}
+		}
+		return wasmStatusNotFound
+	})
+	export("proxy_get_header_map_pairs", func(ctx context.Context, m api.Module, mapType, retPtr, retSize uint32) uint32 {
+		pairs := p.headerMap(mapType)
+		if pairs == nil {
+			return wasmStatusNotFound
+		}
+		return writeBytes(ctx, m, serializeHeaderPairs(*pairs), retPtr, retSize)
+	})
+	export("proxy_add_header_map_value", func(ctx context.Context, m api.Module, mapType, keyPtr, keySize, valuePtr, valueSize uint32) uint32 {
+		pairs := p.headerMap(mapType)
+		if pairs == nil {
+			return wasmStatusNotFound
+		}
+		*pairs = append(*pairs, [2]string{strings.ToLower(string(read(m, keyPtr, keySize))), string(read(m, valuePtr, valueSize))})
+		return wasmStatusOK
+	})
+	export("proxy_replace_header_map_value", func(ctx context.Context, m api.Module, mapType, keyPtr, keySize, valuePtr, valueSize uint32) uint32 {
+		pairs := p.headerMap(mapType)
+		if pairs == nil {
+			return wasmStatusNotFound
+		}
+		key := strings.ToLower(string(read(m, keyPtr, keySize)))
+		*pairs = append(removePairs(*pairs, key), [2]string{key, string(read(m, valuePtr, valueSize))})
+		return wasmStatusOK
+	})
+	export("proxy_remove_header_map_value", func(ctx context.Context, m api.Module, mapType, keyPtr, keySize uint32) uint32 {
+		pairs := p.headerMap(mapType)
+		if pairs == nil {
+			return wasmStatusNotFound
+		}
+		*pairs = removePairs(*pairs, strings.ToLower(string(read(m, keyPtr, keySize))))
+		return wasmStatusOK
+	})
+	export("proxy_send_local_response", func(ctx context.Context, m api.Module, status, detailsPtr, detailsSize, bodyPtr, bodySize, headersPtr, headersSize, grpcStatus uint32) uint32 {
+		if p.current == nil {
+			return wasmStatusBadArgument
+		}
+		headers, err := deserializeHeaderPairs(read(m, headersPtr, headersSize))
+		if err != nil {
+			return wasmStatusBadArgument
+		}
+		p.current.local = &localResponse{
+			status:  int(status),
+			headers: pairsToHeader(headers),
+			body:    read(m, bodyPtr, bodySize),
+		}
+		return wasmStatusOK
+	})
+
+	export("proxy_get_shared_data", func(ctx context.Context, m api.Module, keyPtr, keySize, retPtr, retSize, retCas uint32) uint32 {
+		value, ok := p.shared[string(read(m, keyPtr, keySize))]
+		if !ok {
+			return wasmStatusNotFound
+		}
+		if status := writeBytes(ctx, m, value.data, retPtr, retSize); status != wasmStatusOK {
+			return status
+		}
+		m.Memory().WriteUint32Le(retCas, value.cas)
+		return wasmStatusOK
+	})
+	export("proxy_set_shared_data", func(ctx context.Context, m api.Module, keyPtr, keySize, valuePtr, valueSize, cas uint32) uint32 {
+		key := string(read(m, keyPtr, keySize))
+		if current, ok := p.shared[key]; ok && cas != 0 && cas != current.cas {
+			return wasmStatusCasMismatch
+		}
+		p.nextCas++
+		p.shared[key] = wasmSharedValue{data: read(m, valuePtr, valueSize), cas: p.nextCas}
+		return wasmStatusOK
+	})
+
+	export("proxy_define_metric", func(ctx context.Context, m api.Module, metricType, namePtr, nameSize, retID uint32) uint32 {
+		name := string(read(m, namePtr, nameSize))
+		id, ok := p.metricIDs[name]
+		if !ok {
+			id = uint32(len(p.metrics))
+			p.metrics = append(p.metrics, wasmMetric{name: name})
+			p.metricIDs[name] = id
+		}
+		m.Memory().WriteUint32Le(retID, id)
+		return wasmStatusOK
+	})
+	export("proxy_increment_metric", func(ctx context.Context, m api.Module, id uint32, offset int64) uint32 {
+		if int(id) >= len(p.metrics) {
+			return wasmStatusNotFound
+		}
+		p.metrics[id].value += uint64(offset)
+		return wasmStatusOK
+	})
+	export("proxy_record_metric", func(ctx context.Context, m api.Module, id uint32, value uint64) uint32 {
+		if int(id) >= len(p.metrics) {
+			return wasmStatusNotFound
+		}
+		p.metrics[id].value = value
+		return wasmStatusOK
+	})
+
+	export("proxy_set_tick_period_milliseconds", func(ctx context.Context, m api.Module, period uint32) uint32 {
+		return wasmStatusOK
+	})
+	export("proxy_set_effective_context", func(ctx context.Context, m api.Module, id uint32) uint32 {
+		return wasmStatusOK
+	})
+	export("proxy_http_call", func(ctx context.Context, m api.Module, upstreamPtr, upstreamSize, headersPtr, headersSize, bodyPtr, bodySize, trailersPtr, trailersSize, timeout, retID uint32) uint32 {
+		log.Printf("wasm %s: proxy_http_call to %s is not supported by lb-sim", p.name, read(m, upstreamPtr, upstreamSize))
+		return wasmStatusUnimplemented
+	})
+	return b
+}
+
+// headerMap returns the header map of the current context, or nil for maps
+// lb-sim does not provide.
+func (p *wasmPlugin) headerMap(mapType uint32) *[][2]string {
+	if p.current == nil {
+		return nil
+	}
+	switch mapType {
+	case wasmMapRequestHeaders:
+		return &p.current.requestHeaders
+	case wasmMapResponseHeaders:
+		return &p.current.responseHeaders
+	}
+	return nil
+}
+
+func removePairs(pairs [][2]string, key string) [][2]string {
+	kept := pairs[:0]
+	for _, kv := range pairs {
+		if kv[0] != key {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
+
+// read copies size bytes at ptr out of the module memory.
+func read(m api.Module, ptr, size uint32) []byte {
+	if size == 0 {
+		return nil
+	}
+	data, ok := m.Memory().Read(ptr, size)
+	if !ok {
+		return nil
+	}
+	return append([]byte(nil), data...)
+}
+
+// writeBytes returns data to the module: the buffer is allocated with
+// proxy_on_memory_allocate and its address and size are written to retPtr
+// and retSize.
+func writeBytes(ctx context.Context, m api.Module, data []byte, retPtr, retSize uint32) uint32 {
+	var ptr uint32
+	if len(data) > 0 {
+		results, err := m.ExportedFunction("proxy_on_memory_allocate").Call(ctx, uint64(len(data)))
+		if err != nil || len(results) == 0 {
+			return wasmStatusBadArgument
+		}
+		ptr = uint32(results[0])
+		if !m.Memory().Write(ptr, data) {
+			return wasmStatusBadArgument
+		}
+	}
+	if !m.Memory().WriteUint32Le(retPtr, ptr) || !m.Memory().WriteUint32Le(retSize, uint32(len(data))) {
+		return wasmStatusBadArgument
+	}
+	return wasmStatusOK
+}
+
+// serializeHeaderPairs encodes pairs in the proxy-wasm map format: the
+// number of pairs, the key and value sizes, then each key and value
+// followed by a NUL byte.
+func serializeHeaderPairs(pairs [][2]string) []byte {
+	size := 4
+	for _, kv := range pairs {
+		size += 8 + len(kv[0]) + len(kv[1]) + 2
+	}
+	buf := make([]byte, 4, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(pairs)))
+	for _, kv := range pairs {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(kv[0])))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(kv[1])))
+	}
+	for _, kv := range pairs {
+		buf = append(append(buf, kv[0]...), 0)
+		buf = append(append(buf, kv[1]...), 0)
+	}
+	return buf
+}
+
+func deserializeHeaderPairs(data []byte) ([][2]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(data) < 4 {
+		return nil, errors.New("header map is truncated")
+	}
+	n := int(binary.LittleEndian.Uint32(data))
+	sizes := 4
+	offset := 4 + 8*n
+	if n < 0 || offset > len(data) {
+		return nil, errors.New("header map is truncated")
+	}
+	pairs := make([][2]string, n)
+	for i := range pairs {
+		for j := range 2 {
+			size := int(binary.LittleEndian.Uint32(data[sizes:]))
+			sizes += 4
+			if offset+size+1 > len(data) {
+				return nil, errors.New("header map is truncated")
+			}
+			pairs[i][j] = string(data[offset : offset+size])
+			offset += size + 1
+		}
+	}
+	return pairs, nil
+}
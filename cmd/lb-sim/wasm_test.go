@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+// buildPlugin compiles plugins/wasm-jwt the way its cloudbuild.yaml does.
+func buildPlugin(t testing.TB) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds the Wasm plugin")
+	}
+	module := filepath.Join(t.TempDir(), "plugin.wasm")
+	cmd := exec.Command("go", "build", "-buildmode=c-shared", "-trimpath", "-o", module, ".")
+	cmd.Dir = filepath.Join("..", "..", "plugins", "wasm-jwt")
+	cmd.Env = append(os.Environ(), "GOWORK=off", "GOOS=wasip1", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("build plugin: %v\n%s", err, out)
+	}
+	return module
+}
+
+func TestWasmPlugin(t *testing.T) {
+	pluginConfig, _ := json.Marshal(map[string]any{
+		"schema_version":   1,
+		"public_key_pem":   jwtverifytest.PublicKeyPEM(),
+		"security_headers": map[string]string{"x-frame-options": "DENY"},
+	})
+	plugin, err := newWasmPlugin(context.Background(), wasmPluginConfig{Module: buildPlugin(t), PluginConfig: string(pluginConfig)})
+	if err != nil {
+		t.Fatalf("newWasmPlugin: %v", err)
+	}
+	l := &listener{name: "wasm", origin: startOrigin(t), wasm: plugin}
+
+	t.Run("allowed", func(t *testing.T) {
+		token := jwtverifytest.SignRS256(jwtverifytest.PrivateKey(), map[string]any{"alg": "RS256", "typ": "JWT"},
+			map[string]any{"sub": "demo-user", "exp": time.Now().Add(time.Hour).Unix()})
+		req := httptest.NewRequest(http.MethodGet, "http://lb.example.com/api", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Uid", "spoofed")
+		req.Header.Set("X-Debug", "1")
+		resp := serve(t, l, req)
+		if resp.status != http.StatusOK {
+			t.Fatalf("status = %d, body %q", resp.status, resp.body)
+		}
+		if uid := resp.echo.Headers.Values("X-Uid"); len(uid) != 1 || uid[0] != "demo-user" {
+			t.Errorf("origin x-uid = %v, want [demo-user]", uid)
+		}
+		if v := resp.headers.Get("X-Frame-Options"); v != "DENY" {
+			t.Errorf("response x-frame-options = %q, want DENY", v)
+		}
+		if v := resp.headers.Get("X-Auth-Decision"); v != "allow" {
+			t.Errorf("response x-auth-decision = %q, want allow", v)
+		}
+	})
+	valid := jwtverifytest.SignRS256(jwtverifytest.PrivateKey(), map[string]any{"alg": "RS256"},
+		map[string]any{"sub": "demo-user", "exp": time.Now().Add(time.Hour).Unix()})
+	for _, tc := range []struct {
+		name, authorization, wantReason string
+	}{
+		{name: "missing_auth", wantReason: "authorization header is missing"},
+		{name: "not_bearer", authorization: "Token " + valid, wantReason: "authorization header is invalid"},
+		{name: "bad_signature", authorization: "Bearer " + valid[:len(valid)-4] + "AAAA", wantReason: "token signature is invalid"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://lb.example.com/api", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			resp := serve(t, l, req)
+			if resp.status != http.StatusForbidden || resp.body != "denied: "+tc.wantReason {
+				t.Errorf("response = %d %q, want 403 denied: %s", resp.status, resp.body, tc.wantReason)
+			}
+			if v := resp.headers.Get("X-Frame-Options"); v != "DENY" {
+				t.Errorf("local response x-frame-options = %q, want DENY", v)
+			}
+		})
+	}
+}
+
+func TestNewWasmPluginRejectsConfig(t *testing.T) {
+	for _, cfg := range []wasmPluginConfig{
+		{},
+		{Module: "plugin.wasm", PluginConfig: "{}", PluginConfigFile: "plugin.json"},
+	} {
+		if _, err := newWasmPlugin(context.Background(), cfg); err == nil {
+			t.Errorf("newWasmPlugin(%+v) succeeded, want error", cfg)
+		}
+	}
+}
+
+func TestHeaderPairsRoundTrip(t *testing.T) {
+	pairs := [][2]string{{":status", "200"}, {"x-empty", ""}, {"set-cookie", "a=1"}, {"set-cookie", "b=2"}}
+	got, err := deserializeHeaderPairs(serializeHeaderPairs(pairs))
+	if err != nil {
+		t.Fatalf("deserializeHeaderPairs: %v", err)
+	}
+	if !reflect.DeepEqual(got, pairs) {
+		t.Errorf("round trip = %v, want %v", got, pairs)
+	}
+	if _, err := deserializeHeaderPairs([]byte{1, 0, 0, 0}); err == nil {
+		t.Error("deserializeHeaderPairs accepted a truncated map")
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+)
+
+const (
+	identityModeJWT  = "jwt"
+	identityModeHMAC = "hmac"
+
+	defaultJWTIdentityHeader  = "x-internal-token"
+	defaultHMACIdentityHeader = "x-identity"
+	defaultSubjectHeader      = "x-uid"
+
+	// jwksRefreshInterval bounds how often an unknown kid refetches the
+	// JWKS; jwksMaxAge is how long a fetched JWKS is used, matching the
+	// callout-server Cache-Control.
+	jwksRefreshInterval = 30 * time.Second
+	jwksMaxAge          = 5 * time.Minute
+
+	minHMACKeyLength = 32
+)
+
+var (
+	errMissingIdentity  = errors.New("identity header is missing")
+	errInvalidEnvelope  = errors.New("identity envelope is invalid")
+	errForgedIdentity   = errors.New("identity signature is invalid")
+	errIdentityExpired  = errors.New("identity is expired")
+	errIdentityIssuer   = errors.New("identity issuer is not accepted")
+	errIdentityAudience = errors.New("identity audience is not accepted")
+	errSubjectMismatch  = errors.New("subject header does not match the verified identity")
+	errKeysUnavailable  = errors.New("identity keys are unavailable")
+)
+
+// identityConfig is read from the IDENTITY_* environment variables. The
+// middleware is disabled while mode is empty.
+type identityConfig struct {
+	// mode is jwt (a token minted by callout-server) or hmac (an envelope
+	// signed with a shared key).
+	mode string
+	// header carries the signed identity.
+	header string
+	// subjectHeader, when present on a request, must name the verified
+	// subject, so a forwarded plain x-uid cannot disagree with it.
+	subjectHeader string
+
+	// jwksURL or jwksFile hold the keys of jwt mode; audience is required and
+	// issuer is checked when set.
+	jwksURL  string
+	jwksFile string
+	audience string
+	issuer   string
+
+	hmacKey []byte
+
+	// clock is time.Now when nil.
+	clock func() time.Time
+}
+
+func identityConfigFromEnv(getenv func(string) string) identityConfig {
+	return identityConfig{
+		mode:          getenv("IDENTITY_MODE"),
+		header:        strings.ToLower(getenv("IDENTITY_HEADER")),
+		subjectHeader: strings.ToLower(getenv("IDENTITY_SUBJECT_HEADER")),
+		jwksURL:       getenv("IDENTITY_JWKS_URL"),
+		jwksFile:      getenv("IDENTITY_JWKS_FILE"),
+		audience:      getenv("IDENTITY_AUDIENCE"),
+		issuer:        getenv("IDENTITY_ISSUER"),
+		hmacKey:       []byte(getenv("IDENTITY_HMAC_KEY")),
+	}
+}
+
+// principal is the verified caller, returned in the response body.
+type principal struct {
+	Mode      string         `json:"mode"`
+	Subject   string         `json:"subject"`
+	Issuer    string         `json:"issuer,omitempty"`
+	Actor     string         `json:"actor,omitempty"`
+	ExpiresAt int64          `json:"expires_at"`
+	Claims    map[string]any `json:"claims,omitempty"`
+}
+
+type principalKey struct{}
+
+func principalFromContext(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// identityVerifier checks the signed identity of every request.
+type identityVerifier struct {
+	identityConfig
+	keys *jwksSource
+}
+
+func newIdentityVerifier(cfg identityConfig) (*identityVerifier, error) {
+	if cfg.subjectHeader == "" {
+		cfg.subjectHeader = defaultSubjectHeader
+	}
+	if cfg.clock == nil {
+		cfg.clock = time.Now
+	}
+	v := &identityVerifier{identityConfig: cfg}
+	switch cfg.mode {
+	case identityModeJWT:
+		if v.header == "" {
+			v.header = defaultJWTIdentityHeader
+		}
+		if cfg.audience == "" {
+			return nil, errors.New("IDENTITY_AUDIENCE is required in jwt mode")
+		}
+		if (cfg.jwksURL == "") == (cfg.jwksFile == "") {
+			return nil, errors.New("one of IDENTITY_JWKS_URL and IDENTITY_JWKS_FILE is required in jwt mode")
+		}
+		v.keys = &jwksSource{url: cfg.jwksURL, clock: cfg.clock, client: &http.Client{Timeout: 5 * time.Second}}
+		if cfg.jwksFile != "" {
+			raw, err := os.ReadFile(cfg.jwksFile)
+			if err != nil {
+				return nil, err
+			}
+			if err := v.keys.set(raw); err != nil {
+				return nil, err
+			}
+		}
+	case identityModeHMAC:
+		if v.header == "" {
+			v.header = defaultHMACIdentityHeader
+		}
+		if len(cfg.hmacKey) < minHMACKeyLength {
+			return nil, fmt.Errorf("IDENTITY_HMAC_KEY must be at least %d bytes", minHMACKeyLength)
+		}
+	default:
+		return nil, fmt.Errorf("unknown IDENTITY_MODE: %q", cfg.mode)
+	}
+	return v, nil
+}
+
+// middleware answers 401 unless the request carries a valid signed
+// identity, and passes the principal to next in the request context.
+func (v *identityVerifier) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := v.verify(r)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+func (v *identityVerifier) verify(r *http.Request) (*principal, error) {
+	value := r.Header.Get(v.header)
+	if value == "" {
+		return nil, errMissingIdentity
+	}
+	var p *principal
+	var err error
+	if v.mode == identityModeJWT {
+		p, err = v.verifyJWT(r.Context(), value)
+	} else {
+		p, err = verifyEnvelope(v.hmacKey, value, v.clock())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subject := r.Header.Get(v.subjectHeader); subject != "" && subject != p.Subject {
+		return nil, errSubjectMismatch
+	}
+	return p, nil
+}
+
+func (v *identityVerifier) verifyJWT(ctx context.Context, token string) (*principal, error) {
+	claims, err := v.keys.verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, errIdentityIssuer
+	}
+	if !slices.Contains(claims.Audience, v.audience) {
+		return nil, errIdentityAudience
+	}
+	p := &principal{Mode: identityModeJWT, Subject: claims.Subject, Issuer: claims.Issuer, Claims: claims.Raw}
+	if claims.ExpiresAt != nil {
+		p.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if act, ok := claims.Raw["act"].(map[string]any); ok {
+		p.Actor, _ = act["sub"].(string)
+	}
+	return p, nil
+}
+
+// envelope is the payload of an hmac identity:
+// base64url(JSON payload) "." base64url(HMAC-SHA256(key, first part)).
+type envelope struct {
+	Sub string `json:"sub"`
+	Exp int64  `json:"exp"`
+}
+
+func verifyEnvelope(key []byte, value string, now time.Time) (*principal, error) {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, errInvalidEnvelope
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, errInvalidEnvelope
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return nil, errForgedIdentity
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidEnvelope
+	}
+	var e envelope
+	if err := json.Unmarshal(raw, &e); err != nil || e.Sub == "" || e.Exp == 0 {
+		return nil, errInvalidEnvelope
+	}
+	if now.Unix() >= e.Exp {
+		return nil, errIdentityExpired
+	}
+	return &principal{Mode: identityModeHMAC, Subject: e.Sub, ExpiresAt: e.Exp}, nil
+}
+
+// jwksSource holds the verifier for the current JWKS. A JWKS from url is
+// fetched on first use, again after jwksMaxAge, and when a token names an
+// unknown kid (at most every jwksRefreshInterval) so key rotation works
+// without a restart. Until a fetch succeeds it is retried at most every
+// jwksRefreshInterval too.
+type jwksSource struct {
+	url    string
+	client *http.Client
+	clock  func() time.Time
+
+	mu       sync.Mutex
+	verifier *jwtverify.Verifier
+	// fetched is when the last fetch started, failed or not.
+	fetched time.Time
+	// refreshing is closed when the fetch in flight ends, nil when none is.
+	refreshing chan struct{}
+}
+
+func (s *jwksSource) set(raw []byte) error {
+	keys, err := jwtverify.ParseJWKS(raw)
+	if err != nil {
+		return err
+	}
+	verifier, err := jwtverify.NewVerifier(keys, jwtverify.Options{RequireExpiration: true, Now: s.clock})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.verifier = verifier
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *jwksSource) verify(ctx context.Context, token string) (*jwtverify.Claims, error) {
+	verifier, err := s.current(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := verifier.Verify(token)
+	if errors.Is(err, jwtverify.ErrUnknownKey) && s.url != "" {
+		if verifier, err = s.current(ctx, true); err != nil {
+			return nil, err
+		}
+		claims, err = verifier.Verify(token)
+	}
+	return claims, err
+}
+
+// current returns the verifier, fetching the JWKS when it is missing or old,
+// or when unknownKey is set and the last fetch is not recent. The fetch runs
+// once in the background for all callers; only callers without usable keys
+// wait for it, and no longer than ctx allows.
+func (s *jwksSource) current(ctx context.Context, unknownKey bool) (*jwtverify.Verifier, error) {
+	s.mu.Lock()
+	if s.url != "" && s.refreshing == nil {
+		age := s.clock().Sub(s.fetched)
+		if age >= jwksMaxAge || ((s.verifier == nil || unknownKey) && age >= jwksRefreshInterval) {
+			// Failed fetches count too, so an unreachable JWKS is not
+			// requested for every token.
+			s.fetched = s.clock()
+			s.refreshing = make(chan struct{})
+			go s.refresh(s.refreshing)
+		}
+	}
+	verifier, refreshing := s.verifier, s.refreshing
+	s.mu.Unlock()
+
+	if refreshing != nil && (verifier == nil || unknownKey) {
+		select {
+		case <-refreshing:
+			s.mu.Lock()
+			verifier = s.verifier
+			s.mu.Unlock()
+		case <-ctx.Done():
+		}
+	}
+	if verifier == nil {
+		return nil, errKeysUnavailable
+	}
+	// With the JWKS unreachable the last keys keep verifying.
+	return verifier, nil
+}
+
+func (s *jwksSource) refresh(done chan struct{}) {
+	// The fetch outlives the request that started it; client.Timeout
+	// bounds it.
+	if err := s.fetch(context.Background()); err != nil {
+		log.Printf("identity JWKS error: %v", err)
+	}
+	s.mu.Lock()
+	s.refreshing = nil
+	s.mu.Unlock()
+	close(done)
+}
+
+func (s *jwksSource) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: status %d", resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	return s.set(raw)
+}
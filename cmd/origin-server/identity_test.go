@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testAudience = "backend"
+
+var testNow = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testECKey stands in for callout-server's token minting key.
+var testECKey = func() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+var testHMACKey = []byte(strings.Repeat("k", minHMACKeyLength))
+
+// response is the JSON body of origin-server: the echo with the principal,
+// or the middleware error.
+type response struct {
+	Headers   map[string][]string `json:"headers"`
+	Principal *principal          `json:"principal"`
+	Error     string              `json:"error"`
+}
+
+func serve(t *testing.T, verifier *identityVerifier, headers map[string]string) (int, response) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	verifier.middleware(http.HandlerFunc(echoHandler)).ServeHTTP(rec, req)
+	var body response
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+// signES256 signs claims with testECKey under header, whatever alg it
+// names.
+func signES256(header, claims map[string]any) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	rawHeader, _ := json.Marshal(header)
+	rawClaims, _ := json.Marshal(claims)
+	signingInput := b64(rawHeader) + "." + b64(rawClaims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, testECKey, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signingInput + "." + b64(sig)
+}
+
+// mintToken signs claims like callout-server's internal tokens.
+func mintToken(kid string, claims map[string]any) string {
+	values := map[string]any{
+		"iss": "callout-server",
+		"sub": "u1",
+		"aud": testAudience,
+		"iat": testNow.Unix(),
+		"exp": testNow.Add(time.Minute).Unix(),
+		"act": map[string]any{"sub": "edge"},
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(values, k)
+		} else {
+			values[k] = v
+		}
+	}
+	return signES256(map[string]any{"alg": "ES256", "kid": kid, "typ": "JWT"}, values)
+}
+
+// jwksServer serves testECKey under the kid stored in kid.
+func jwksServer(t *testing.T, kid *atomic.Value, fetches *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		x, y := make([]byte, 32), make([]byte, 32)
+		testECKey.X.FillBytes(x)
+		testECKey.Y.FillBytes(y)
+		b64 := base64.RawURLEncoding.EncodeToString
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"keys": []any{map[string]any{"kty": "EC", "kid": kid.Load().(string), "crv": "P-256", "x": b64(x), "y": b64(y)}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestJWTIdentity(t *testing.T) {
+	var kid atomic.Value
+	kid.Store("k1")
+	var fetches atomic.Int32
+	jwks := jwksServer(t, &kid, &fetches)
+	verifier, err := newIdentityVerifier(identityConfig{
+		mode:     identityModeJWT,
+		jwksURL:  jwks.URL,
+		audience: testAudience,
+		issuer:   "callout-server",
+		clock:    func() time.Time { return testNow },
+	})
+	if err != nil {
+		t.Fatalf("newIdentityVerifier: %v", err)
+	}
+
+	token := mintToken("k1", nil)
+	unsigned := token[:strings.LastIndex(token, ".")+1]
+	forged := signES256(map[string]any{"alg": "RS256", "kid": "k1"},
+		map[string]any{"sub": "admin", "aud": testAudience, "exp": testNow.Add(time.Minute).Unix()})
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		wantError   string
+		wantActor   string
+		wantSubject string
+	}{
+		{name: "valid", headers: map[string]string{defaultJWTIdentityHeader: mintToken("k1", nil)}, wantSubject: "u1", wantActor: "edge"},
+		{name: "matching uid", headers: map[string]string{defaultJWTIdentityHeader: mintToken("k1", nil), "x-uid": "u1"}, wantSubject: "u1", wantActor: "edge"},
+		{name: "plain uid", headers: map[string]string{"x-uid": "u1"}, wantError: errMissingIdentity.Error()},
+		{name: "forged uid", headers: map[string]string{defaultJWTIdentityHeader: mintToken("k1", nil), "x-uid": "admin"}, wantError: errSubjectMismatch.Error()},
+		{name: "forged token", headers: map[string]string{defaultJWTIdentityHeader: forged}, wantError: "token algorithm is not supported"},
+		{name: "unsigned token", headers: map[string]string{defaultJWTIdentityHeader: unsigned}, wantError: "token signature is invalid"},
+		{name: "other audience", headers: map[string]string{defaultJWTIdentityHeader: mintToken("k1", map[string]any{"aud": "other"})}, wantError: errIdentityAudience.Error()},
+		{name: "other issuer", headers: map[string]string{defaultJWTIdentityHeader: mintToken("k1", map[string]any{"iss": "client"})}, wantError: errIdentityIssuer.Error()},
+		{name: "no expiration", headers: map[string]string{defaultJWTIdentityHeader: mintToken("k1", map[string]any{"exp": nil})}, wantError: "token expiration is missing"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, body := serve(t, verifier, tc.headers)
+			if tc.wantError != "" {
+				if code != http.StatusUnauthorized || body.Error != tc.wantError {
+					t.Fatalf("response = %d %+v, want 401 %q", code, body, tc.wantError)
+				}
+				return
+			}
+			if code != http.StatusOK || body.Principal == nil {
+				t.Fatalf("response = %d %+v, want 200 with a principal", code, body)
+			}
+			if p := body.Principal; p.Mode != identityModeJWT || p.Subject != tc.wantSubject || p.Actor != tc.wantActor || p.Issuer != "callout-server" {
+				t.Errorf("principal = %+v", p)
+			}
+		})
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetches = %d, want 1", n)
+	}
+}
+
+func TestJWTIdentityKeyRotation(t *testing.T) {
+	var kid atomic.Value
+	kid.Store("k1")
+	var fetches atomic.Int32
+	jwks := jwksServer(t, &kid, &fetches)
+	now := testNow
+	verifier, err := newIdentityVerifier(identityConfig{
+		mode:     identityModeJWT,
+		jwksURL:  jwks.URL,
+		audience: testAudience,
+		clock:    func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("newIdentityVerifier: %v", err)
+	}
+	if code, body := serve(t, verifier, map[string]string{defaultJWTIdentityHeader: mintToken("k1", nil)}); code != http.StatusOK {
+		t.Fatalf("k1 response = %d %+v", code, body)
+	}
+
+	kid.Store("k2")
+	rotated := map[string]string{defaultJWTIdentityHeader: mintToken("k2", nil)}
+	if code, _ := serve(t, verifier, rotated); code != http.StatusUnauthorized || fetches.Load() != 1 {
+		t.Fatalf("k2 right after a fetch = %d with %d fetches, want 401 without a refetch", code, fetches.Load())
+	}
+	now = now.Add(jwksRefreshInterval)
+	if code, body := serve(t, verifier, rotated); code != http.StatusOK || fetches.Load() != 2 {
+		t.Fatalf("k2 after the refresh interval = %d %+v with %d fetches, want 200 after a refetch", code, body, fetches.Load())
+	}
+
+	jwks.Close()
+	now = now.Add(jwksMaxAge)
+	longLived := mintToken("k2", map[string]any{"exp": now.Add(time.Minute).Unix()})
+	if code, body := serve(t, verifier, map[string]string{defaultJWTIdentityHeader: longLived}); code != http.StatusOK {
+		t.Errorf("k2 with the JWKS unreachable = %d %+v, want the last keys to be used", code, body)
+	}
+}
+
+func TestJWTIdentityJWKSUnavailable(t *testing.T) {
+	var fetches atomic.Int32
+	unblock := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-unblock
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(jwks.Close)
+	var release sync.Once
+	t.Cleanup(func() { release.Do(func() { close(unblock) }) })
+	now := testNow
+	verifier, err := newIdentityVerifier(identityConfig{
+		mode:     identityModeJWT,
+		jwksURL:  jwks.URL,
+		audience: testAudience,
+		clock:    func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("newIdentityVerifier: %v", err)
+	}
+	token := mintToken("k1", nil)
+
+	// Callers waiting on the slow fetch give up with their own context and
+	// do not start another one.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for range 3 {
+		if _, err := verifier.keys.verify(ctx, token); !errors.Is(err, errKeysUnavailable) {
+			t.Fatalf("verify during the fetch = %v, want %v", err, errKeysUnavailable)
+		}
+	}
+	release.Do(func() { close(unblock) })
+
+	headers := map[string]string{defaultJWTIdentityHeader: token}
+	for range 3 {
+		if code, body := serve(t, verifier, headers); code != http.StatusUnauthorized || body.Error != errKeysUnavailable.Error() {
+			t.Fatalf("response after a failed fetch = %d %+v, want 401 %q", code, body, errKeysUnavailable)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetches within the refresh interval = %d, want 1", n)
+	}
+	now = now.Add(jwksRefreshInterval)
+	serve(t, verifier, headers)
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("JWKS fetches after the refresh interval = %d, want 2", n)
+	}
+}
+
+func signEnvelope(key []byte, e envelope) string {
+	raw, _ := json.Marshal(e)
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestHMACIdentity(t *testing.T) {
+	verifier, err := newIdentityVerifier(identityConfig{
+		mode:    identityModeHMAC,
+		hmacKey: testHMACKey,
+		clock:   func() time.Time { return testNow },
+	})
+	if err != nil {
+		t.Fatalf("newIdentityVerifier: %v", err)
+	}
+	exp := testNow.Add(time.Minute).Unix()
+	valid := signEnvelope(testHMACKey, envelope{Sub: "u1", Exp: exp})
+	payload, sig, _ := strings.Cut(valid, ".")
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":9999999999}`)) + "." + sig
+
+	for name, tc := range map[string]struct {
+		value     string
+		wantError string
+	}{
+		"valid":         {value: valid},
+		"tampered":      {value: tampered, wantError: errForgedIdentity.Error()},
+		"other key":     {value: signEnvelope([]byte(strings.Repeat("x", minHMACKeyLength)), envelope{Sub: "u1", Exp: exp}), wantError: errForgedIdentity.Error()},
+		"unsigned":      {value: payload, wantError: errInvalidEnvelope.Error()},
+		"expired":       {value: signEnvelope(testHMACKey, envelope{Sub: "u1", Exp: testNow.Unix()}), wantError: errIdentityExpired.Error()},
+		"no subject":    {value: signEnvelope(testHMACKey, envelope{Exp: exp}), wantError: errInvalidEnvelope.Error()},
+		"no expiration": {value: signEnvelope(testHMACKey, envelope{Sub: "u1"}), wantError: errInvalidEnvelope.Error()},
+	} {
+		code, body := serve(t, verifier, map[string]string{defaultHMACIdentityHeader: tc.value})
+		if tc.wantError != "" {
+			if code != http.StatusUnauthorized || body.Error != tc.wantError {
+				t.Errorf("%s: response = %d %+v, want 401 %q", name, code, body, tc.wantError)
+			}
+			continue
+		}
+		if code != http.StatusOK || body.Principal == nil || body.Principal.Subject != "u1" || body.Principal.ExpiresAt != exp {
+			t.Errorf("%s: response = %d %+v, want 200 for u1", name, code, body)
+		}
+	}
+}
+
+func TestIdentityConfigErrors(t *testing.T) {
+	for name, cfg := range map[string]identityConfig{
+		"unknown mode":     {mode: "mtls"},
+		"jwt no audience":  {mode: identityModeJWT, jwksURL: "http://localhost/jwks.json"},
+		"jwt no keys":      {mode: identityModeJWT, audience: testAudience},
+		"jwt both sources": {mode: identityModeJWT, audience: testAudience, jwksURL: "http://localhost/jwks.json", jwksFile: "jwks.json"},
+		"jwt missing file": {mode: identityModeJWT, audience: testAudience, jwksFile: "does-not-exist.json"},
+		"hmac short key":   {mode: identityModeHMAC, hmacKey: []byte("short")},
+	} {
+		if _, err := newIdentityVerifier(cfg); err == nil {
+			t.Errorf("%s: newIdentityVerifier succeeded, want error", name)
+		}
+	}
+}
@@ -13,16 +13,19 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
-	mux := http.NewServeMux()
-	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		payload := map[string]map[string][]string{
-			"headers": r.Header,
-		}
-		if err := json.NewEncoder(w).Encode(payload); err != nil {
-			http.Error(w, "encode error", http.StatusInternalServerError)
+	var echo http.Handler = http.HandlerFunc(echoHandler)
+	// IDENTITY_MODE=jwt|hmac only lets requests with a verified identity
+	// through; origin-server echoes every request otherwise.
+	if cfg := identityConfigFromEnv(os.Getenv); cfg.mode != "" {
+		verifier, err := newIdentityVerifier(cfg)
+		if err != nil {
+			log.Fatalf("identity config error: %v", err)
 		}
-	}))
+		echo = verifier.middleware(echo)
+		log.Printf("origin-server verifies %s identities in %s", cfg.mode, verifier.header)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", echo)
 
 	server := &http.Server{
 		Addr:              ":" + port,
@@ -35,3 +38,18 @@ func main() {
 		log.Fatalf("server error: %v", err)
 	}
 }
+
+// echoHandler returns the request headers and, behind the identity
+// middleware, the verified principal.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	payload := map[string]any{
+		"headers": r.Header,
+	}
+	if p := principalFromContext(r.Context()); p != nil {
+		payload["principal"] = p
+	}
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		http.Error(w, "encode error", http.StatusInternalServerError)
+	}
+}
@@ -64,7 +64,7 @@ EXT_FILE="$(mktemp)"
 trap 'rm -f "$CONFIG_FILE" "$EXT_FILE"' EXIT
 
 cat > "$CONFIG_FILE" <<EOF_CONFIG
-{"public_key_pem":"${PUBLIC_KEY_PEM}"}
+{"schema_version":1,"public_key_pem":"${PUBLIC_KEY_PEM}"}
 EOF_CONFIG
 
 cd "$ROOT_DIR"
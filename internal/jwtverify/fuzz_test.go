@@ -0,0 +1,123 @@
+package jwtverify_test
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+var verifyErrors = []error{
+	jwtverify.ErrMalformed,
+	jwtverify.ErrInvalidHeader,
+	jwtverify.ErrUnsupportedAlgorithm,
+	jwtverify.ErrUnknownKey,
+	jwtverify.ErrInvalidSignature,
+	jwtverify.ErrInvalidPayload,
+	jwtverify.ErrExpired,
+	jwtverify.ErrNotYetValid,
+	jwtverify.ErrIssuedInFuture,
+	jwtverify.ErrMissingExpiration,
+	jwtverify.ErrMissingSubject,
+}
+
+// checkVerifyResult asserts the Verify contract: exactly one of the
+// exported errors, or claims with a subject that are valid at Now.
+func checkVerifyResult(t *testing.T, claims *jwtverify.Claims, err error) {
+	t.Helper()
+	if err != nil {
+		for _, want := range verifyErrors {
+			if err == want {
+				return
+			}
+		}
+		t.Fatalf("Verify() error = %#v, want one of the exported errors", err)
+	}
+	if claims == nil || claims.Subject == "" {
+		t.Fatalf("Verify() accepted claims %+v without a subject", claims)
+	}
+	if claims.ExpiresAt != nil && !claims.ExpiresAt.After(jwtverifytest.Now) {
+		t.Fatalf("Verify() accepted exp %v at %v", claims.ExpiresAt, jwtverifytest.Now)
+	}
+}
+
+func FuzzVerify(f *testing.F) {
+	key := jwtverifytest.PrivateKey()
+	f.Add(jwtverifytest.SignRS256(key, map[string]any{"alg": "RS256"}, map[string]any{"sub": "fuzz"}))
+	f.Add(jwtverifytest.SignRS256(key, map[string]any{"alg": "RS256", "kid": "other"}, map[string]any{"sub": "fuzz", "exp": 1767225660}))
+	f.Add("..")
+	f.Add("a.b.c.d")
+	f.Add("e30.e30.")
+	verifier := newConformanceVerifier(f, 0)
+	f.Fuzz(func(t *testing.T, token string) {
+		claims, err := verifier.Verify(token)
+		checkVerifyResult(t, claims, err)
+	})
+}
+
+// signRawRS256 signs header and payload bytes as given, which need not be
+// valid JSON, so the fuzzer reaches the decoding behind the signature check.
+func signRawRS256(t *testing.T, key *rsa.PrivateKey, header, payload []byte) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signingInput + "." + b64(sig)
+}
+
+func FuzzVerifySignedPayload(f *testing.F) {
+	f.Add([]byte(`{"alg":"RS256","typ":"JWT"}`), []byte(`{"sub":"fuzz"}`))
+	f.Add([]byte(`{"alg":"RS256","kid":"other"}`), []byte(`{"sub":"fuzz","aud":["a","b"],"exp":1767225660}`))
+	f.Add([]byte(`{"alg":"RS256"}`), []byte(`{"sub":42}`))
+	f.Add([]byte(`{"alg":"RS256"}`), []byte(`{"sub":"fuzz","exp":"tomorrow"}`))
+	f.Add([]byte(`{"alg":"RS256"}`), []byte(`{"sub":"fuzz","nbf":1e400}`))
+	f.Add([]byte(`{"alg":"RS256"}`), []byte(`null`))
+	f.Add([]byte(`{"alg":"none"}`), []byte(`{"sub":"fuzz"}`))
+	key := jwtverifytest.PrivateKey()
+	verifier := newConformanceVerifier(f, 0)
+	f.Fuzz(func(t *testing.T, header, payload []byte) {
+		claims, err := verifier.Verify(signRawRS256(t, key, header, payload))
+		checkVerifyResult(t, claims, err)
+		if err != nil {
+			return
+		}
+		var values map[string]any
+		if json.Unmarshal(payload, &values) != nil {
+			t.Fatalf("Verify() accepted payload %q that is not a JSON object", payload)
+		}
+		if values["sub"] != claims.Subject {
+			t.Errorf("subject = %q, want %v", claims.Subject, values["sub"])
+		}
+	})
+}
+
+func FuzzParseJWKS(f *testing.F) {
+	for _, jwk := range []map[string]any{
+		publicJWK(&jwtverifytest.PrivateKey().PublicKey, "rsa"),
+		publicJWK(&newECKey(f).PublicKey, "ec"),
+		publicJWK(newEd25519Key(f).Public(), "ed"),
+	} {
+		raw, _ := json.Marshal(map[string]any{"keys": []any{jwk}})
+		f.Add(raw)
+	}
+	f.Add([]byte(`{"keys":[]}`))
+	f.Add([]byte(`{"keys":[{"kty":"RSA","n":"AQAB","e":"AQAB"}]}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		keys, err := jwtverify.ParseJWKS(data)
+		if err != nil {
+			return
+		}
+		// Every parsed key must be usable by a verifier.
+		if _, err := jwtverify.NewVerifier(keys, jwtverify.Options{}); err != nil {
+			t.Fatalf("NewVerifier(ParseJWKS()) error = %v", err)
+		}
+	})
+}
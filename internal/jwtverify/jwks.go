@@ -0,0 +1,128 @@
+package jwtverify
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JWKS is a JSON Web Key Set document.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is the subset of a JSON Web Key needed for signature verification.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// ParseJWKS parses a JWKS document into verification keys. Every key is
+// bound to one algorithm: its "alg" member, or the default for its type
+// (RS256 for RSA, ES256 for P-256, EdDSA for Ed25519). Keys with "use" other than "sig" and
+// duplicate kids are rejected.
+func ParseJWKS(data []byte) ([]Key, error) {
+	var set JWKS
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse JWKS: %w", err)
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("JWKS has no keys")
+	}
+	keys := make([]Key, 0, len(set.Keys))
+	seen := make(map[string]bool, len(set.Keys))
+	for i, jwk := range set.Keys {
+		key, err := jwk.Key()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (kid %q): %w", i, jwk.Kid, err)
+		}
+		if key.ID != "" {
+			if seen[key.ID] {
+				return nil, fmt.Errorf("key %d: duplicate kid %q", i, key.ID)
+			}
+			seen[key.ID] = true
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Key converts the JWK into a verification key.
+func (j JWK) Key() (Key, error) {
+	if j.Use != "" && j.Use != "sig" {
+		return Key{}, fmt.Errorf("unsupported use %q", j.Use)
+	}
+	key := Key{ID: j.Kid, Algorithm: j.Alg}
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return Key{}, errors.New("invalid RSA modulus")
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return Key{}, errors.New("invalid RSA exponent")
+		}
+		key.PublicKey = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		if key.Algorithm == "" {
+			key.Algorithm = AlgRS256
+		}
+	case "EC":
+		if j.Crv != "P-256" {
+			return Key{}, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, errX := decodeBigInt(j.X)
+		y, errY := decodeBigInt(j.Y)
+		if errX != nil || errY != nil || !elliptic.P256().IsOnCurve(x, y) {
+			return Key{}, errors.New("invalid EC point")
+		}
+		key.PublicKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if key.Algorithm == "" {
+			key.Algorithm = AlgES256
+		}
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return Key{}, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return Key{}, errors.New("invalid Ed25519 public key")
+		}
+		key.PublicKey = ed25519.PublicKey(x)
+		if key.Algorithm == "" {
+			key.Algorithm = AlgEdDSA
+		}
+	default:
+		return Key{}, fmt.Errorf("unsupported kty %q", j.Kty)
+	}
+	if err := checkKey(key); err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("empty value")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
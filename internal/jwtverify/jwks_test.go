@@ -0,0 +1,123 @@
+package jwtverify_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func newECKey(t testing.TB) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+func newEd25519Key(t testing.TB) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+// publicJWK returns the JWK of an RSA, P-256 or Ed25519 public key.
+func publicJWK(pub crypto.PublicKey, kid string) map[string]any {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]any{"kty": "RSA", "kid": kid, "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		return map[string]any{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(x), "y": b64(y)}
+	case ed25519.PublicKey:
+		return map[string]any{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64(k)}
+	}
+	panic("unsupported key type")
+}
+
+func marshalJWKS(t *testing.T, keys ...map[string]any) []byte {
+	t.Helper()
+	raw, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return raw
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaJWK := publicJWK(&jwtverifytest.PrivateKey().PublicKey, "rsa")
+	ecJWK := publicJWK(&newECKey(t).PublicKey, "ec")
+	edJWK := publicJWK(newEd25519Key(t).Public(), "ed")
+
+	keys, err := jwtverify.ParseJWKS(marshalJWKS(t, rsaJWK, ecJWK, edJWK))
+	if err != nil {
+		t.Fatalf("ParseJWKS() error = %v", err)
+	}
+	want := map[string]string{"rsa": jwtverify.AlgRS256, "ec": jwtverify.AlgES256, "ed": jwtverify.AlgEdDSA}
+	if len(keys) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(keys), len(want))
+	}
+	for _, key := range keys {
+		if key.Algorithm != want[key.ID] {
+			t.Errorf("key %q algorithm = %q, want %q", key.ID, key.Algorithm, want[key.ID])
+		}
+	}
+}
+
+func TestParseJWKSRejects(t *testing.T) {
+	with := func(base map[string]any, overrides map[string]any) map[string]any {
+		out := make(map[string]any, len(base))
+		for k, v := range base {
+			out[k] = v
+		}
+		for k, v := range overrides {
+			out[k] = v
+		}
+		return out
+	}
+	rsaJWK := publicJWK(&jwtverifytest.PrivateKey().PublicKey, "rsa")
+	ecJWK := publicJWK(&newECKey(t).PublicKey, "ec")
+	edJWK := publicJWK(newEd25519Key(t).Public(), "ed")
+
+	tests := []struct {
+		name    string
+		keys    []map[string]any
+		wantErr string
+	}{
+		{name: "empty", wantErr: "JWKS has no keys"},
+		{name: "encryption key", keys: []map[string]any{with(rsaJWK, map[string]any{"use": "enc"})}, wantErr: `unsupported use "enc"`},
+		{name: "symmetric key", keys: []map[string]any{{"kty": "oct", "k": "c2VjcmV0"}}, wantErr: `unsupported kty "oct"`},
+		{name: "duplicate kid", keys: []map[string]any{rsaJWK, with(ecJWK, map[string]any{"kid": "rsa"})}, wantErr: `duplicate kid "rsa"`},
+		{name: "P-384", keys: []map[string]any{with(ecJWK, map[string]any{"crv": "P-384"})}, wantErr: `unsupported curve "P-384"`},
+		{name: "point off curve", keys: []map[string]any{with(ecJWK, map[string]any{"y": ecJWK["x"]})}, wantErr: "invalid EC point"},
+		{name: "X448", keys: []map[string]any{with(edJWK, map[string]any{"crv": "X448"})}, wantErr: `unsupported curve "X448"`},
+		{name: "short Ed25519 key", keys: []map[string]any{with(edJWK, map[string]any{"x": "AAAA"})}, wantErr: "invalid Ed25519 public key"},
+		{name: "alg not matching key type", keys: []map[string]any{with(ecJWK, map[string]any{"alg": "RS256"})}, wantErr: "RS256 key must be an RSA public key"},
+		{name: "missing modulus", keys: []map[string]any{with(rsaJWK, map[string]any{"n": ""})}, wantErr: "invalid RSA modulus"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := jwtverify.ParseJWKS(marshalJWKS(t, tc.keys...))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("ParseJWKS() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
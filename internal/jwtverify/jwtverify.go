@@ -0,0 +1,335 @@
+// Package jwtverify verifies compact JWS tokens for both callout-server and
+// the proxy-wasm plugin, so every extension type accepts the same tokens.
+//
+// It only depends on the standard library and avoids features that TinyGo
+// does not support, so it can be compiled into the Wasm plugin.
+package jwtverify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Algorithms supported by Verifier.
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Verification errors. Verify returns exactly one of these, so callers can
+// use the message as the denial reason and compare with errors.Is.
+var (
+	ErrMalformed            = errors.New("token format is invalid")
+	ErrInvalidHeader        = errors.New("token header is invalid")
+	ErrUnsupportedAlgorithm = errors.New("token algorithm is not supported")
+	ErrUnknownKey           = errors.New("token key is unknown")
+	ErrInvalidSignature     = errors.New("token signature is invalid")
+	ErrInvalidPayload       = errors.New("token payload is invalid")
+	ErrExpired              = errors.New("token is expired")
+	ErrNotYetValid          = errors.New("token is not valid yet")
+	ErrIssuedInFuture       = errors.New("token is issued in the future")
+	ErrMissingExpiration    = errors.New("token expiration is missing")
+	ErrMissingSubject       = errors.New("subject is missing")
+)
+
+// Header is the JOSE header of a token.
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Claims is the claims model shared by all extension types. Registered time
+// claims are Unix seconds; Raw holds every claim with numbers as json.Number.
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt *time.Time
+	NotBefore *time.Time
+	IssuedAt  *time.Time
+	Raw       map[string]any
+}
+
+// Key is a verification key bound to a single algorithm. ID is matched
+// against the token "kid" header when both are set.
+type Key struct {
+	ID        string
+	Algorithm string
+	PublicKey crypto.PublicKey
+}
+
+// Options tune claim validation.
+type Options struct {
+	// Leeway is the clock skew tolerated for exp, nbf and iat.
+	Leeway time.Duration
+	// RequireExpiration rejects tokens without an exp claim.
+	RequireExpiration bool
+	// Now returns the current time; time.Now is used when nil.
+	Now func() time.Time
+}
+
+// Verifier checks signatures and validates claims.
+type Verifier struct {
+	keys              []Key
+	leeway            time.Duration
+	requireExpiration bool
+	now               func() time.Time
+}
+
+// NewVerifier returns a Verifier for the given keys.
+func NewVerifier(keys []Key, opts Options) (*Verifier, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one key is required")
+	}
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+	}
+	now := opts.Now
+	if now == nil {
+		now = time.Now
+	}
+	if opts.Leeway < 0 {
+		return nil, errors.New("leeway must not be negative")
+	}
+	return &Verifier{keys: keys, leeway: opts.Leeway, requireExpiration: opts.RequireExpiration, now: now}, nil
+}
+
+func checkKey(key Key) error {
+	switch key.Algorithm {
+	case AlgRS256:
+		if _, ok := key.PublicKey.(*rsa.PublicKey); !ok {
+			return errors.New("RS256 key must be an RSA public key")
+		}
+		return nil
+	case AlgES256:
+		if pub, ok := key.PublicKey.(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P256() {
+			return errors.New("ES256 key must be a P-256 public key")
+		}
+		return nil
+	case AlgEdDSA:
+		if pub, ok := key.PublicKey.(ed25519.PublicKey); !ok || len(pub) != ed25519.PublicKeySize {
+			return errors.New("EdDSA key must be an Ed25519 public key")
+		}
+		return nil
+	default:
+		return errors.New("unsupported key algorithm: " + key.Algorithm)
+	}
+}
+
+// Verify parses token, verifies its signature with a matching key and
+// validates the claims. The signature is checked before any claim is trusted.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var header Header
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	candidates, err := v.keysFor(header)
+	if err != nil {
+		return nil, err
+	}
+	signingInput := []byte(token[:len(parts[0])+1+len(parts[1])])
+	if !verifyAny(candidates, signingInput, signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	claims, err := parseClaims(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// keysFor returns the keys that may have signed a token with this header.
+// A kid selects a single key; without one every key bound to alg is tried.
+func (v *Verifier) keysFor(header Header) ([]Key, error) {
+	if header.Alg == "" {
+		return nil, ErrInvalidHeader
+	}
+	var candidates []Key
+	algKnown := false
+	for _, key := range v.keys {
+		if key.Algorithm != header.Alg {
+			continue
+		}
+		algKnown = true
+		if header.Kid != "" && key.ID != "" && key.ID != header.Kid {
+			continue
+		}
+		candidates = append(candidates, key)
+	}
+	if !algKnown {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	if len(candidates) == 0 {
+		return nil, ErrUnknownKey
+	}
+	return candidates, nil
+}
+
+func verifyAny(keys []Key, signingInput, signature []byte) bool {
+	for _, key := range keys {
+		if verifySignature(key, signingInput, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifySignature(key Key, signingInput, signature []byte) bool {
+	switch key.Algorithm {
+	case AlgRS256:
+		digest := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(key.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	case AlgES256:
+		// JWS encodes ECDSA signatures as fixed-size R||S, not ASN.1.
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signingInput)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key.PublicKey.(*ecdsa.PublicKey), digest[:], r, s)
+	case AlgEdDSA:
+		return ed25519.Verify(key.PublicKey.(ed25519.PublicKey), signingInput, signature)
+	default:
+		return false
+	}
+}
+
+func decodeSegment(segment string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func parseClaims(segment string) (*Claims, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return nil, ErrInvalidPayload
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var values map[string]any
+	if err := decoder.Decode(&values); err != nil || values == nil {
+		return nil, ErrInvalidPayload
+	}
+
+	claims := &Claims{Raw: values}
+	var ok bool
+	if claims.Subject, ok = optionalString(values, "sub"); !ok {
+		return nil, ErrInvalidPayload
+	}
+	if claims.Issuer, ok = optionalString(values, "iss"); !ok {
+		return nil, ErrInvalidPayload
+	}
+	if claims.Audience, ok = audience(values["aud"]); !ok {
+		return nil, ErrInvalidPayload
+	}
+	for name, dst := range map[string]**time.Time{"exp": &claims.ExpiresAt, "nbf": &claims.NotBefore, "iat": &claims.IssuedAt} {
+		if *dst, ok = numericDate(values[name]); !ok {
+			return nil, ErrInvalidPayload
+		}
+	}
+	return claims, nil
+}
+
+func optionalString(values map[string]any, name string) (string, bool) {
+	value, present := values[name]
+	if !present {
+		return "", true
+	}
+	s, ok := value.(string)
+	return s, ok
+}
+
+// audience accepts both the single string and the array form of "aud".
+func audience(value any) ([]string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return []string{v}, true
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			out = append(out, s)
+		}
+		return out, true
+	default:
+		return nil, false
+	}
+}
+
+// numericDate parses a NumericDate (seconds since the epoch, possibly
+// fractional). Fractions are truncated, as validation works in seconds.
+func numericDate(value any) (*time.Time, bool) {
+	if value == nil {
+		return nil, true
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return nil, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return nil, false
+	}
+	t := time.Unix(int64(seconds), 0)
+	return &t, true
+}
+
+// validate applies the time rules with second precision: a token is expired
+// once now reaches exp+leeway, and is rejected while now is before
+// nbf-leeway or iat-leeway.
+func (v *Verifier) validate(claims *Claims) error {
+	now := v.now().Truncate(time.Second)
+	if claims.ExpiresAt == nil && v.requireExpiration {
+		return ErrMissingExpiration
+	}
+	if claims.ExpiresAt != nil && !now.Before(claims.ExpiresAt.Add(v.leeway)) {
+		return ErrExpired
+	}
+	if claims.NotBefore != nil && now.Before(claims.NotBefore.Add(-v.leeway)) {
+		return ErrNotYetValid
+	}
+	if claims.IssuedAt != nil && now.Before(claims.IssuedAt.Add(-v.leeway)) {
+		return ErrIssuedInFuture
+	}
+	if claims.Subject == "" {
+		return ErrMissingSubject
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package jwtverify_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func newConformanceVerifier(t testing.TB, leeway time.Duration) *jwtverify.Verifier {
+	t.Helper()
+	block, _ := pem.Decode([]byte(jwtverifytest.PublicKeyPEM()))
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse public key: %v", err)
+	}
+	verifier, err := jwtverify.NewVerifier(
+		[]jwtverify.Key{{Algorithm: jwtverify.AlgRS256, PublicKey: pub}},
+		jwtverify.Options{Leeway: leeway, Now: func() time.Time { return jwtverifytest.Now }},
+	)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	return verifier
+}
+
+func TestVerifyConformance(t *testing.T) {
+	verifier := newConformanceVerifier(t, 0)
+	for _, tc := range jwtverifytest.Cases() {
+		token, ok := strings.CutPrefix(tc.Authorization, "Bearer ")
+		if !ok {
+			// Header-level cases are covered by the extensions themselves.
+			continue
+		}
+		t.Run(tc.Name, func(t *testing.T) {
+			claims, err := verifier.Verify(token)
+			if tc.WantReason != "" {
+				if err == nil || err.Error() != tc.WantReason {
+					t.Fatalf("Verify() error = %v, want %q", err, tc.WantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if claims.Subject != tc.WantSubject {
+				t.Errorf("subject = %q, want %q", claims.Subject, tc.WantSubject)
+			}
+		})
+	}
+}
+
+func TestVerifyLeeway(t *testing.T) {
+	key := jwtverifytest.PrivateKey()
+	header := map[string]any{"alg": "RS256"}
+	expired := jwtverifytest.SignRS256(key, header, map[string]any{
+		"sub": jwtverifytest.Subject,
+		"exp": jwtverifytest.Now.Add(-10 * time.Second).Unix(),
+	})
+
+	if _, err := newConformanceVerifier(t, 0).Verify(expired); !errors.Is(err, jwtverify.ErrExpired) {
+		t.Fatalf("without leeway: error = %v, want %v", err, jwtverify.ErrExpired)
+	}
+	if _, err := newConformanceVerifier(t, 30*time.Second).Verify(expired); err != nil {
+		t.Fatalf("with leeway: error = %v", err)
+	}
+}
+
+func TestNewVerifierRejectsMismatchedKey(t *testing.T) {
+	ecKey := newECKey(t)
+	tests := map[string][]jwtverify.Key{
+		"no keys":           nil,
+		"ec key for RS256":  {{Algorithm: jwtverify.AlgRS256, PublicKey: &ecKey.PublicKey}},
+		"rsa key for ES256": {{Algorithm: jwtverify.AlgES256, PublicKey: &jwtverifytest.PrivateKey().PublicKey}},
+		"ec key for EdDSA":  {{Algorithm: jwtverify.AlgEdDSA, PublicKey: &ecKey.PublicKey}},
+		"short Ed25519 key": {{Algorithm: jwtverify.AlgEdDSA, PublicKey: ed25519.PublicKey(make([]byte, 16))}},
+		"unknown alg":       {{Algorithm: "PS512", PublicKey: &jwtverifytest.PrivateKey().PublicKey}},
+	}
+	for name, keys := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := jwtverify.NewVerifier(keys, jwtverify.Options{}); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// signES256 signs claims with the fixed-size R||S signature JWS requires.
+func signES256(t *testing.T, key *ecdsa.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	signingInput := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func signEdDSA(t *testing.T, key ed25519.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	signingInput := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(signingInput)))
+}
+
+// resign replaces the signature of token.
+func resign(token string, sig []byte) string {
+	return token[:strings.LastIndex(token, ".")+1] + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyAlgorithms(t *testing.T) {
+	rsaKey := jwtverifytest.PrivateKey()
+	ecKey := newECKey(t)
+	edKey := newEd25519Key(t)
+	otherEC := newECKey(t)
+	verifier, err := jwtverify.NewVerifier([]jwtverify.Key{
+		{ID: "rsa", Algorithm: jwtverify.AlgRS256, PublicKey: &rsaKey.PublicKey},
+		{ID: "ec", Algorithm: jwtverify.AlgES256, PublicKey: &ecKey.PublicKey},
+		{ID: "ed", Algorithm: jwtverify.AlgEdDSA, PublicKey: edKey.Public()},
+	}, jwtverify.Options{Now: func() time.Time { return jwtverifytest.Now }})
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+
+	claims := map[string]any{"sub": jwtverifytest.Subject}
+	es256 := signES256(t, ecKey, map[string]any{"alg": "ES256", "kid": "ec"}, claims)
+	eddsa := signEdDSA(t, edKey, map[string]any{"alg": "EdDSA", "kid": "ed"}, claims)
+
+	signingInput := es256[:strings.LastIndex(es256, ".")]
+	digest := sha256.Sum256([]byte(signingInput))
+	der, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	rawSig, _ := base64.RawURLEncoding.DecodeString(es256[strings.LastIndex(es256, ".")+1:])
+	swapped := append(append([]byte{}, rawSig[32:]...), rawSig[:32]...)
+	tamperedEd, _ := base64.RawURLEncoding.DecodeString(eddsa[strings.LastIndex(eddsa, ".")+1:])
+	tamperedEd[0] ^= 0xff
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "RS256", token: jwtverifytest.SignRS256(rsaKey, map[string]any{"alg": "RS256", "kid": "rsa"}, claims)},
+		{name: "ES256", token: es256},
+		{name: "ES256 without kid", token: signES256(t, ecKey, map[string]any{"alg": "ES256"}, claims)},
+		{name: "EdDSA", token: eddsa},
+		{name: "ES256 ASN.1 signature", token: resign(es256, der), wantErr: jwtverify.ErrInvalidSignature},
+		{name: "ES256 short signature", token: resign(es256, rawSig[:63]), wantErr: jwtverify.ErrInvalidSignature},
+		{name: "ES256 swapped R and S", token: resign(es256, swapped), wantErr: jwtverify.ErrInvalidSignature},
+		{name: "ES256 zero signature", token: resign(es256, make([]byte, 64)), wantErr: jwtverify.ErrInvalidSignature},
+		{name: "ES256 other key", token: signES256(t, otherEC, map[string]any{"alg": "ES256", "kid": "ec"}, claims), wantErr: jwtverify.ErrInvalidSignature},
+		{name: "EdDSA tampered", token: resign(eddsa, tamperedEd), wantErr: jwtverify.ErrInvalidSignature},
+		{name: "ES256 with RSA kid", token: signES256(t, ecKey, map[string]any{"alg": "ES256", "kid": "rsa"}, claims), wantErr: jwtverify.ErrUnknownKey},
+		{name: "RS256 with EC kid", token: jwtverifytest.SignRS256(rsaKey, map[string]any{"alg": "RS256", "kid": "ec"}, claims), wantErr: jwtverify.ErrUnknownKey},
+		{name: "EdDSA signature labelled ES256", token: resign(signES256(t, ecKey, map[string]any{"alg": "ES256", "kid": "ec"}, claims), tamperedEd), wantErr: jwtverify.ErrInvalidSignature},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := verifier.Verify(tc.token)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("Verify() error = %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if got.Subject != jwtverifytest.Subject {
+				t.Errorf("subject = %q, want %q", got.Subject, jwtverifytest.Subject)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+func signEdDSA(t *testing.T, key ed25519.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	input := signingInput(t, header, claims)
+	return input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(input)))
+}
+
+// pkixPublicKeyPEM encodes pub the way public_key_pem is configured.
+func pkixPublicKeyPEM(t *testing.T, pub crypto.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestOnHttpRequestHeadersAlgorithms(t *testing.T) {
+	rsaKey := jwtverifytest.PrivateKey()
+	ecKey := newECKey(t)
+	edKey := newEd25519Key(t)
+	claims := map[string]any{"sub": jwtverifytest.Subject}
+
+	es256 := signES256(t, ecKey, map[string]any{"alg": "ES256", "kid": "ec"}, claims)
+	signingInput := es256[:strings.LastIndex(es256, ".")]
+	digest := sha256.Sum256([]byte(signingInput))
+	der, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	es256DER := signingInput + "." + base64.RawURLEncoding.EncodeToString(der)
+
+	configs := map[string]rawConfig{
+		"pem keys": {
+			SchemaVersion: configSchemaVersion,
+			Keys: []rawKey{
+				{Kid: "rsa", PublicKeyPEM: pkixPublicKeyPEM(t, &rsaKey.PublicKey)},
+				{Kid: "ec", Alg: "ES256", PublicKeyPEM: pkixPublicKeyPEM(t, &ecKey.PublicKey)},
+				{Kid: "ed", Alg: "EdDSA", PublicKeyPEM: pkixPublicKeyPEM(t, edKey.Public())},
+			},
+		},
+		"jwks": jwksConfig(t,
+			publicJWK(&rsaKey.PublicKey, "rsa"),
+			publicJWK(&ecKey.PublicKey, "ec"),
+			publicJWK(edKey.Public(), "ed"),
+		),
+	}
+	tests := []struct {
+		name       string
+		token      string
+		wantReason string
+	}{
+		{name: "RS256", token: jwtverifytest.SignRS256(rsaKey, map[string]any{"alg": "RS256", "kid": "rsa"}, claims)},
+		{name: "ES256", token: es256},
+		{name: "EdDSA", token: signEdDSA(t, edKey, map[string]any{"alg": "EdDSA", "kid": "ed"}, claims)},
+		{name: "ES256 ASN.1 signature", token: es256DER, wantReason: "token signature is invalid"},
+		{name: "ES256 with RSA kid", token: signES256(t, ecKey, map[string]any{"alg": "ES256", "kid": "rsa"}, claims), wantReason: "token key is unknown"},
+		{name: "EdDSA with EC kid", token: signEdDSA(t, edKey, map[string]any{"alg": "EdDSA", "kid": "ec"}, claims), wantReason: "token key is unknown"},
+		{name: "ES384", token: signES256(t, ecKey, map[string]any{"alg": "ES384", "kid": "ec"}, claims), wantReason: "token algorithm is not supported"},
+	}
+	for name, cfg := range configs {
+		for _, tc := range tests {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				host := startPlugin(t, cfg)
+				action, resp, headers := sendRequest(host, bearerHeaders(tc.token))
+				if tc.wantReason != "" {
+					assertDenied(t, action, resp, 403, "denied: "+tc.wantReason)
+					return
+				}
+				assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+			})
+		}
+	}
+}
+
+func TestPublicKeyPEMAlgorithm(t *testing.T) {
+	claims := map[string]any{"sub": jwtverifytest.Subject}
+	ecKey := newECKey(t)
+	edKey := newEd25519Key(t)
+	rsaToken := signClaims(nil)
+
+	tests := []struct {
+		name    string
+		pem     string
+		token   string
+		wantLog string
+	}{
+		{name: "P-256", pem: pkixPublicKeyPEM(t, &ecKey.PublicKey), token: signES256(t, ecKey, map[string]any{"alg": "ES256"}, claims), wantLog: "kid=(none) alg=ES256"},
+		{name: "Ed25519", pem: pkixPublicKeyPEM(t, edKey.Public()), token: signEdDSA(t, edKey, map[string]any{"alg": "EdDSA"}, claims), wantLog: "kid=(none) alg=EdDSA"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			host := startPlugin(t, rawConfig{SchemaVersion: configSchemaVersion, PublicKeyPEM: tc.pem})
+			assertLogged(t, host.GetInfoLogs(), tc.wantLog)
+
+			action, resp, headers := sendRequest(host, bearerHeaders(tc.token))
+			assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+
+			// The key is bound to its algorithm; RS256 tokens are not accepted.
+			action, resp, _ = sendRequest(host, bearerHeaders(rsaToken))
+			assertDenied(t, action, resp, 403, "denied: token algorithm is not supported")
+		})
+	}
+}
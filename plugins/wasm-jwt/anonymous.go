@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// defaultAnonymousHeader marks requests forwarded by an allow_anonymous
+// rule without a verified token.
+const defaultAnonymousHeader = "x-anonymous"
+
+// rawAnonymousRule is an allow_anonymous entry. Exactly one path matcher is
+// required; empty methods or hosts match any.
+type rawAnonymousRule struct {
+	// Path matches the request path (without query) exactly.
+	Path string `json:"path,omitempty"`
+	// PathPrefix matches paths starting with the prefix.
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// PathRegex is an RE2 expression that must match the whole path.
+	PathRegex string `json:"path_regex,omitempty"`
+	// Methods are the allowed :method values.
+	Methods []string `json:"methods,omitempty"`
+	// Hosts are the allowed :authority values, compared without port and
+	// case-insensitively.
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+type anonymousRule struct {
+	path    string
+	prefix  string
+	regex   *regexp.Regexp
+	methods map[string]bool
+	hosts   map[string]bool
+}
+
+func parseAnonymousRules(raw []rawAnonymousRule) ([]anonymousRule, error) {
+	rules := make([]anonymousRule, 0, len(raw))
+	for i, r := range raw {
+		rule, err := parseAnonymousRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("allow_anonymous[%d]: %w", i, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseAnonymousRule(r rawAnonymousRule) (anonymousRule, error) {
+	matchers := 0
+	for _, m := range []string{r.Path, r.PathPrefix, r.PathRegex} {
+		if m != "" {
+			matchers++
+		}
+	}
+	if matchers != 1 {
+		return anonymousRule{}, errors.New("exactly one of path, path_prefix and path_regex is required")
+	}
+	rule := anonymousRule{path: r.Path, prefix: r.PathPrefix}
+	if r.PathRegex != "" {
+		re, err := regexp.Compile("^(?:" + r.PathRegex + ")$")
+		if err != nil {
+			return anonymousRule{}, fmt.Errorf("path_regex: %w", err)
+		}
+		rule.regex = re
+	}
+	if len(r.Methods) > 0 {
+		rule.methods = make(map[string]bool, len(r.Methods))
+		for _, m := range r.Methods {
+			if m == "" {
+				return anonymousRule{}, errors.New("methods must not contain an empty value")
+			}
+			rule.methods[strings.ToUpper(m)] = true
+		}
+	}
+	if len(r.Hosts) > 0 {
+		rule.hosts = make(map[string]bool, len(r.Hosts))
+		for _, h := range r.Hosts {
+			if h == "" {
+				return anonymousRule{}, errors.New("hosts must not contain an empty value")
+			}
+			rule.hosts[normalizeHost(h)] = true
+		}
+	}
+	return rule, nil
+}
+
+func (r anonymousRule) matches(method, host, path string) bool {
+	if r.methods != nil && !r.methods[method] {
+		return false
+	}
+	if r.hosts != nil && !r.hosts[normalizeHost(host)] {
+		return false
+	}
+	switch {
+	case r.regex != nil:
+		return r.regex.MatchString(path)
+	case r.prefix != "":
+		return strings.HasPrefix(path, r.prefix)
+	default:
+		return path == r.path
+	}
+}
+
+// anonymousAllowed reports whether a rule exempts the current request from
+// token verification.
+func anonymousAllowed(rules []anonymousRule) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	path, _ := getRequestHeader(":path")
+	method, _ := getRequestHeader(":method")
+	host, _ := getRequestHeader(":authority")
+	if path == "" {
+		return false
+	}
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	path, ok := canonicalPath(path)
+	if !ok {
+		return false
+	}
+	for _, rule := range rules {
+		if rule.matches(method, host, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalPath percent-decodes p and reports whether the result is already
+// canonical. Dot segments, empty segments, backslashes and encoded
+// separators are rejected rather than resolved, since the origin may resolve
+// them differently, e.g. "/assets/%2e%2e/admin" to "/admin".
+func canonicalPath(p string) (string, bool) {
+	lower := strings.ToLower(p)
+	if strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c") {
+		return "", false
+	}
+	decoded, err := url.PathUnescape(p)
+	if err != nil || strings.Contains(decoded, `\`) {
+		return "", false
+	}
+	cleaned := path.Clean(decoded)
+	if strings.HasSuffix(decoded, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return decoded, cleaned == decoded
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func anonymousConfig() rawConfig {
+	cfg := testConfig()
+	cfg.AllowAnonymous = []rawAnonymousRule{
+		{Path: "/healthz"},
+		{PathPrefix: "/assets/", Methods: []string{"GET", "head"}},
+		{PathRegex: `/public/[a-z]+\.png`, Hosts: []string{"WWW.example.com"}},
+	}
+	return cfg
+}
+
+func TestAnonymousRules(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		host          string
+		path          string
+		wantAnonymous bool
+	}{
+		{name: "exact path", path: "/healthz", wantAnonymous: true},
+		{name: "exact path with query", path: "/healthz?probe=lb", wantAnonymous: true},
+		{name: "exact path does not match children", path: "/healthz/deep"},
+		{name: "prefix with allowed method", path: "/assets/app.js", wantAnonymous: true},
+		{name: "prefix with lower-case configured method", method: "HEAD", path: "/assets/app.js", wantAnonymous: true},
+		{name: "prefix with other method", method: "POST", path: "/assets/upload"},
+		{name: "prefix boundary", path: "/assets"},
+		{name: "regex with allowed host", host: "www.example.com", path: "/public/logo.png", wantAnonymous: true},
+		{name: "regex with host port and case", host: "Www.Example.com:443", path: "/public/logo.png", wantAnonymous: true},
+		{name: "regex with other host", host: "api.example.com", path: "/public/logo.png"},
+		{name: "regex matches the whole path", host: "www.example.com", path: "/public/logo.png.bak"},
+		{name: "no rule", path: "/api/users"},
+		{name: "percent-encoded path", path: "/assets/app%2Ejs", wantAnonymous: true},
+		{name: "dot-dot segment", path: "/assets/../admin"},
+		{name: "encoded dot-dot segment", path: "/assets/%2e%2e/admin"},
+		{name: "mixed-case encoded dot-dot segment", path: "/assets/%2E./admin"},
+		{name: "dot segment", path: "/assets/./app.js"},
+		{name: "empty segment", path: "/assets//app.js"},
+		{name: "encoded slash", path: "/assets%2F..%2Fadmin"},
+		{name: "encoded backslash", path: "/assets/..%5Cadmin"},
+		{name: "backslash", path: `/assets/..\admin`},
+		{name: "invalid escape", path: "/assets/%zz"},
+		{name: "exact path with dot-dot", path: "/healthz/../admin"},
+		{name: "trailing dot-dot", path: "/assets/.."},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			host := startPlugin(t, anonymousConfig())
+			method := tc.method
+			if method == "" {
+				method = "GET"
+			}
+			headers := [][2]string{{":method", method}, {":authority", tc.host}, {":path", tc.path}}
+			action, resp, got := sendRequest(host, headers)
+			if !tc.wantAnonymous {
+				assertDenied(t, action, resp, 403, "denied: authorization header is missing")
+				return
+			}
+			assertAnonymous(t, action, resp, got, defaultAnonymousHeader)
+		})
+	}
+}
+
+func TestAnonymousRequestHeaders(t *testing.T) {
+	t.Run("client identity removed", func(t *testing.T) {
+		host := startPlugin(t, anonymousConfig())
+		headers := [][2]string{{":method", "GET"}, {":path", "/healthz"}, {headerUID, "spoofed"}}
+		action, resp, got := sendRequest(host, headers)
+		assertAnonymous(t, action, resp, got, defaultAnonymousHeader)
+	})
+	t.Run("token is not verified", func(t *testing.T) {
+		host := startPlugin(t, anonymousConfig())
+		headers := [][2]string{{":method", "GET"}, {":path", "/healthz"}, {headerAuth, "Bearer invalid"}}
+		action, resp, got := sendRequest(host, headers)
+		assertAnonymous(t, action, resp, got, defaultAnonymousHeader)
+	})
+	t.Run("client marker removed from authenticated requests", func(t *testing.T) {
+		host := startPlugin(t, anonymousConfig())
+		headers := append(bearerHeaders(signClaims(nil)), [2]string{defaultAnonymousHeader, "1"})
+		action, resp, got := sendRequest(host, headers)
+		assertAllowed(t, action, resp, got, jwtverifytest.Subject)
+		if v, ok := headerValue(got, defaultAnonymousHeader); ok {
+			t.Errorf("%s = %q on an authenticated request", defaultAnonymousHeader, v)
+		}
+	})
+	t.Run("custom marker", func(t *testing.T) {
+		cfg := anonymousConfig()
+		cfg.AnonymousHeader = "X-Authn-Anonymous"
+		host := startPlugin(t, cfg)
+		action, resp, got := sendRequest(host, [][2]string{{":method", "GET"}, {":path", "/healthz"}})
+		assertAnonymous(t, action, resp, got, "x-authn-anonymous")
+	})
+	t.Run("remove failure denies", func(t *testing.T) {
+		stub(t, &removeRequestHeader, func(string) error { return types.ErrorStatusBadArgument })
+		host := startPlugin(t, anonymousConfig())
+		action, resp, _ := sendRequest(host, [][2]string{{":method", "GET"}, {":path", "/healthz"}})
+		assertDenied(t, action, resp, 403, "denied: x-uid header could not be removed")
+	})
+	t.Run("keys not loaded", func(t *testing.T) {
+		cfg := remoteConfig()
+		cfg.AllowAnonymous = []rawAnonymousRule{{Path: "/healthz"}}
+		host := startPlugin(t, cfg)
+		action, resp, got := sendRequest(host, [][2]string{{":method", "GET"}, {":path", "/healthz"}})
+		assertAnonymous(t, action, resp, got, defaultAnonymousHeader)
+	})
+	t.Run("metrics", func(t *testing.T) {
+		host := startPlugin(t, anonymousConfig())
+		sendRequest(host, [][2]string{{":method", "GET"}, {":path", "/healthz"}})
+		sendRequest(host, bearerHeaders(signClaims(nil)))
+		assertCounter(t, host, defaultMetricPrefix+"requests_anonymous_total", 1)
+		assertCounter(t, host, defaultMetricPrefix+"requests_allowed_total", 1)
+	})
+}
+
+func assertAnonymous(t *testing.T, action types.Action, resp *proxytest.LocalHttpResponse, headers [][2]string, marker string) {
+	t.Helper()
+	if action != types.ActionContinue || resp != nil {
+		t.Fatalf("action = %v, local response = %v, want continue", action, resp)
+	}
+	if got, _ := headerValue(headers, marker); got != "1" {
+		t.Errorf("%s = %q, want 1", marker, got)
+	}
+	if got, ok := headerValue(headers, headerUID); ok {
+		t.Errorf("%s = %q on an anonymous request", headerUID, got)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+// publicJWK returns the JWK of an RSA, P-256 or Ed25519 public key.
+func publicJWK(pub crypto.PublicKey, kid string) map[string]any {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]any{"kty": "RSA", "kid": kid, "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		return map[string]any{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(x), "y": b64(y)}
+	case ed25519.PublicKey:
+		return map[string]any{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64(k)}
+	}
+	panic("unsupported key type")
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+// signingInput encodes the JOSE header and claims of a compact JWS.
+func signingInput(t *testing.T, header, claims map[string]any) string {
+	t.Helper()
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("marshal header: %v", err)
+	}
+	rawClaims, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(rawHeader) + "." + base64.RawURLEncoding.EncodeToString(rawClaims)
+}
+
+// signES256 signs claims with the fixed-size R||S signature JWS requires.
+func signES256(t *testing.T, key *ecdsa.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	input := signingInput(t, header, claims)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwksConfig(t *testing.T, keys ...map[string]any) rawConfig {
+	t.Helper()
+	return rawConfig{SchemaVersion: configSchemaVersion, JWKS: mustMarshal(t, map[string]any{"keys": keys})}
+}
+
+func TestJWKSKidSelection(t *testing.T) {
+	current := jwtverifytest.PrivateKey()
+	staged, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	ecKey := newECKey(t)
+	host := startPlugin(t, jwksConfig(t,
+		publicJWK(&current.PublicKey, "current"),
+		publicJWK(&staged.PublicKey, "next"),
+		publicJWK(&ecKey.PublicKey, "ec"),
+	))
+
+	claims := map[string]any{"sub": jwtverifytest.Subject}
+	tests := []struct {
+		name       string
+		token      string
+		wantReason string
+	}{
+		{name: "current key", token: jwtverifytest.SignRS256(current, map[string]any{"alg": "RS256", "kid": "current"}, claims)},
+		{name: "staged key", token: jwtverifytest.SignRS256(staged, map[string]any{"alg": "RS256", "kid": "next"}, claims)},
+		{name: "ec key", token: signES256(t, ecKey, map[string]any{"alg": "ES256", "kid": "ec"}, claims)},
+		{name: "no kid tries all keys", token: jwtverifytest.SignRS256(staged, map[string]any{"alg": "RS256"}, claims)},
+		{name: "kid of another key", token: jwtverifytest.SignRS256(staged, map[string]any{"alg": "RS256", "kid": "current"}, claims), wantReason: "token signature is invalid"},
+		{name: "unknown kid", token: jwtverifytest.SignRS256(current, map[string]any{"alg": "RS256", "kid": "retired"}, claims), wantReason: "token key is unknown"},
+		{name: "alg not bound to kid", token: jwtverifytest.SignRS256(current, map[string]any{"alg": "RS256", "kid": "ec"}, claims), wantReason: "token key is unknown"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			action, resp, headers := sendRequest(host, bearerHeaders(tc.token))
+			if tc.wantReason != "" {
+				assertDenied(t, action, resp, 403, "denied: "+tc.wantReason)
+				return
+			}
+			assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+		})
+	}
+
+	logs := strings.Join(host.GetInfoLogs(), "\n")
+	for _, want := range []string{"kid=current alg=RS256", "kid=next alg=RS256", "kid=ec alg=ES256"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("info logs do not report %q:\n%s", want, logs)
+		}
+	}
+}
+
+func TestLoadConfigRejectsInvalidConfig(t *testing.T) {
+	key := jwtverifytest.PrivateKey()
+	pem := jwtverifytest.PublicKeyPEM()
+	tests := []struct {
+		name    string
+		cfg     map[string]any
+		wantErr string
+	}{
+		{name: "no keys", cfg: map[string]any{"leeway_seconds": 5}, wantErr: "public_key_pem, jwks or jwks_cluster is required"},
+		{name: "unknown field", cfg: map[string]any{"public_key_pem": pem, "leeway": 5}, wantErr: `unknown field "leeway"`},
+		{name: "negative leeway", cfg: map[string]any{"public_key_pem": pem, "leeway_seconds": -1}, wantErr: "leeway_seconds must not be negative"},
+		{name: "bad pem", cfg: map[string]any{"public_key_pem": "not a key"}, wantErr: "public key PEM is invalid"},
+		{name: "duplicate kid", cfg: map[string]any{"jwks": map[string]any{"keys": []any{publicJWK(&key.PublicKey, "a"), publicJWK(&key.PublicKey, "a")}}}, wantErr: `duplicate kid "a"`},
+		{name: "bad jwk", cfg: map[string]any{"jwks": map[string]any{"keys": []any{map[string]any{"kty": "oct", "k": "c2VjcmV0"}}}}, wantErr: `unsupported kty "oct"`},
+		{name: "empty jwks", cfg: map[string]any{"jwks": map[string]any{"keys": []any{}}}, wantErr: "JWKS has no keys"},
+		{name: "remote options without cluster", cfg: map[string]any{"public_key_pem": pem, "jwks_path": "/keys"}, wantErr: "jwks_cluster is required"},
+		{name: "negative refresh", cfg: map[string]any{"jwks_cluster": "issuer", "jwks_refresh_seconds": -1}, wantErr: "jwks_refresh_seconds must not be negative"},
+		{name: "unsupported schema version", cfg: map[string]any{"schema_version": 2, "public_key_pem": pem}, wantErr: "unsupported schema_version 2 (this plugin supports 1)"},
+		{name: "invalid metric prefix", cfg: map[string]any{"metric_prefix": "lb3 authn", "public_key_pem": pem}, wantErr: "metric_prefix may only contain"},
+		{name: "anonymous rule without path", cfg: map[string]any{"public_key_pem": pem, "allow_anonymous": []any{map[string]any{"methods": []string{"GET"}}}}, wantErr: "allow_anonymous[0]: exactly one of path, path_prefix and path_regex is required"},
+		{name: "anonymous rule with two paths", cfg: map[string]any{"public_key_pem": pem, "allow_anonymous": []any{map[string]any{"path": "/a", "path_prefix": "/b"}}}, wantErr: "exactly one of path"},
+		{name: "anonymous rule with bad regex", cfg: map[string]any{"public_key_pem": pem, "allow_anonymous": []any{map[string]any{"path_regex": "(["}}}, wantErr: "allow_anonymous[0]: path_regex"},
+		{name: "reserved anonymous header", cfg: map[string]any{"public_key_pem": pem, "anonymous_header": "X-Uid"}, wantErr: `anonymous_header "X-Uid" is reserved`},
+		{name: "negative token cache size", cfg: map[string]any{"public_key_pem": pem, "token_cache_size": -1}, wantErr: "token_cache_size must be between 0 and 65536"},
+		{name: "token cache too large", cfg: map[string]any{"public_key_pem": pem, "token_cache_size": 1 << 20}, wantErr: "token_cache_size must be between 0 and 65536"},
+		{name: "negative token cache ttl", cfg: map[string]any{"public_key_pem": pem, "token_cache_max_ttl_seconds": -1}, wantErr: "token_cache_max_ttl_seconds must not be negative"},
+		{name: "key alg not matching key type", cfg: map[string]any{"keys": []any{map[string]any{"kid": "a", "alg": "ES256", "public_key_pem": pem}}}, wantErr: "keys[0]: ES256 key must be a P-256 public key"},
+		{name: "unsupported key alg", cfg: map[string]any{"keys": []any{map[string]any{"alg": "PS256", "public_key_pem": pem}}}, wantErr: "keys[0]: unsupported key algorithm: PS256"},
+		{name: "duplicate kid across keys and jwks", cfg: map[string]any{"keys": []any{map[string]any{"kid": "a", "public_key_pem": pem}}, "jwks": map[string]any{"keys": []any{publicJWK(&key.PublicKey, "a")}}}, wantErr: `duplicate kid "a"`},
+		{name: "pseudo security header", cfg: map[string]any{"public_key_pem": pem, "security_headers": map[string]string{":status": "200"}}, wantErr: `security_headers: invalid header name ":status"`},
+		{name: "empty security header value", cfg: map[string]any{"public_key_pem": pem, "security_headers": map[string]string{"x-frame-options": ""}}, wantErr: "security_headers: x-frame-options has an empty value"},
+		{name: "empty strip header", cfg: map[string]any{"public_key_pem": pem, "strip_response_headers": []string{""}}, wantErr: `strip_response_headers: invalid header name ""`},
+		{name: "invalid debug header", cfg: map[string]any{"public_key_pem": pem, "debug_header": "x debug"}, wantErr: `debug_header: invalid header name "x debug"`},
+		{name: "rate limit without slash", cfg: map[string]any{"public_key_pem": pem, "rate_limits": []any{map[string]any{"prefix": "api", "requests_per_second": 1, "burst": 1}}}, wantErr: "rate_limits[0]: prefix must start with /"},
+		{name: "rate limit without burst", cfg: map[string]any{"public_key_pem": pem, "rate_limits": []any{map[string]any{"prefix": "/", "requests_per_second": 1}}}, wantErr: "rate_limits[0]: requests_per_second and burst must be positive"},
+		{name: "too many rate limit slots", cfg: map[string]any{"public_key_pem": pem, "rate_limit_slots": 1 << 20}, wantErr: "rate_limit_slots must be between 1 and 65536"},
+		{name: "unknown start mode", cfg: map[string]any{"start_mode": "lenient", "public_key_pem": pem}, wantErr: `unknown start_mode "lenient"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name+"/strict", func(t *testing.T) {
+			host := newHost(t, mustMarshal(t, tc.cfg))
+			if status := host.StartPlugin(); status != types.OnPluginStartStatusFailed {
+				t.Fatalf("StartPlugin() = %v, want failed", status)
+			}
+			assertLogged(t, host.GetCriticalLogs(), tc.wantErr)
+		})
+		if tc.cfg["start_mode"] != nil {
+			continue
+		}
+		t.Run(tc.name+"/permissive", func(t *testing.T) {
+			cfg := map[string]any{"start_mode": startModePermissive}
+			for k, v := range tc.cfg {
+				cfg[k] = v
+			}
+			host := startPlugin(t, cfg)
+			action, resp, _ := sendRequest(host, bearerHeaders(signClaims(nil)))
+			assertDenied(t, action, resp, 403, "denied: plugin config is invalid")
+			assertLogged(t, host.GetErrorLogs(), tc.wantErr)
+		})
+	}
+}
+
+func TestPluginStartWithUnparseableConfig(t *testing.T) {
+	tests := map[string]string{
+		"empty":        "",
+		"whitespace":   " \n",
+		"invalid json": `{"start_mode":"permissive"`,
+		"not object":   `["public_key_pem"]`,
+	}
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			host := newHost(t, []byte(raw))
+			if status := host.StartPlugin(); status != types.OnPluginStartStatusFailed {
+				t.Fatalf("StartPlugin() = %v, want failed", status)
+			}
+			if len(host.GetCriticalLogs()) == 0 {
+				t.Error("config error was not logged")
+			}
+		})
+	}
+}
+
+func TestLoadConfigSchemaVersion(t *testing.T) {
+	t.Run("current", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.SchemaVersion = configSchemaVersion
+		host := startPlugin(t, cfg)
+		if logs := host.GetWarnLogs(); len(logs) != 0 {
+			t.Errorf("unexpected warnings: %v", logs)
+		}
+	})
+	t.Run("unset", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.SchemaVersion = 0
+		host := startPlugin(t, cfg)
+		assertLogged(t, host.GetWarnLogs(), "schema_version is not set, assuming 1")
+		action, resp, headers := sendRequest(host, bearerHeaders(signClaims(nil)))
+		assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+	})
+}
+
+func assertLogged(t *testing.T, logs []string, want string) {
+	t.Helper()
+	for _, log := range logs {
+		if strings.Contains(log, want) {
+			return
+		}
+	}
+	t.Errorf("no log contains %q: %v", want, logs)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func TestOnHttpRequestHeadersConformance(t *testing.T) {
+	host := startPlugin(t, testConfig())
+
+	for _, tc := range jwtverifytest.Cases() {
+		t.Run(tc.Name, func(t *testing.T) {
+			headers := [][2]string{{":path", "/"}}
+			if tc.Authorization != "" {
+				headers = append(headers, [2]string{headerAuth, tc.Authorization})
+			}
+			action, resp, got := sendRequest(host, headers)
+			if tc.WantReason != "" {
+				assertDenied(t, action, resp, 403, "denied: "+tc.WantReason)
+				return
+			}
+			assertAllowed(t, action, resp, got, tc.WantSubject)
+		})
+	}
+}
@@ -1,5 +1,13 @@
 module github.com/winor30/gcp-service-extensions-playground/plugins/wasm-jwt
 
-go 1.24
+go 1.25
 
-require github.com/proxy-wasm/proxy-wasm-go-sdk v0.0.0-20260105142703-44c7d5847745
+require (
+	github.com/proxy-wasm/proxy-wasm-go-sdk v0.0.0-20260105142703-44c7d5847745
+	github.com/winor30/gcp-service-extensions-playground v0.0.0
+)
+
+require github.com/tetratelabs/wazero v1.7.2 // indirect
+
+// The shared verification package lives in the repository root module.
+replace github.com/winor30/gcp-service-extensions-playground => ../..
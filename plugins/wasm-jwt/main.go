@@ -1,18 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm"
 	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
 )
 
 const (
@@ -21,15 +26,92 @@ const (
 	bearerPrefix = "Bearer "
 )
 
-type jwtHeader struct {
-	Alg string `json:"alg"`
-}
+const (
+	// configSchemaVersion is the plugin config schema this build understands.
+	configSchemaVersion = 1
 
-type jwtClaims struct {
-	Sub string `json:"sub"`
-}
+	// startModeStrict fails plugin start on an invalid config so the
+	// rollout is rejected by the host.
+	startModeStrict = "strict"
+	// startModePermissive starts the plugin with an invalid config and
+	// denies every request, for debugging a deployment.
+	startModePermissive = "permissive"
+)
+
+// now is the clock used for token validation. The host provides it through
+// WASI clock_time_get; tests replace it.
+var now = time.Now
+
+// Request header hostcalls. Tests replace them to emulate host failures and
+// hosts whose replace does not insert a missing header.
+var (
+	getRequestHeader     = proxywasm.GetHttpRequestHeader
+	replaceRequestHeader = proxywasm.ReplaceHttpRequestHeader
+	addRequestHeader     = proxywasm.AddHttpRequestHeader
+	removeRequestHeader  = proxywasm.RemoveHttpRequestHeader
+)
 
 type rawConfig struct {
+	// SchemaVersion is the config schema version (default: configSchemaVersion).
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// StartMode is startModeStrict (default) or startModePermissive.
+	StartMode string `json:"start_mode,omitempty"`
+	// AllowAnonymous exempts matching requests from token verification.
+	AllowAnonymous []rawAnonymousRule `json:"allow_anonymous,omitempty"`
+	// AnonymousHeader is set to "1" on exempted requests and removed from
+	// all others (default: defaultAnonymousHeader).
+	AnonymousHeader string `json:"anonymous_header,omitempty"`
+	// TokenCacheSize is the number of verified-token cache slots shared by
+	// all worker VMs (default: defaultTokenCacheSize, 0 disables the cache).
+	TokenCacheSize *int `json:"token_cache_size,omitempty"`
+	// TokenCacheMaxTTLSeconds bounds how long a verified token is cached
+	// (default: defaultTokenCacheMaxTTL).
+	TokenCacheMaxTTLSeconds int `json:"token_cache_max_ttl_seconds,omitempty"`
+	// RateLimits are per-subject token buckets by path prefix.
+	RateLimits []rawRateLimitRule `json:"rate_limits,omitempty"`
+	// RateLimitSlots is the number of shared-data buckets per rate limit
+	// rule (default: defaultRateLimitSlots).
+	RateLimitSlots int `json:"rate_limit_slots,omitempty"`
+	// StripResponseHeaders are removed from responses in addition to x-uid
+	// and the anonymous header.
+	StripResponseHeaders []string `json:"strip_response_headers,omitempty"`
+	// SecurityHeaders are set on every response, replacing origin values.
+	SecurityHeaders map[string]string `json:"security_headers,omitempty"`
+	// DebugHeader makes the plugin report its decision and latency in
+	// response headers when present on the request (default: defaultDebugHeader).
+	DebugHeader string `json:"debug_header,omitempty"`
+	// MetricPrefix is prepended to every metric name (default: defaultMetricPrefix).
+	MetricPrefix *string `json:"metric_prefix,omitempty"`
+	// PublicKeyPEM is a single key without a kid (RSA, P-256 or Ed25519).
+	PublicKeyPEM string `json:"public_key_pem,omitempty"`
+	// Keys are PEM keys with a kid and an algorithm.
+	Keys []rawKey `json:"keys,omitempty"`
+	// JWKS is a JSON Web Key Set (RSA, P-256 EC and Ed25519 OKP keys). Tokens carrying a
+	// kid are verified with the matching key only, so a new key can be staged
+	// here before the issuer starts using it.
+	JWKS json.RawMessage `json:"jwks,omitempty"`
+	// JWKSCluster is the upstream cluster the JWKS is fetched from. Remote
+	// keys are used in addition to public_key_pem and jwks.
+	JWKSCluster string `json:"jwks_cluster,omitempty"`
+	// JWKSAuthority is the :authority of the JWKS request (default: the cluster).
+	JWKSAuthority string `json:"jwks_authority,omitempty"`
+	// JWKSPath is the :path of the JWKS request.
+	JWKSPath string `json:"jwks_path,omitempty"`
+	// JWKSRefreshSeconds is the interval between JWKS fetches.
+	JWKSRefreshSeconds int `json:"jwks_refresh_seconds,omitempty"`
+	// JWKSTimeoutMillis is the timeout of a JWKS fetch.
+	JWKSTimeoutMillis int `json:"jwks_timeout_ms,omitempty"`
+	// LeewaySeconds is the clock skew tolerated for exp, nbf and iat.
+	LeewaySeconds int `json:"leeway_seconds,omitempty"`
+	// RequireExp rejects tokens without an exp claim.
+	RequireExp bool `json:"require_exp,omitempty"`
+}
+
+// rawKey is a keys entry. Alg defaults to the algorithm of the key type;
+// a token is only verified with a key whose algorithm matches its alg.
+type rawKey struct {
+	Kid          string `json:"kid,omitempty"`
+	Alg          string `json:"alg,omitempty"`
 	PublicKeyPEM string `json:"public_key_pem"`
 }
 
@@ -45,11 +127,30 @@ type pluginContext struct {
 type httpContext struct {
 	types.DefaultHttpContext
 	state *pluginState
+
+	// start is when request processing began; latency is its duration.
+	start   time.Time
+	latency time.Duration
+	// debug is set when the request carried the debug header.
+	debug bool
+	// decision is reported in x-auth-decision: allow, anonymous or
+	// "deny: <reason>".
+	decision string
 }
 
 type pluginState struct {
-	publicKey *rsa.PublicKey
-	configErr error
+	verifier  *jwtverify.Verifier
+	keys      []jwtverify.Key
+	options   jwtverify.Options
+	remote    *remoteJWKS
+	anonymous []anonymousRule
+	// anonymousHeader marks exempted requests.
+	anonymousHeader string
+	cache           *tokenCache
+	limiter         *rateLimiter
+	response        *responsePolicy
+	metrics         *metrics
+	configErr       error
 }
 
 func main() {
@@ -64,27 +165,73 @@ func (*vmContext) NewPluginContext(contextID uint32) types.PluginContext {
 }
 
 func (ctx *pluginContext) OnPluginStart(pluginConfigurationSize int) types.OnPluginStartStatus {
-	state, err := loadConfig()
+	raw, err := proxywasm.GetPluginConfiguration()
+	if err != nil && !errors.Is(err, types.ErrorStatusNotFound) {
+		proxywasm.LogCriticalf("read plugin config failed: %v", err)
+		return types.OnPluginStartStatusFailed
+	}
+	state, err := loadConfig(raw)
 	if err != nil {
-		ctx.state.configErr = err
-		proxywasm.LogWarnf("plugin config error: %v", err)
-		return types.OnPluginStartStatusOK
+		if startMode(raw) == startModePermissive {
+			ctx.state.configErr = err
+			ctx.state.metrics = newMetrics(defaultMetricPrefix)
+			proxywasm.LogErrorf("invalid plugin config, denying all requests (start_mode=permissive): %v", err)
+			return types.OnPluginStartStatusOK
+		}
+		proxywasm.LogCriticalf("invalid plugin config, failing plugin start: %v", err)
+		return types.OnPluginStartStatusFailed
 	}
 	ctx.state = state
+	for _, key := range state.keys {
+		kid := key.ID
+		if kid == "" {
+			kid = "(none)"
+		}
+		proxywasm.LogInfof("loaded verification key kid=%s alg=%s", kid, key.Algorithm)
+	}
+	if state.remote != nil {
+		if err := proxywasm.SetTickPeriodMilliSeconds(uint32(state.remote.refresh.Milliseconds())); err != nil {
+			proxywasm.LogWarnf("set tick period failed: %v", err)
+		}
+		state.remote.fetch()
+	}
 	proxywasm.LogInfo("proxy-wasm plugin started")
 	return types.OnPluginStartStatusOK
 }
 
+func (ctx *pluginContext) OnTick() {
+	if ctx.state.remote != nil {
+		ctx.state.remote.fetch()
+	}
+}
+
 func (ctx *pluginContext) NewHttpContext(contextID uint32) types.HttpContext {
 	return &httpContext{state: ctx.state}
 }
 
 func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) types.Action {
-	if ctx.state == nil || ctx.state.configErr != nil || ctx.state.publicKey == nil {
+	ctx.start = time.Now()
+	ctx.debug = ctx.state.response.debugRequested()
+	action := ctx.authorize()
+	ctx.latency = time.Since(ctx.start)
+	return action
+}
+
+// authorize decides the request: anonymous rules first, then the bearer
+// token.
+func (ctx *httpContext) authorize() types.Action {
+	if ctx.state.configErr != nil {
 		return ctx.deny("denied: plugin config is invalid")
 	}
+	if anonymousAllowed(ctx.state.anonymous) {
+		return ctx.allowAnonymous()
+	}
+	verifier, keySet := ctx.state.currentVerifier()
+	if verifier == nil {
+		return ctx.deny("denied: verification keys are not loaded")
+	}
 
-	authHeader, err := proxywasm.GetHttpRequestHeader(headerAuth)
+	authHeader, err := getRequestHeader(headerAuth)
 	if err != nil {
 		if err == types.ErrorStatusNotFound {
 			return ctx.deny("denied: authorization header is missing")
@@ -99,80 +246,270 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 		return ctx.deny("denied: authorization header is invalid")
 	}
 	token := strings.TrimPrefix(authHeader, bearerPrefix)
-	parts := strings.Split(token, ".")
-	if len(parts) != 3 {
-		return ctx.deny("denied: token format is invalid")
+	subject, ok := ctx.state.cache.lookup(token, keySet)
+	if !ok {
+		start := time.Now()
+		claims, err := verifier.Verify(token)
+		ctx.state.metrics.recordVerification(time.Since(start))
+		if err != nil {
+			return ctx.deny("denied: " + err.Error())
+		}
+		ctx.state.cache.store(token, keySet, claims)
+		subject = claims.Subject
 	}
-
-	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
-	if err != nil {
-		return ctx.deny("denied: token header is invalid")
+	if limited := ctx.state.limiter.allow(subject); limited != nil {
+		return ctx.rateLimit(limited)
 	}
-	var header jwtHeader
-	if err := json.Unmarshal(headerBytes, &header); err != nil {
-		return ctx.deny("denied: token header is invalid")
+
+	if err := setRequestHeader(headerUID, subject); err != nil {
+		return ctx.deny("denied: " + err.Error())
 	}
-	if header.Alg != "RS256" {
-		return ctx.deny("denied: token header is invalid")
+	if ctx.state.anonymousHeader != "" {
+		if err := deleteRequestHeader(ctx.state.anonymousHeader); err != nil {
+			return ctx.deny("denied: " + err.Error())
+		}
 	}
+	ctx.state.metrics.allow()
+	ctx.decision = "allow"
+	return types.ActionContinue
+}
 
-	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
-	if err != nil {
-		return ctx.deny("denied: token payload is invalid")
-	}
-	var claims jwtClaims
-	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
-		return ctx.deny("denied: token payload is invalid")
+// allowAnonymous forwards an exempted request without identity: any
+// client-supplied x-uid is removed and the anonymous marker is set.
+func (ctx *httpContext) allowAnonymous() types.Action {
+	if err := deleteRequestHeader(headerUID); err != nil {
+		return ctx.deny("denied: " + err.Error())
 	}
-	if claims.Sub == "" {
-		return ctx.deny("denied: subject is missing")
+	if err := setRequestHeader(ctx.state.anonymousHeader, "1"); err != nil {
+		return ctx.deny("denied: " + err.Error())
 	}
+	ctx.state.metrics.allowAnonymous()
+	ctx.decision = "anonymous"
+	return types.ActionContinue
+}
 
-	signingInput := parts[0] + "." + parts[1]
-	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
-	if err != nil {
-		return ctx.deny("denied: token signature is invalid")
+// setRequestHeader replaces name with value, adding it for hosts whose
+// replace does not insert a missing header. An error means a
+// client-supplied value may still be present and the request must not be
+// forwarded.
+func setRequestHeader(name, value string) error {
+	err := replaceRequestHeader(name, value)
+	if err == nil {
+		return nil
+	}
+	if err != types.ErrorStatusNotFound {
+		proxywasm.LogWarnf("set %s header failed: %v", name, err)
+		return fmt.Errorf("%s header could not be set", name)
 	}
-	digest := sha256.Sum256([]byte(signingInput))
-	if err := rsa.VerifyPKCS1v15(ctx.state.publicKey, crypto.SHA256, digest[:], signature); err != nil {
-		return ctx.deny("denied: token signature is invalid")
+	if err := addRequestHeader(name, value); err != nil {
+		proxywasm.LogWarnf("add %s header failed: %v", name, err)
 	}
+	return nil
+}
 
-	if err := proxywasm.ReplaceHttpRequestHeader(headerUID, claims.Sub); err != nil {
-		if err == types.ErrorStatusNotFound {
-			if err := proxywasm.AddHttpRequestHeader(headerUID, claims.Sub); err != nil {
-				proxywasm.LogWarnf("add %s header failed: %v", headerUID, err)
-			}
-		} else {
-			proxywasm.LogWarnf("set %s header failed: %v", headerUID, err)
-		}
+// deleteRequestHeader removes a client-supplied header the plugin owns.
+func deleteRequestHeader(name string) error {
+	if err := removeRequestHeader(name); err != nil && err != types.ErrorStatusNotFound {
+		proxywasm.LogWarnf("remove %s header failed: %v", name, err)
+		return fmt.Errorf("%s header could not be removed", name)
 	}
-	return types.ActionContinue
+	return nil
 }
 
 func (ctx *httpContext) deny(reason string) types.Action {
+	ctx.state.metrics.deny(strings.TrimPrefix(reason, "denied: "))
+	ctx.decision = "deny: " + strings.TrimPrefix(reason, "denied: ")
 	_ = proxywasm.SendHttpResponse(403,
-		[][2]string{{"content-type", "text/plain"}},
+		ctx.localResponseHeaders(),
 		[]byte(reason),
 		-1,
 	)
 	return types.ActionPause
 }
 
-func loadConfig() (*pluginState, error) {
-	raw, err := proxywasm.GetPluginConfiguration()
+// startMode reads start_mode leniently so that it applies even when the
+// rest of the config is invalid. Unparseable configs are strict.
+func startMode(raw []byte) string {
+	var cfg struct {
+		StartMode string `json:"start_mode"`
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return startModeStrict
+	}
+	return cfg.StartMode
+}
+
+func loadConfig(raw []byte) (*pluginState, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, errors.New("plugin config is empty")
+	}
+	var cfg rawConfig
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse plugin config: %w", err)
+	}
+	switch cfg.SchemaVersion {
+	case configSchemaVersion:
+	case 0:
+		proxywasm.LogWarnf("schema_version is not set, assuming %d", configSchemaVersion)
+	default:
+		return nil, fmt.Errorf("unsupported schema_version %d (this plugin supports %d)", cfg.SchemaVersion, configSchemaVersion)
+	}
+	switch cfg.StartMode {
+	case "", startModeStrict, startModePermissive:
+	default:
+		return nil, fmt.Errorf("unknown start_mode %q (want %q or %q)", cfg.StartMode, startModeStrict, startModePermissive)
+	}
+	if cfg.LeewaySeconds < 0 {
+		return nil, errors.New("leeway_seconds must not be negative")
+	}
+	prefix := defaultMetricPrefix
+	if cfg.MetricPrefix != nil {
+		prefix = *cfg.MetricPrefix
+		if err := validateMetricPrefix(prefix); err != nil {
+			return nil, err
+		}
+	}
+	anonymous, err := parseAnonymousRules(cfg.AllowAnonymous)
 	if err != nil {
 		return nil, err
 	}
-	if len(raw) == 0 {
-		return nil, nil
+	anonymousHeader := strings.ToLower(cfg.AnonymousHeader)
+	if anonymousHeader == "" {
+		anonymousHeader = defaultAnonymousHeader
 	}
-	var cfg rawConfig
-	if err := json.Unmarshal(raw, &cfg); err != nil {
+	if anonymousHeader == headerUID || anonymousHeader == headerAuth || strings.HasPrefix(anonymousHeader, ":") {
+		return nil, fmt.Errorf("anonymous_header %q is reserved", cfg.AnonymousHeader)
+	}
+	response, err := newResponsePolicy(cfg, anonymousHeader)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadKeys(cfg)
+	if err != nil {
 		return nil, err
 	}
-	cfg.PublicKeyPEM = strings.ReplaceAll(cfg.PublicKeyPEM, "\\n", "\n")
-	block, _ := pem.Decode([]byte(cfg.PublicKeyPEM))
+	remote, err := newRemoteJWKS(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 && remote == nil {
+		return nil, errors.New("public_key_pem, jwks or jwks_cluster is required")
+	}
+	pluginMetrics := newMetrics(prefix)
+	cache, err := newTokenCache(raw, cfg, pluginMetrics)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := newRateLimiter(raw, cfg, pluginMetrics)
+	if err != nil {
+		return nil, err
+	}
+	state := &pluginState{
+		keys: keys,
+		options: jwtverify.Options{
+			Leeway:            time.Duration(cfg.LeewaySeconds) * time.Second,
+			RequireExpiration: cfg.RequireExp,
+			Now:               func() time.Time { return now() },
+		},
+		remote:          remote,
+		anonymous:       anonymous,
+		anonymousHeader: anonymousHeader,
+		cache:           cache,
+		limiter:         limiter,
+		response:        response,
+		metrics:         pluginMetrics,
+	}
+	if len(keys) > 0 {
+		state.verifier, err = jwtverify.NewVerifier(keys, state.options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// currentVerifier returns the verifier for the configured keys plus the
+// remote JWKS last stored in shared data, or nil when no key is available.
+// keySet identifies the key set for the token cache: the shared JWKS CAS,
+// or 0 for the configured keys only.
+func (s *pluginState) currentVerifier() (verifier *jwtverify.Verifier, keySet uint32) {
+	if s.remote != nil {
+		if verifier := s.remote.verifier(s.keys, s.options); verifier != nil {
+			return verifier, s.remote.cas
+		}
+	}
+	return s.verifier, 0
+}
+
+// loadKeys collects the static verification keys from public_key_pem, keys
+// and jwks.
+func loadKeys(cfg rawConfig) ([]jwtverify.Key, error) {
+	var keys []jwtverify.Key
+	if cfg.PublicKeyPEM != "" {
+		key, err := pemKey(rawKey{PublicKeyPEM: cfg.PublicKeyPEM})
+		if err != nil {
+			return nil, fmt.Errorf("public_key_pem: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	for i, raw := range cfg.Keys {
+		key, err := pemKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d]: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(cfg.JWKS) > 0 {
+		jwks, err := jwtverify.ParseJWKS(cfg.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwks...)
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key.ID == "" {
+			continue
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("duplicate kid %q", key.ID)
+		}
+		seen[key.ID] = true
+	}
+	return keys, nil
+}
+
+// pemKey binds a PEM key to its configured algorithm, or to the default
+// for its type (RS256 for RSA, ES256 for P-256, EdDSA for Ed25519).
+func pemKey(raw rawKey) (jwtverify.Key, error) {
+	publicKey, err := parsePublicKeyPEM(raw.PublicKeyPEM)
+	if err != nil {
+		return jwtverify.Key{}, err
+	}
+	key := jwtverify.Key{ID: raw.Kid, Algorithm: raw.Alg, PublicKey: publicKey}
+	if key.Algorithm == "" {
+		switch publicKey.(type) {
+		case *rsa.PublicKey:
+			key.Algorithm = jwtverify.AlgRS256
+		case *ecdsa.PublicKey:
+			key.Algorithm = jwtverify.AlgES256
+		case ed25519.PublicKey:
+			key.Algorithm = jwtverify.AlgEdDSA
+		}
+	}
+	// NewVerifier rejects keys that do not fit their algorithm; check here
+	// too so the error names the offending entry.
+	if _, err := jwtverify.NewVerifier([]jwtverify.Key{key}, jwtverify.Options{}); err != nil {
+		return jwtverify.Key{}, err
+	}
+	return key, nil
+}
+
+func parsePublicKeyPEM(value string) (crypto.PublicKey, error) {
+	value = strings.ReplaceAll(value, "\\n", "\n")
+	block, _ := pem.Decode([]byte(value))
 	if block == nil || block.Type != "PUBLIC KEY" {
 		return nil, errors.New("public key PEM is invalid")
 	}
@@ -180,9 +517,10 @@ func loadConfig() (*pluginState, error) {
 	if err != nil {
 		return nil, err
 	}
-	publicKey, ok := pub.(*rsa.PublicKey)
-	if !ok {
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return pub, nil
+	default:
 		return nil, errors.New("public key type is invalid")
 	}
-	return &pluginState{publicKey: publicKey}, nil
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+// newHost creates a host emulator with the raw plugin config, with the
+// clock frozen at jwtverifytest.Now. The plugin is not started.
+func newHost(t *testing.T, raw []byte) proxytest.HostEmulator {
+	t.Helper()
+	now = func() time.Time { return jwtverifytest.Now }
+	t.Cleanup(func() { now = time.Now })
+
+	opt := proxytest.NewEmulatorOption().WithVMContext(&vmContext{}).WithPluginConfiguration(raw)
+	host, reset := proxytest.NewHostEmulator(opt)
+	t.Cleanup(reset)
+	return host
+}
+
+// startPlugin starts the plugin in the host emulator with cfg.
+func startPlugin(t *testing.T, cfg any) proxytest.HostEmulator {
+	t.Helper()
+	host := newHost(t, mustMarshal(t, cfg))
+	if status := host.StartPlugin(); status != types.OnPluginStartStatusOK {
+		t.Fatalf("StartPlugin() = %v", status)
+	}
+	return host
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return raw
+}
+
+func testConfig() rawConfig {
+	return rawConfig{SchemaVersion: configSchemaVersion, PublicKeyPEM: jwtverifytest.PublicKeyPEM()}
+}
+
+// signClaims signs claims with the fixture key. nil values remove the
+// default claims (sub, iat, exp).
+func signClaims(extra map[string]any) string {
+	claims := map[string]any{
+		"sub": jwtverifytest.Subject,
+		"iat": jwtverifytest.Now.Add(-time.Minute).Unix(),
+		"exp": jwtverifytest.Now.Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+	return jwtverifytest.SignRS256(jwtverifytest.PrivateKey(), map[string]any{"alg": "RS256", "typ": "JWT"}, claims)
+}
+
+// sendRequest runs OnHttpRequestHeaders and returns the action, the local
+// response (nil when the request continued) and the resulting headers.
+func sendRequest(host proxytest.HostEmulator, headers [][2]string) (types.Action, *proxytest.LocalHttpResponse, [][2]string) {
+	id := host.InitializeHttpContext()
+	action := host.CallOnRequestHeaders(id, headers, true)
+	return action, host.GetSentLocalResponse(id), host.GetCurrentRequestHeaders(id)
+}
+
+func bearerHeaders(token string) [][2]string {
+	return [][2]string{{":path", "/"}, {headerAuth, bearerPrefix + token}}
+}
+
+func headerValue(headers [][2]string, key string) (string, bool) {
+	for _, h := range headers {
+		if h[0] == key {
+			return h[1], true
+		}
+	}
+	return "", false
+}
+
+func assertDenied(t *testing.T, action types.Action, resp *proxytest.LocalHttpResponse, status uint32, body string) {
+	t.Helper()
+	if action != types.ActionPause || resp == nil {
+		t.Fatalf("action = %v, local response = %v, want denial", action, resp)
+	}
+	if resp.StatusCode != status || string(resp.Data) != body {
+		t.Fatalf("local response = %d %q, want %d %q", resp.StatusCode, resp.Data, status, body)
+	}
+}
+
+func assertAllowed(t *testing.T, action types.Action, resp *proxytest.LocalHttpResponse, headers [][2]string, uid string) {
+	t.Helper()
+	if action != types.ActionContinue || resp != nil {
+		t.Fatalf("action = %v, local response = %v, want continue", action, resp)
+	}
+	if got, _ := headerValue(headers, headerUID); got != uid {
+		t.Errorf("%s = %q, want %q", headerUID, got, uid)
+	}
+}
+
+func TestOnHttpRequestHeadersTimeClaims(t *testing.T) {
+	tests := []struct {
+		name       string
+		leeway     int
+		requireExp bool
+		claims     map[string]any
+		wantReason string
+	}{
+		{name: "expired", claims: map[string]any{"exp": jwtverifytest.Now.Add(-10 * time.Second).Unix()}, wantReason: "token is expired"},
+		{name: "expired within leeway", leeway: 30, claims: map[string]any{"exp": jwtverifytest.Now.Add(-10 * time.Second).Unix()}},
+		{name: "expired beyond leeway", leeway: 5, claims: map[string]any{"exp": jwtverifytest.Now.Add(-10 * time.Second).Unix()}, wantReason: "token is expired"},
+		{name: "not yet valid", claims: map[string]any{"nbf": jwtverifytest.Now.Add(time.Minute).Unix()}, wantReason: "token is not valid yet"},
+		{name: "not yet valid within leeway", leeway: 60, claims: map[string]any{"nbf": jwtverifytest.Now.Add(time.Minute).Unix()}},
+		{name: "issued in the future", claims: map[string]any{"iat": jwtverifytest.Now.Add(time.Hour).Unix()}, wantReason: "token is issued in the future"},
+		{name: "missing exp allowed", claims: map[string]any{"exp": nil}},
+		{name: "missing exp required", requireExp: true, claims: map[string]any{"exp": nil}, wantReason: "token expiration is missing"},
+		{name: "valid with exp required", requireExp: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.LeewaySeconds = tc.leeway
+			cfg.RequireExp = tc.requireExp
+			host := startPlugin(t, cfg)
+
+			action, resp, headers := sendRequest(host, bearerHeaders(signClaims(tc.claims)))
+			if tc.wantReason != "" {
+				assertDenied(t, action, resp, 403, "denied: "+tc.wantReason)
+				return
+			}
+			assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+		})
+	}
+}
+
+// stub replaces *target with value for the duration of the test.
+func stub[T any](t *testing.T, target *T, value T) {
+	t.Helper()
+	orig := *target
+	*target = value
+	t.Cleanup(func() { *target = orig })
+}
+
+func TestOnHttpRequestHeadersAuthorizationHeader(t *testing.T) {
+	token := signClaims(nil)
+	tests := []struct {
+		name       string
+		headers    [][2]string
+		wantReason string
+	}{
+		{name: "missing", headers: [][2]string{{":path", "/"}}, wantReason: "authorization header is missing"},
+		{name: "empty value", headers: [][2]string{{":path", "/"}, {headerAuth, ""}}, wantReason: "authorization header is missing"},
+		{name: "blank value", headers: [][2]string{{":path", "/"}, {headerAuth, "   "}}, wantReason: "authorization header is missing"},
+		{name: "basic scheme", headers: [][2]string{{":path", "/"}, {headerAuth, "Basic dXNlcjpwYXNz"}}, wantReason: "authorization header is invalid"},
+		{name: "lower-case scheme", headers: [][2]string{{":path", "/"}, {headerAuth, "bearer " + token}}, wantReason: "authorization header is invalid"},
+		{name: "scheme without token", headers: [][2]string{{":path", "/"}, {headerAuth, "Bearer "}}, wantReason: "authorization header is invalid"},
+		{name: "malformed token", headers: [][2]string{{":path", "/"}, {headerAuth, "Bearer x"}}, wantReason: "token format is invalid"},
+		{name: "canonical header name", headers: [][2]string{{":path", "/"}, {"Authorization", bearerPrefix + token}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			host := startPlugin(t, testConfig())
+			action, resp, headers := sendRequest(host, tc.headers)
+			if tc.wantReason != "" {
+				assertDenied(t, action, resp, 403, "denied: "+tc.wantReason)
+				if _, ok := headerValue(headers, headerUID); ok {
+					t.Errorf("%s was set on a denied request", headerUID)
+				}
+				return
+			}
+			assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+		})
+	}
+}
+
+func TestOnHttpRequestHeadersDeniedResponse(t *testing.T) {
+	host := startPlugin(t, testConfig())
+	action, resp, _ := sendRequest(host, [][2]string{{":path", "/"}})
+	assertDenied(t, action, resp, 403, "denied: authorization header is missing")
+	if got, _ := headerValue(resp.Headers, "content-type"); got != "text/plain" {
+		t.Errorf("content-type = %q, want text/plain", got)
+	}
+}
+
+func TestOnHttpRequestHeadersLookupFailure(t *testing.T) {
+	stub(t, &getRequestHeader, func(string) (string, error) { return "", types.ErrorStatusBadArgument })
+	host := startPlugin(t, testConfig())
+
+	action, resp, _ := sendRequest(host, bearerHeaders(signClaims(nil)))
+	assertDenied(t, action, resp, 403, "denied: authorization header lookup failed")
+	assertLogged(t, host.GetWarnLogs(), "authorization header lookup failed")
+}
+
+func TestOnHttpRequestHeadersUIDHeader(t *testing.T) {
+	notFound := func(string, string) error { return types.ErrorStatusNotFound }
+	tests := []struct {
+		name    string
+		headers [][2]string
+		replace func(string, string) error
+		add     func(string, string) error
+		wantUID string
+		wantLog string
+	}{
+		{name: "added when absent", wantUID: jwtverifytest.Subject},
+		{name: "client value replaced", headers: [][2]string{{headerUID, "spoofed"}}, wantUID: jwtverifytest.Subject},
+		{name: "client value with other case replaced", headers: [][2]string{{"X-Uid", "spoofed"}}, wantUID: jwtverifytest.Subject},
+		{name: "added when replace reports not found", replace: notFound, wantUID: jwtverifytest.Subject},
+		{
+			name:    "add failure continues without uid",
+			replace: notFound,
+			add:     func(string, string) error { return types.ErrorStatusBadArgument },
+			wantLog: "add x-uid header failed",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.replace != nil {
+				stub(t, &replaceRequestHeader, tc.replace)
+			}
+			if tc.add != nil {
+				stub(t, &addRequestHeader, tc.add)
+			}
+			host := startPlugin(t, testConfig())
+
+			action, resp, headers := sendRequest(host, append(bearerHeaders(signClaims(nil)), tc.headers...))
+			if action != types.ActionContinue || resp != nil {
+				t.Fatalf("action = %v, local response = %v, want continue", action, resp)
+			}
+			var uids []string
+			for _, h := range headers {
+				if h[0] == headerUID {
+					uids = append(uids, h[1])
+				}
+			}
+			switch {
+			case tc.wantUID == "" && len(uids) != 0:
+				t.Errorf("%s = %v, want none", headerUID, uids)
+			case tc.wantUID != "" && (len(uids) != 1 || uids[0] != tc.wantUID):
+				t.Errorf("%s = %v, want [%s]", headerUID, uids, tc.wantUID)
+			}
+			if tc.wantLog != "" {
+				assertLogged(t, host.GetWarnLogs(), tc.wantLog)
+			}
+		})
+	}
+}
+
+func TestOnHttpRequestHeadersReplaceFailureDenies(t *testing.T) {
+	stub(t, &replaceRequestHeader, func(string, string) error { return types.ErrorStatusBadArgument })
+	host := startPlugin(t, testConfig())
+
+	headers := append(bearerHeaders(signClaims(nil)), [2]string{headerUID, "spoofed"})
+	action, resp, _ := sendRequest(host, headers)
+	assertDenied(t, action, resp, 403, "denied: x-uid header could not be set")
+	assertLogged(t, host.GetWarnLogs(), "set x-uid header failed")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm"
+)
+
+// defaultMetricPrefix is prepended to every metric name unless
+// metric_prefix is configured.
+const defaultMetricPrefix = "wasm_jwt."
+
+// metrics are the plugin's host metrics. Denials are counted in total and
+// per reason; the reason metric is defined on first use.
+type metrics struct {
+	prefix    string
+	allowed   proxywasm.MetricCounter
+	anonymous proxywasm.MetricCounter
+	denied    proxywasm.MetricCounter
+	reasons   map[string]proxywasm.MetricCounter
+	duration  proxywasm.MetricHistogram
+
+	cacheHits      proxywasm.MetricCounter
+	cacheMisses    proxywasm.MetricCounter
+	cacheConflicts proxywasm.MetricCounter
+
+	rateLimitedRequests proxywasm.MetricCounter
+	rateLimitConflicts  proxywasm.MetricCounter
+}
+
+func newMetrics(prefix string) *metrics {
+	return &metrics{
+		prefix:    prefix,
+		allowed:   proxywasm.DefineCounterMetric(prefix + "requests_allowed_total"),
+		anonymous: proxywasm.DefineCounterMetric(prefix + "requests_anonymous_total"),
+		denied:    proxywasm.DefineCounterMetric(prefix + "requests_denied_total"),
+		reasons:   make(map[string]proxywasm.MetricCounter),
+		duration:  proxywasm.DefineHistogramMetric(prefix + "verify_duration_us"),
+
+		cacheHits:      proxywasm.DefineCounterMetric(prefix + "token_cache_hits_total"),
+		cacheMisses:    proxywasm.DefineCounterMetric(prefix + "token_cache_misses_total"),
+		cacheConflicts: proxywasm.DefineCounterMetric(prefix + "token_cache_conflicts_total"),
+
+		rateLimitedRequests: proxywasm.DefineCounterMetric(prefix + "requests_rate_limited_total"),
+		rateLimitConflicts:  proxywasm.DefineCounterMetric(prefix + "rate_limit_conflicts_total"),
+	}
+}
+
+func validateMetricPrefix(prefix string) error {
+	for _, r := range prefix {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.') {
+			return errors.New("metric_prefix may only contain letters, digits, '_' and '.'")
+		}
+	}
+	return nil
+}
+
+func (m *metrics) allow() {
+	m.allowed.Increment(1)
+}
+
+func (m *metrics) allowAnonymous() {
+	m.anonymous.Increment(1)
+}
+
+// deny counts a denial. reason is the denial body without the "denied: "
+// prefix, e.g. "token is expired" -> <prefix>requests_denied_total.reason.token_is_expired.
+func (m *metrics) deny(reason string) {
+	m.denied.Increment(1)
+	slug := metricSlug(reason)
+	counter, ok := m.reasons[slug]
+	if !ok {
+		counter = proxywasm.DefineCounterMetric(m.prefix + "requests_denied_total.reason." + slug)
+		m.reasons[slug] = counter
+	}
+	counter.Increment(1)
+}
+
+func (m *metrics) recordVerification(d time.Duration) {
+	m.duration.Record(uint64(d.Microseconds()))
+}
+
+func (m *metrics) cacheHit() {
+	m.cacheHits.Increment(1)
+}
+
+func (m *metrics) cacheMiss() {
+	m.cacheMisses.Increment(1)
+}
+
+func (m *metrics) cacheConflict() {
+	m.cacheConflicts.Increment(1)
+}
+
+func (m *metrics) rateLimited() {
+	m.rateLimitedRequests.Increment(1)
+}
+
+func (m *metrics) rateLimitConflict() {
+	m.rateLimitConflicts.Increment(1)
+}
+
+func metricSlug(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, s)
+}
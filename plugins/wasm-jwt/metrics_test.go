@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/proxytest"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func assertCounter(t *testing.T, host proxytest.HostEmulator, name string, want uint64) {
+	t.Helper()
+	got, err := host.GetCounterMetric(name)
+	if err != nil {
+		t.Errorf("GetCounterMetric(%q) error = %v", name, err)
+		return
+	}
+	if got != want {
+		t.Errorf("%s = %d, want %d", name, got, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix *string
+		want   string
+	}{
+		{name: "default prefix", want: defaultMetricPrefix},
+		{name: "configured prefix", prefix: ptr("lb3.authn."), want: "lb3.authn."},
+		{name: "empty prefix", prefix: ptr(""), want: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MetricPrefix = tc.prefix
+			host := startPlugin(t, cfg)
+
+			sendRequest(host, bearerHeaders(signClaims(nil)))
+			sendRequest(host, bearerHeaders(signClaims(nil)))
+			sendRequest(host, bearerHeaders(signClaims(map[string]any{"exp": jwtverifytest.Now.Add(-time.Minute).Unix()})))
+			sendRequest(host, [][2]string{{":path", "/"}})
+
+			assertCounter(t, host, tc.want+"requests_allowed_total", 2)
+			assertCounter(t, host, tc.want+"requests_denied_total", 2)
+			assertCounter(t, host, tc.want+"requests_denied_total.reason.token_is_expired", 1)
+			assertCounter(t, host, tc.want+"requests_denied_total.reason.authorization_header_is_missing", 1)
+			if _, err := host.GetHistogramMetric(tc.want + "verify_duration_us"); err != nil {
+				t.Errorf("verification duration histogram: %v", err)
+			}
+		})
+	}
+}
+
+func TestMetricsWithPermissiveInvalidConfig(t *testing.T) {
+	host := startPlugin(t, map[string]any{"start_mode": startModePermissive, "metric_prefix": "lb3."})
+	sendRequest(host, bearerHeaders(signClaims(nil)))
+
+	assertCounter(t, host, defaultMetricPrefix+"requests_denied_total.reason.plugin_config_is_invalid", 1)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+const (
+	headerRetryAfter         = "retry-after"
+	headerRateLimitLimit     = "x-ratelimit-limit"
+	headerRateLimitRemaining = "x-ratelimit-remaining"
+	headerRateLimitReset     = "x-ratelimit-reset"
+
+	defaultRateLimitSlots = 4096
+	maxRateLimitSlots     = 1 << 16
+	// rateLimitCASAttempts bounds the read-modify-write retries when other
+	// VMs update the same bucket concurrently.
+	rateLimitCASAttempts = 8
+)
+
+// rawRateLimitRule is a rate_limits entry: a token bucket per verified
+// subject on paths starting with prefix (longest prefix wins).
+type rawRateLimitRule struct {
+	Prefix            string  `json:"prefix"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+type rateLimitRule struct {
+	index  int
+	prefix string
+	rate   float64
+	burst  float64
+}
+
+// rateLimiter keeps per-subject token buckets in shared data, so the limit
+// applies across worker VMs. Buckets are read and written with CAS and the
+// update is retried when another VM changed the bucket in between.
+//
+// Like the token cache, buckets are direct-mapped: a subject hashes to one
+// of slots keys per rule. A subject mapping to the slot of another subject
+// whose bucket has not refilled yet shares that bucket, so a collision can
+// limit a subject early but never lets it exceed its own limit.
+type rateLimiter struct {
+	prefix  string
+	slots   uint32
+	rules   []rateLimitRule
+	metrics *metrics
+}
+
+// rateLimitBucket is encoded as subject hash (32 bytes) | tokens (float64
+// bits) | last refill unix nanoseconds (int64).
+type rateLimitBucket struct {
+	hash   [sha256.Size]byte
+	tokens float64
+	last   int64
+}
+
+const rateLimitBucketSize = sha256.Size + 8 + 8
+
+// rateLimited describes a request that exceeded its bucket.
+type rateLimited struct {
+	limit      int
+	retryAfter time.Duration
+}
+
+func newRateLimiter(rawConfig []byte, cfg rawConfig, m *metrics) (*rateLimiter, error) {
+	slots := defaultRateLimitSlots
+	if cfg.RateLimitSlots != 0 {
+		slots = cfg.RateLimitSlots
+	}
+	if slots < 1 || slots > maxRateLimitSlots {
+		return nil, fmt.Errorf("rate_limit_slots must be between 1 and %d", maxRateLimitSlots)
+	}
+	if len(cfg.RateLimits) == 0 {
+		return nil, nil
+	}
+	sum := sha256.Sum256(rawConfig)
+	l := &rateLimiter{
+		prefix:  "wasm-jwt/ratelimit/" + hex.EncodeToString(sum[:6]) + "/",
+		slots:   uint32(slots),
+		metrics: m,
+	}
+	for i, r := range cfg.RateLimits {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, fmt.Errorf("rate_limits[%d]: prefix must start with /", i)
+		}
+		if r.RequestsPerSecond <= 0 || r.Burst <= 0 {
+			return nil, fmt.Errorf("rate_limits[%d]: requests_per_second and burst must be positive", i)
+		}
+		l.rules = append(l.rules, rateLimitRule{index: i, prefix: r.Prefix, rate: r.RequestsPerSecond, burst: float64(r.Burst)})
+	}
+	sort.SliceStable(l.rules, func(i, j int) bool { return len(l.rules[i].prefix) > len(l.rules[j].prefix) })
+	return l, nil
+}
+
+func (l *rateLimiter) ruleFor(path string) *rateLimitRule {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	for i := range l.rules {
+		if strings.HasPrefix(path, l.rules[i].prefix) {
+			return &l.rules[i]
+		}
+	}
+	return nil
+}
+
+func (l *rateLimiter) bucketKey(rule *rateLimitRule, hash [sha256.Size]byte) string {
+	return fmt.Sprintf("%s%d/%d", l.prefix, rule.index, binary.BigEndian.Uint32(hash[:4])%l.slots)
+}
+
+// allow takes a token from subject's bucket for the current request. Paths
+// without a rule are not limited. When the bucket cannot be updated (shared
+// data errors or CAS retries exhausted) the request is allowed.
+func (l *rateLimiter) allow(subject string) *rateLimited {
+	if l == nil {
+		return nil
+	}
+	path, _ := getRequestHeader(":path")
+	rule := l.ruleFor(path)
+	if rule == nil {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(subject))
+	key := l.bucketKey(rule, hash)
+	for attempt := 0; attempt < rateLimitCASAttempts; attempt++ {
+		data, cas, err := proxywasm.GetSharedData(key)
+		if err != nil && !errors.Is(err, types.ErrorStatusNotFound) {
+			proxywasm.LogWarnf("read rate limit bucket failed: %v", err)
+			return nil
+		}
+		bucket, limited := rule.take(data, hash, now())
+		if limited != nil {
+			l.metrics.rateLimited()
+			return limited
+		}
+		err = proxywasm.SetSharedData(key, bucket.encode(), cas)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, types.ErrorStatusCasMismatch) {
+			proxywasm.LogWarnf("write rate limit bucket failed: %v", err)
+			return nil
+		}
+		l.metrics.rateLimitConflict()
+	}
+	proxywasm.LogWarnf("rate limit bucket %s is contended, allowing request", key)
+	return nil
+}
+
+// take refills the stored bucket up to now and takes one token. A missing,
+// invalid or idle bucket of another subject starts full.
+func (r *rateLimitRule) take(data []byte, hash [sha256.Size]byte, current time.Time) (rateLimitBucket, *rateLimited) {
+	nowNano := current.UnixNano()
+	bucket, ok := decodeRateLimitBucket(data)
+	if ok {
+		if elapsed := float64(nowNano-bucket.last) / float64(time.Second); elapsed > 0 {
+			bucket.tokens = math.Min(r.burst, bucket.tokens+elapsed*r.rate)
+			bucket.last = nowNano
+		}
+	}
+	if !ok || bucket.hash != hash && bucket.tokens >= r.burst {
+		bucket = rateLimitBucket{hash: hash, tokens: r.burst, last: nowNano}
+	}
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / r.rate * float64(time.Second))
+		return bucket, &rateLimited{limit: int(r.burst), retryAfter: wait}
+	}
+	bucket.tokens--
+	return bucket, nil
+}
+
+func (b rateLimitBucket) encode() []byte {
+	buf := make([]byte, rateLimitBucketSize)
+	copy(buf, b.hash[:])
+	binary.BigEndian.PutUint64(buf[sha256.Size:], math.Float64bits(b.tokens))
+	binary.BigEndian.PutUint64(buf[sha256.Size+8:], uint64(b.last))
+	return buf
+}
+
+func decodeRateLimitBucket(data []byte) (rateLimitBucket, bool) {
+	if len(data) != rateLimitBucketSize {
+		return rateLimitBucket{}, false
+	}
+	var b rateLimitBucket
+	copy(b.hash[:], data)
+	b.tokens = math.Float64frombits(binary.BigEndian.Uint64(data[sha256.Size:]))
+	b.last = int64(binary.BigEndian.Uint64(data[sha256.Size+8:]))
+	return b, true
+}
+
+// headers returns the Retry-After and x-ratelimit-* response headers, the
+// same set callout-server sends. Both Retry-After and the reset value are
+// whole seconds, rounded up.
+func (r *rateLimited) headers() [][2]string {
+	seconds := strconv.Itoa(int(math.Ceil(r.retryAfter.Seconds())))
+	return [][2]string{
+		{headerRetryAfter, seconds},
+		{headerRateLimitLimit, strconv.Itoa(r.limit)},
+		{headerRateLimitRemaining, "0"},
+		{headerRateLimitReset, seconds},
+	}
+}
+
+func (ctx *httpContext) rateLimit(limited *rateLimited) types.Action {
+	ctx.decision = "rate_limited"
+	_ = proxywasm.SendHttpResponse(429,
+		ctx.localResponseHeaders(limited.headers()...),
+		[]byte("rate limit exceeded"),
+		-1,
+	)
+	return types.ActionPause
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func rateLimitConfig() rawConfig {
+	cfg := anonymousConfig()
+	cfg.RateLimits = []rawRateLimitRule{
+		{Prefix: "/", RequestsPerSecond: 100, Burst: 100},
+		{Prefix: "/api/", RequestsPerSecond: 0.5, Burst: 2},
+	}
+	return cfg
+}
+
+func pathRequest(path, token string) [][2]string {
+	return [][2]string{{":method", "GET"}, {":path", path}, {headerAuth, bearerPrefix + token}}
+}
+
+func assertRateLimited(t *testing.T, action types.Action, resp *proxytest.LocalHttpResponse, retryAfter string) {
+	t.Helper()
+	assertDenied(t, action, resp, 429, "rate limit exceeded")
+	assertHeader(t, resp.Headers, headerRetryAfter, retryAfter)
+	assertHeader(t, resp.Headers, headerRateLimitLimit, "2")
+	assertHeader(t, resp.Headers, headerRateLimitRemaining, "0")
+	assertHeader(t, resp.Headers, headerRateLimitReset, retryAfter)
+}
+
+func TestRateLimit(t *testing.T) {
+	host := startPlugin(t, rateLimitConfig())
+	token := signClaims(nil)
+
+	for range 2 {
+		action, resp, headers := sendRequest(host, pathRequest("/api/users", token))
+		assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+	}
+	action, resp, _ := sendRequest(host, pathRequest("/api/users?page=2", token))
+	assertRateLimited(t, action, resp, "2")
+
+	// Another subject has its own bucket; another route its own rule.
+	other := signClaims(map[string]any{"sub": "other-user"})
+	action, resp, headers := sendRequest(host, pathRequest("/api/users", other))
+	assertAllowed(t, action, resp, headers, "other-user")
+	action, resp, headers = sendRequest(host, pathRequest("/home", token))
+	assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+
+	// Half a second refills a quarter token: still limited, 1.5s to go.
+	setNow(500 * time.Millisecond)
+	action, resp, _ = sendRequest(host, pathRequest("/api/users", token))
+	assertRateLimited(t, action, resp, "2")
+	setNow(1500 * time.Millisecond)
+	action, resp, _ = sendRequest(host, pathRequest("/api/users", token))
+	assertRateLimited(t, action, resp, "1")
+
+	setNow(2 * time.Second)
+	action, resp, headers = sendRequest(host, pathRequest("/api/users", token))
+	assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+	action, resp, _ = sendRequest(host, pathRequest("/api/users", token))
+	assertRateLimited(t, action, resp, "2")
+
+	assertCounter(t, host, defaultMetricPrefix+"requests_rate_limited_total", 4)
+	assertCounter(t, host, defaultMetricPrefix+"requests_allowed_total", 5)
+	assertCounter(t, host, defaultMetricPrefix+"requests_denied_total", 0)
+}
+
+func TestRateLimitSkipsUnlimitedRequests(t *testing.T) {
+	cfg := rateLimitConfig()
+	cfg.RateLimits = cfg.RateLimits[1:]
+	host := startPlugin(t, cfg)
+	token := signClaims(nil)
+
+	for range 5 {
+		action, resp, headers := sendRequest(host, pathRequest("/home", token))
+		assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+		action, resp, headers = sendRequest(host, [][2]string{{":method", "GET"}, {":path", "/healthz"}})
+		assertAnonymous(t, action, resp, headers, defaultAnonymousHeader)
+	}
+	// Denied requests do not take tokens.
+	for range 5 {
+		action, resp, _ := sendRequest(host, pathRequest("/api/users", "invalid"))
+		assertDenied(t, action, resp, 403, "denied: token format is invalid")
+	}
+	action, resp, headers := sendRequest(host, pathRequest("/api/users", token))
+	assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+}
+
+func TestRateLimitResponseHeaders(t *testing.T) {
+	cfg := rateLimitConfig()
+	cfg.SecurityHeaders = map[string]string{"x-content-type-options": "nosniff"}
+	host := startPlugin(t, cfg)
+	token := signClaims(nil)
+	for range 2 {
+		sendRequest(host, pathRequest("/api/users", token))
+	}
+	resp, got := sendExchange(host, append(pathRequest("/api/users", token), [2]string{defaultDebugHeader, "1"}), nil)
+	if resp == nil || resp.StatusCode != 429 {
+		t.Fatalf("local response = %v, want 429", resp)
+	}
+	assertHeader(t, got, "x-content-type-options", "nosniff")
+	assertHeader(t, got, headerAuthDecision, "rate_limited")
+}
+
+func TestRateLimitSharedAcrossVMs(t *testing.T) {
+	cfg := rateLimitConfig()
+	raw := mustMarshal(t, cfg)
+	host := newHost(t, raw)
+	if status := host.StartPlugin(); status != types.OnPluginStartStatusOK {
+		t.Fatalf("StartPlugin() = %v", status)
+	}
+
+	// Another worker VM took the last token of the subject's bucket.
+	limiter, err := newRateLimiter(raw, cfg, nil)
+	if err != nil {
+		t.Fatalf("newRateLimiter() error = %v", err)
+	}
+	bucket := rateLimitBucket{hash: sha256.Sum256([]byte(jwtverifytest.Subject)), tokens: 0, last: jwtverifytest.Now.UnixNano()}
+	key := limiter.bucketKey(limiter.ruleFor("/api/"), bucket.hash)
+	if err := proxywasm.SetSharedData(key, bucket.encode(), 0); err != nil {
+		t.Fatalf("SetSharedData() error = %v", err)
+	}
+
+	action, resp, _ := sendRequest(host, pathRequest("/api/users", signClaims(nil)))
+	assertRateLimited(t, action, resp, "2")
+}
+
+func TestRateLimitBucketCollision(t *testing.T) {
+	rule := rateLimitRule{rate: 1, burst: 2}
+	owner := sha256.Sum256([]byte("owner"))
+	other := sha256.Sum256([]byte("other"))
+	start := jwtverifytest.Now
+
+	// An active bucket of another subject is shared.
+	active := rateLimitBucket{hash: owner, tokens: 0.5, last: start.UnixNano()}
+	if _, limited := rule.take(active.encode(), other, start); limited == nil {
+		t.Error("take() on another subject's active bucket was allowed")
+	}
+	// An idle (refilled) bucket is taken over.
+	bucket, limited := rule.take(active.encode(), other, start.Add(2*time.Second))
+	if limited != nil || bucket.hash != other || bucket.tokens != 1 {
+		t.Errorf("take() on an idle bucket = %+v, %v, want a new bucket with 1 token", bucket, limited)
+	}
+	// Garbage in shared data starts a full bucket.
+	if bucket, limited := rule.take([]byte("junk"), owner, start); limited != nil || bucket.tokens != 1 {
+		t.Errorf("take() on invalid data = %+v, %v", bucket, limited)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+)
+
+const (
+	defaultJWKSPath    = "/.well-known/jwks.json"
+	defaultJWKSRefresh = 5 * time.Minute
+	defaultJWKSTimeout = 5 * time.Second
+	// jwksRetryPeriod is the tick period used after a failed fetch until the
+	// next fetch succeeds.
+	jwksRetryPeriod = 10 * time.Second
+	// maxJWKSSize bounds the JWKS response body read from the host.
+	maxJWKSSize = 1 << 20
+)
+
+// remoteJWKS fetches a JWKS from an upstream cluster and publishes it in
+// shared data, so every worker VM verifies with the same key set. Only a
+// response that parses as a JWKS replaces the shared value; on failure the
+// last good set stays in use.
+type remoteJWKS struct {
+	cluster   string
+	authority string
+	path      string
+	refresh   time.Duration
+	timeout   time.Duration
+	sharedKey string
+
+	fetching bool
+	failing  bool
+
+	// cas and cached are the shared value this VM last built a verifier
+	// from; the verifier is rebuilt when another VM stores a new set.
+	cas    uint32
+	cached *jwtverify.Verifier
+}
+
+func newRemoteJWKS(cfg rawConfig) (*remoteJWKS, error) {
+	if cfg.JWKSCluster == "" {
+		if cfg.JWKSAuthority != "" || cfg.JWKSPath != "" || cfg.JWKSRefreshSeconds != 0 || cfg.JWKSTimeoutMillis != 0 {
+			return nil, errors.New("jwks_cluster is required for remote JWKS options")
+		}
+		return nil, nil
+	}
+	if cfg.JWKSRefreshSeconds < 0 {
+		return nil, errors.New("jwks_refresh_seconds must not be negative")
+	}
+	if cfg.JWKSTimeoutMillis < 0 {
+		return nil, errors.New("jwks_timeout_ms must not be negative")
+	}
+	r := &remoteJWKS{
+		cluster:   cfg.JWKSCluster,
+		authority: cfg.JWKSAuthority,
+		path:      cfg.JWKSPath,
+		refresh:   time.Duration(cfg.JWKSRefreshSeconds) * time.Second,
+		timeout:   time.Duration(cfg.JWKSTimeoutMillis) * time.Millisecond,
+	}
+	if r.authority == "" {
+		r.authority = r.cluster
+	}
+	if r.path == "" {
+		r.path = defaultJWKSPath
+	}
+	if r.refresh == 0 {
+		r.refresh = defaultJWKSRefresh
+	}
+	if r.timeout == 0 {
+		r.timeout = defaultJWKSTimeout
+	}
+	r.sharedKey = "wasm-jwt/jwks/" + r.cluster + "/" + r.authority + r.path
+	return r, nil
+}
+
+// fetch dispatches a JWKS request unless one is already in flight.
+func (r *remoteJWKS) fetch() {
+	if r.fetching {
+		return
+	}
+	headers := [][2]string{
+		{":method", "GET"},
+		{":path", r.path},
+		{":authority", r.authority},
+		{"accept", "application/json"},
+	}
+	if _, err := proxywasm.DispatchHttpCall(r.cluster, headers, nil, nil, uint32(r.timeout.Milliseconds()), r.onResponse); err != nil {
+		r.fetchFailed(fmt.Errorf("dispatch to %s: %w", r.cluster, err))
+		return
+	}
+	r.fetching = true
+}
+
+func (r *remoteJWKS) onResponse(numHeaders, bodySize, numTrailers int) {
+	r.fetching = false
+	data, err := readJWKSResponse(bodySize)
+	if err != nil {
+		r.fetchFailed(err)
+		return
+	}
+	keys, err := jwtverify.ParseJWKS(data)
+	if err != nil {
+		r.fetchFailed(err)
+		return
+	}
+	if err := r.store(data); err != nil {
+		r.fetchFailed(err)
+		return
+	}
+	proxywasm.LogInfof("fetched JWKS from %s%s: %d keys", r.authority, r.path, len(keys))
+	if r.failing {
+		r.failing = false
+		r.setTickPeriod(r.refresh)
+	}
+}
+
+func readJWKSResponse(bodySize int) ([]byte, error) {
+	headers, err := proxywasm.GetHttpCallResponseHeaders()
+	if err != nil {
+		return nil, fmt.Errorf("read response headers: %w", err)
+	}
+	status := ""
+	for _, h := range headers {
+		if h[0] == ":status" {
+			status = h[1]
+		}
+	}
+	if status != "200" {
+		return nil, fmt.Errorf("unexpected status %q", status)
+	}
+	if bodySize == 0 {
+		return nil, errors.New("empty response body")
+	}
+	if bodySize > maxJWKSSize {
+		return nil, fmt.Errorf("response body is too large (%d bytes)", bodySize)
+	}
+	body, err := proxywasm.GetHttpCallResponseBody(0, bodySize)
+	if err != nil {
+		return nil, fmt.Errorf("read response body: %w", err)
+	}
+	return body, nil
+}
+
+// store publishes data in shared data. An unchanged set is not written
+// again, since a new CAS would flush the token caches keyed on it. A CAS
+// mismatch means another VM stored a set concurrently; its value is kept.
+func (r *remoteJWKS) store(data []byte) error {
+	current, cas, err := proxywasm.GetSharedData(r.sharedKey)
+	if err != nil && !errors.Is(err, types.ErrorStatusNotFound) {
+		return fmt.Errorf("read shared data: %w", err)
+	}
+	if err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	if err := proxywasm.SetSharedData(r.sharedKey, data, cas); err != nil && !errors.Is(err, types.ErrorStatusCasMismatch) {
+		return fmt.Errorf("store shared data: %w", err)
+	}
+	return nil
+}
+
+func (r *remoteJWKS) fetchFailed(err error) {
+	proxywasm.LogWarnf("JWKS fetch failed, keeping last good key set: %v", err)
+	if !r.failing {
+		r.failing = true
+		r.setTickPeriod(jwksRetryPeriod)
+	}
+}
+
+func (r *remoteJWKS) setTickPeriod(period time.Duration) {
+	if err := proxywasm.SetTickPeriodMilliSeconds(uint32(period.Milliseconds())); err != nil {
+		proxywasm.LogWarnf("set tick period failed: %v", err)
+	}
+}
+
+// verifier returns a verifier for static plus the shared JWKS, or nil when
+// no JWKS has been stored yet.
+func (r *remoteJWKS) verifier(static []jwtverify.Key, opts jwtverify.Options) *jwtverify.Verifier {
+	data, cas, err := proxywasm.GetSharedData(r.sharedKey)
+	if err != nil {
+		if !errors.Is(err, types.ErrorStatusNotFound) {
+			proxywasm.LogWarnf("read shared JWKS failed: %v", err)
+		}
+		return r.cached
+	}
+	if r.cached != nil && cas == r.cas {
+		return r.cached
+	}
+	keys, err := jwtverify.ParseJWKS(data)
+	if err != nil {
+		proxywasm.LogWarnf("shared JWKS is invalid: %v", err)
+		return r.cached
+	}
+	all := make([]jwtverify.Key, 0, len(static)+len(keys))
+	all = append(append(all, static...), keys...)
+	verifier, err := jwtverify.NewVerifier(all, opts)
+	if err != nil {
+		proxywasm.LogWarnf("shared JWKS is invalid: %v", err)
+		return r.cached
+	}
+	r.cas, r.cached = cas, verifier
+	return verifier
+}
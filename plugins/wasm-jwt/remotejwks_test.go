@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/proxytest"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func remoteConfig() rawConfig {
+	return rawConfig{
+		SchemaVersion:      configSchemaVersion,
+		JWKSCluster:        "outbound|443||issuer.example.com",
+		JWKSAuthority:      "issuer.example.com",
+		JWKSRefreshSeconds: 60,
+	}
+}
+
+func jwksBody(t *testing.T, keys ...map[string]any) []byte {
+	t.Helper()
+	return mustMarshal(t, map[string]any{"keys": keys})
+}
+
+// lastCallout returns the most recent JWKS request dispatched by the plugin
+// context.
+func lastCallout(t *testing.T, host proxytest.HostEmulator) proxytest.HttpCalloutAttribute {
+	t.Helper()
+	callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+	if len(callouts) == 0 {
+		t.Fatal("no JWKS request was dispatched")
+	}
+	return callouts[len(callouts)-1]
+}
+
+func respondJWKS(t *testing.T, host proxytest.HostEmulator, status string, body []byte) {
+	t.Helper()
+	host.CallOnHttpCallResponse(lastCallout(t, host).CalloutID, [][2]string{{":status", status}}, nil, body)
+}
+
+func fixtureJWKS(t *testing.T) []byte {
+	return jwksBody(t, publicJWK(&jwtverifytest.PrivateKey().PublicKey, "fixture"))
+}
+
+func TestRemoteJWKSFetch(t *testing.T) {
+	host := startPlugin(t, remoteConfig())
+
+	if got := host.GetTickPeriod(); got != 60000 {
+		t.Errorf("tick period = %d, want 60000", got)
+	}
+	callout := lastCallout(t, host)
+	if callout.Upstream != "outbound|443||issuer.example.com" {
+		t.Errorf("upstream = %q", callout.Upstream)
+	}
+	for key, want := range map[string]string{":method": "GET", ":path": defaultJWKSPath, ":authority": "issuer.example.com"} {
+		if got, _ := headerValue(callout.Headers, key); got != want {
+			t.Errorf("JWKS request %s = %q, want %q", key, got, want)
+		}
+	}
+
+	action, resp, _ := sendRequest(host, bearerHeaders(signClaims(nil)))
+	assertDenied(t, action, resp, 403, "denied: verification keys are not loaded")
+
+	respondJWKS(t, host, "200", fixtureJWKS(t))
+	action, resp, headers := sendRequest(host, bearerHeaders(signClaims(nil)))
+	assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+	if logs := strings.Join(host.GetInfoLogs(), "\n"); !strings.Contains(logs, "fetched JWKS from issuer.example.com/.well-known/jwks.json: 1 keys") {
+		t.Errorf("fetch was not logged:\n%s", logs)
+	}
+}
+
+func TestRemoteJWKSKeepsLastGoodSet(t *testing.T) {
+	host := startPlugin(t, remoteConfig())
+	respondJWKS(t, host, "200", fixtureJWKS(t))
+
+	failures := []struct {
+		name   string
+		status string
+		body   []byte
+	}{
+		{name: "server error", status: "503", body: []byte("unavailable")},
+		{name: "invalid json", status: "200", body: []byte("{")},
+		{name: "empty key set", status: "200", body: []byte(`{"keys":[]}`)},
+		{name: "timeout", status: ""},
+	}
+	for _, tc := range failures {
+		t.Run(tc.name, func(t *testing.T) {
+			host.Tick()
+			if tc.status == "" {
+				host.CallOnHttpCallResponse(lastCallout(t, host).CalloutID, nil, nil, nil)
+			} else {
+				respondJWKS(t, host, tc.status, tc.body)
+			}
+			if got := host.GetTickPeriod(); got != uint32(jwksRetryPeriod.Milliseconds()) {
+				t.Errorf("tick period after failure = %d, want %d", got, jwksRetryPeriod.Milliseconds())
+			}
+			action, resp, headers := sendRequest(host, bearerHeaders(signClaims(nil)))
+			assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+		})
+	}
+	if len(host.GetWarnLogs()) < len(failures) {
+		t.Errorf("fetch failures were not logged: %v", host.GetWarnLogs())
+	}
+
+	// A successful fetch replaces the set and restores the refresh period.
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	host.Tick()
+	respondJWKS(t, host, "200", jwksBody(t, publicJWK(&rotated.PublicKey, "next")))
+	if got := host.GetTickPeriod(); got != 60000 {
+		t.Errorf("tick period after recovery = %d, want 60000", got)
+	}
+	action, resp, _ := sendRequest(host, bearerHeaders(signClaims(nil)))
+	assertDenied(t, action, resp, 403, "denied: token signature is invalid")
+	token := jwtverifytest.SignRS256(rotated, map[string]any{"alg": "RS256", "kid": "next"}, map[string]any{"sub": jwtverifytest.Subject})
+	action, resp, headers := sendRequest(host, bearerHeaders(token))
+	assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+}
+
+func TestRemoteJWKSSingleFetchInFlight(t *testing.T) {
+	host := startPlugin(t, remoteConfig())
+	host.Tick()
+	host.Tick()
+	if got := len(host.GetCalloutAttributesFromContext(proxytest.PluginContextID)); got != 1 {
+		t.Fatalf("dispatched %d JWKS requests, want 1", got)
+	}
+	respondJWKS(t, host, "200", fixtureJWKS(t))
+	host.Tick()
+	if got := len(host.GetCalloutAttributesFromContext(proxytest.PluginContextID)); got != 2 {
+		t.Fatalf("dispatched %d JWKS requests, want 2", got)
+	}
+}
+
+func TestRemoteJWKSUnchangedSetKeepsCAS(t *testing.T) {
+	cfg := remoteConfig()
+	host := startPlugin(t, cfg)
+	remote, err := newRemoteJWKS(cfg)
+	if err != nil {
+		t.Fatalf("newRemoteJWKS() error = %v", err)
+	}
+	respondJWKS(t, host, "200", fixtureJWKS(t))
+	_, cas, err := proxywasm.GetSharedData(remote.sharedKey)
+	if err != nil {
+		t.Fatalf("GetSharedData() error = %v", err)
+	}
+
+	// The token cache is keyed on the CAS, so a refresh returning the same
+	// set must not bump it.
+	host.Tick()
+	respondJWKS(t, host, "200", fixtureJWKS(t))
+	if _, got, _ := proxywasm.GetSharedData(remote.sharedKey); got != cas {
+		t.Errorf("CAS after an unchanged refresh = %d, want %d", got, cas)
+	}
+	host.Tick()
+	respondJWKS(t, host, "200", jwksBody(t, publicJWK(&jwtverifytest.PrivateKey().PublicKey, "renamed")))
+	if _, got, _ := proxywasm.GetSharedData(remote.sharedKey); got == cas {
+		t.Error("CAS unchanged after a new set was fetched")
+	}
+}
+
+func TestRemoteJWKSSharedAcrossVMs(t *testing.T) {
+	cfg := remoteConfig()
+	host := startPlugin(t, cfg)
+
+	// Another worker VM fetched the set and stored it in shared data.
+	remote, err := newRemoteJWKS(cfg)
+	if err != nil {
+		t.Fatalf("newRemoteJWKS() error = %v", err)
+	}
+	if err := proxywasm.SetSharedData(remote.sharedKey, fixtureJWKS(t), 0); err != nil {
+		t.Fatalf("SetSharedData() error = %v", err)
+	}
+
+	action, resp, headers := sendRequest(host, bearerHeaders(signClaims(nil)))
+	assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+}
+
+func TestRemoteJWKSWithStaticKey(t *testing.T) {
+	cfg := remoteConfig()
+	cfg.PublicKeyPEM = jwtverifytest.PublicKeyPEM()
+	host := startPlugin(t, cfg)
+
+	// The static key is used until the first fetch completes.
+	action, resp, headers := sendRequest(host, bearerHeaders(signClaims(nil)))
+	assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	respondJWKS(t, host, "200", jwksBody(t, publicJWK(&other.PublicKey, "remote")))
+	action, resp, headers = sendRequest(host, bearerHeaders(signClaims(nil)))
+	assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+	token := jwtverifytest.SignRS256(other, map[string]any{"alg": "RS256", "kid": "remote"}, map[string]any{"sub": jwtverifytest.Subject})
+	action, resp, headers = sendRequest(host, bearerHeaders(token))
+	assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+}
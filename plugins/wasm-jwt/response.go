@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+const (
+	defaultDebugHeader = "x-debug"
+	headerAuthDecision = "x-auth-decision"
+	headerAuthLatency  = "x-auth-latency-us"
+)
+
+// Response header hostcalls. Tests replace them to emulate hosts whose
+// replace does not insert a missing header.
+var (
+	replaceResponseHeader = proxywasm.ReplaceHttpResponseHeader
+	addResponseHeader     = proxywasm.AddHttpResponseHeader
+)
+
+// responsePolicy is applied to responses: identity headers the origin
+// echoed are removed, security headers are set, and the authorization
+// decision is reported when the request asked for it with the debug header.
+type responsePolicy struct {
+	strip       []string
+	security    [][2]string
+	debugHeader string
+}
+
+func newResponsePolicy(cfg rawConfig, anonymousHeader string) (*responsePolicy, error) {
+	p := &responsePolicy{
+		strip:       []string{headerUID, anonymousHeader},
+		debugHeader: strings.ToLower(cfg.DebugHeader),
+	}
+	if p.debugHeader == "" {
+		p.debugHeader = defaultDebugHeader
+	}
+	if err := checkHeaderName(p.debugHeader); err != nil {
+		return nil, fmt.Errorf("debug_header: %w", err)
+	}
+	for _, name := range cfg.StripResponseHeaders {
+		name = strings.ToLower(name)
+		if err := checkHeaderName(name); err != nil {
+			return nil, fmt.Errorf("strip_response_headers: %w", err)
+		}
+		p.strip = append(p.strip, name)
+	}
+	for name, value := range cfg.SecurityHeaders {
+		lower := strings.ToLower(name)
+		if err := checkHeaderName(lower); err != nil {
+			return nil, fmt.Errorf("security_headers: %w", err)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("security_headers: %s has an empty value", name)
+		}
+		p.security = append(p.security, [2]string{lower, value})
+	}
+	sort.Slice(p.security, func(i, j int) bool { return p.security[i][0] < p.security[j][0] })
+	return p, nil
+}
+
+func checkHeaderName(name string) error {
+	if name == "" || strings.HasPrefix(name, ":") || strings.ContainsAny(name, " \t\r\n") {
+		return errors.New("invalid header name " + strconv.Quote(name))
+	}
+	return nil
+}
+
+// debugRequested reports whether the request carries the debug header.
+func (p *responsePolicy) debugRequested() bool {
+	if p == nil {
+		return false
+	}
+	value, err := getRequestHeader(p.debugHeader)
+	return err == nil && value != ""
+}
+
+// localResponseHeaders are the headers of a response the plugin sends
+// itself, which does not pass OnHttpResponseHeaders.
+func (ctx *httpContext) localResponseHeaders(extra ...[2]string) [][2]string {
+	headers := append([][2]string{{"content-type", "text/plain"}}, extra...)
+	if p := ctx.state.response; p != nil {
+		headers = append(headers, p.security...)
+	}
+	if ctx.debug {
+		headers = append(headers, ctx.debugHeaders(time.Since(ctx.start))...)
+	}
+	return headers
+}
+
+func (ctx *httpContext) debugHeaders(latency time.Duration) [][2]string {
+	return [][2]string{
+		{headerAuthDecision, ctx.decision},
+		{headerAuthLatency, strconv.FormatInt(latency.Microseconds(), 10)},
+	}
+}
+
+func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool) types.Action {
+	p := ctx.state.response
+	if p == nil {
+		return types.ActionContinue
+	}
+	for _, name := range p.strip {
+		if err := proxywasm.RemoveHttpResponseHeader(name); err != nil && err != types.ErrorStatusNotFound {
+			proxywasm.LogWarnf("remove response header %s failed: %v", name, err)
+		}
+	}
+	headers := p.security
+	if ctx.debug && ctx.decision != "" {
+		headers = append(append([][2]string{}, headers...), ctx.debugHeaders(ctx.latency)...)
+	}
+	for _, h := range headers {
+		setResponseHeader(h[0], h[1])
+	}
+	return types.ActionContinue
+}
+
+// setResponseHeader replaces a response header and adds it when the host
+// reports it missing, like setRequestHeader. Failures are only logged: the
+// response is already authorized.
+func setResponseHeader(name, value string) {
+	err := replaceResponseHeader(name, value)
+	if err == types.ErrorStatusNotFound {
+		err = addResponseHeader(name, value)
+	}
+	if err != nil {
+		proxywasm.LogWarnf("set response header %s failed: %v", name, err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+func responseConfig() rawConfig {
+	cfg := anonymousConfig()
+	cfg.StripResponseHeaders = []string{"X-Internal-Tenant"}
+	cfg.SecurityHeaders = map[string]string{
+		"Strict-Transport-Security": "max-age=31536000",
+		"x-content-type-options":    "nosniff",
+	}
+	return cfg
+}
+
+// sendExchange runs a request and, when it continued, an origin response
+// with originHeaders. It returns the request's local response and the
+// response headers the client receives.
+func sendExchange(host proxytest.HostEmulator, reqHeaders, originHeaders [][2]string) (*proxytest.LocalHttpResponse, [][2]string) {
+	id := host.InitializeHttpContext()
+	if action := host.CallOnRequestHeaders(id, reqHeaders, true); action != types.ActionContinue {
+		resp := host.GetSentLocalResponse(id)
+		return resp, resp.Headers
+	}
+	host.CallOnResponseHeaders(id, originHeaders, false)
+	return nil, host.GetCurrentResponseHeaders(id)
+}
+
+func assertHeader(t *testing.T, headers [][2]string, key, want string) {
+	t.Helper()
+	if got, ok := headerValue(headers, key); !ok || got != want {
+		t.Errorf("%s = %q (present %v), want %q", key, got, ok, want)
+	}
+}
+
+func assertNoHeader(t *testing.T, headers [][2]string, key string) {
+	t.Helper()
+	if got, ok := headerValue(headers, key); ok {
+		t.Errorf("%s = %q, want it removed", key, got)
+	}
+}
+
+func TestOnHttpResponseHeaders(t *testing.T) {
+	origin := [][2]string{
+		{":status", "200"},
+		{headerUID, jwtverifytest.Subject},
+		{defaultAnonymousHeader, "1"},
+		{"x-internal-tenant", "acme"},
+		{"x-content-type-options", "sniff"},
+		{"content-type", "application/json"},
+	}
+	t.Run("identity headers stripped and security headers set", func(t *testing.T) {
+		host := startPlugin(t, responseConfig())
+		resp, got := sendExchange(host, bearerHeaders(signClaims(nil)), origin)
+		if resp != nil {
+			t.Fatalf("local response = %v, want continue", resp)
+		}
+		assertNoHeader(t, got, headerUID)
+		assertNoHeader(t, got, defaultAnonymousHeader)
+		assertNoHeader(t, got, "x-internal-tenant")
+		assertHeader(t, got, "x-content-type-options", "nosniff")
+		assertHeader(t, got, "strict-transport-security", "max-age=31536000")
+		assertHeader(t, got, "content-type", "application/json")
+		assertNoHeader(t, got, headerAuthDecision)
+		assertNoHeader(t, got, headerAuthLatency)
+	})
+	t.Run("default config strips identity headers only", func(t *testing.T) {
+		host := startPlugin(t, testConfig())
+		_, got := sendExchange(host, bearerHeaders(signClaims(nil)), origin)
+		assertNoHeader(t, got, headerUID)
+		assertNoHeader(t, got, defaultAnonymousHeader)
+		assertHeader(t, got, "x-internal-tenant", "acme")
+		assertHeader(t, got, "x-content-type-options", "sniff")
+	})
+	t.Run("custom anonymous header stripped", func(t *testing.T) {
+		cfg := responseConfig()
+		cfg.AnonymousHeader = "x-public"
+		host := startPlugin(t, cfg)
+		_, got := sendExchange(host, bearerHeaders(signClaims(nil)), [][2]string{{":status", "200"}, {"x-public", "1"}})
+		assertNoHeader(t, got, "x-public")
+	})
+	t.Run("security headers on denials", func(t *testing.T) {
+		host := startPlugin(t, responseConfig())
+		resp, got := sendExchange(host, [][2]string{{":path", "/"}}, origin)
+		if resp == nil || resp.StatusCode != 403 {
+			t.Fatalf("local response = %v, want 403", resp)
+		}
+		assertHeader(t, got, "content-type", "text/plain")
+		assertHeader(t, got, "x-content-type-options", "nosniff")
+		assertHeader(t, got, "strict-transport-security", "max-age=31536000")
+		assertNoHeader(t, got, headerAuthDecision)
+	})
+	t.Run("permissive invalid config", func(t *testing.T) {
+		host := startPlugin(t, map[string]any{"start_mode": startModePermissive})
+		resp, got := sendExchange(host, [][2]string{{":path", "/"}, {defaultDebugHeader, "1"}}, origin)
+		if resp == nil || string(resp.Data) != "denied: plugin config is invalid" {
+			t.Fatalf("local response = %v, want config denial", resp)
+		}
+		// The debug header is part of the config that failed to load.
+		assertNoHeader(t, got, headerAuthDecision)
+	})
+}
+
+func TestOnHttpResponseHeadersAddsMissing(t *testing.T) {
+	// Hosts may report a missing header instead of inserting it on replace.
+	stub(t, &replaceResponseHeader, func(string, string) error { return types.ErrorStatusNotFound })
+	host := startPlugin(t, responseConfig())
+	_, got := sendExchange(host, append(bearerHeaders(signClaims(nil)), [2]string{defaultDebugHeader, "1"}), [][2]string{{":status", "200"}})
+	assertHeader(t, got, "x-content-type-options", "nosniff")
+	assertHeader(t, got, "strict-transport-security", "max-age=31536000")
+	assertHeader(t, got, headerAuthDecision, "allow")
+}
+
+func TestOnHttpResponseHeadersSetFailureLogged(t *testing.T) {
+	stub(t, &replaceResponseHeader, func(string, string) error { return types.ErrorStatusBadArgument })
+	host := startPlugin(t, responseConfig())
+	_, got := sendExchange(host, bearerHeaders(signClaims(nil)), [][2]string{{":status", "200"}})
+	assertNoHeader(t, got, "x-content-type-options")
+	assertLogged(t, host.GetWarnLogs(), "set response header x-content-type-options failed")
+}
+
+func TestOnHttpResponseHeadersDebug(t *testing.T) {
+	tests := []struct {
+		name         string
+		debugHeader  string
+		headers      [][2]string
+		wantDecision string
+	}{
+		{name: "allow", headers: bearerHeaders(signClaims(nil)), wantDecision: "allow"},
+		{name: "anonymous", headers: [][2]string{{":method", "GET"}, {":path", "/healthz"}}, wantDecision: "anonymous"},
+		{name: "deny", headers: bearerHeaders("invalid"), wantDecision: "deny: token format is invalid"},
+		{name: "custom debug header", debugHeader: "X-Trace-Auth", headers: bearerHeaders(signClaims(nil)), wantDecision: "allow"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := responseConfig()
+			cfg.DebugHeader = tc.debugHeader
+			debug := defaultDebugHeader
+			if tc.debugHeader != "" {
+				debug = "x-trace-auth"
+			}
+			host := startPlugin(t, cfg)
+			_, got := sendExchange(host, append(tc.headers, [2]string{debug, "1"}), [][2]string{{":status", "200"}})
+			assertHeader(t, got, headerAuthDecision, tc.wantDecision)
+			latency, _ := headerValue(got, headerAuthLatency)
+			if _, err := strconv.ParseUint(latency, 10, 64); err != nil {
+				t.Errorf("%s = %q, want microseconds", headerAuthLatency, latency)
+			}
+		})
+	}
+	t.Run("other debug header ignored", func(t *testing.T) {
+		cfg := responseConfig()
+		cfg.DebugHeader = "x-trace-auth"
+		host := startPlugin(t, cfg)
+		_, got := sendExchange(host, append(bearerHeaders(signClaims(nil)), [2]string{defaultDebugHeader, "1"}), [][2]string{{":status", "200"}})
+		assertNoHeader(t, got, headerAuthDecision)
+		assertNoHeader(t, got, headerAuthLatency)
+	})
+}
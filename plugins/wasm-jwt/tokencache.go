@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify"
+)
+
+const (
+	defaultTokenCacheSize   = 1024
+	maxTokenCacheSize       = 1 << 16
+	defaultTokenCacheMaxTTL = 5 * time.Minute
+)
+
+// tokenCache maps SHA-256(token) to the verified subject in shared data, so
+// a bearer seen by any worker VM is not verified again until it expires.
+//
+// The cache is direct-mapped: a token hashes to one of size slots, and a
+// newer entry overwrites the slot. This bounds shared data to size keys
+// without a way to list or delete them. Writes use CAS; when another VM
+// wrote the slot concurrently its entry is kept.
+//
+// Entries record the key set they were verified with (the shared JWKS CAS,
+// 0 for static keys only), so a JWKS change invalidates them.
+type tokenCache struct {
+	prefix  string
+	size    uint32
+	maxTTL  time.Duration
+	leeway  time.Duration
+	metrics *metrics
+}
+
+// tokenCacheEntry is encoded as hash (32 bytes) | key set (uint32) |
+// valid-until unix seconds (int64) | subject.
+type tokenCacheEntry struct {
+	hash    [sha256.Size]byte
+	keySet  uint32
+	until   int64
+	subject string
+}
+
+const tokenCacheEntryHeaderSize = sha256.Size + 4 + 8
+
+func newTokenCache(rawConfig []byte, cfg rawConfig, m *metrics) (*tokenCache, error) {
+	size := defaultTokenCacheSize
+	if cfg.TokenCacheSize != nil {
+		size = *cfg.TokenCacheSize
+	}
+	if size < 0 || size > maxTokenCacheSize {
+		return nil, fmt.Errorf("token_cache_size must be between 0 and %d", maxTokenCacheSize)
+	}
+	if cfg.TokenCacheMaxTTLSeconds < 0 {
+		return nil, errors.New("token_cache_max_ttl_seconds must not be negative")
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	maxTTL := time.Duration(cfg.TokenCacheMaxTTLSeconds) * time.Second
+	if maxTTL == 0 {
+		maxTTL = defaultTokenCacheMaxTTL
+	}
+	// Plugins with different configs in one VM must not share entries.
+	sum := sha256.Sum256(rawConfig)
+	return &tokenCache{
+		prefix:  "wasm-jwt/tokens/" + hex.EncodeToString(sum[:6]) + "/",
+		size:    uint32(size),
+		maxTTL:  maxTTL,
+		leeway:  time.Duration(cfg.LeewaySeconds) * time.Second,
+		metrics: m,
+	}, nil
+}
+
+func (c *tokenCache) slotKey(hash [sha256.Size]byte) string {
+	return fmt.Sprintf("%s%d", c.prefix, binary.BigEndian.Uint32(hash[:4])%c.size)
+}
+
+// lookup returns the cached subject of token verified with keySet.
+func (c *tokenCache) lookup(token string, keySet uint32) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	hash := sha256.Sum256([]byte(token))
+	data, _, err := proxywasm.GetSharedData(c.slotKey(hash))
+	if err != nil {
+		if !errors.Is(err, types.ErrorStatusNotFound) {
+			proxywasm.LogWarnf("read token cache failed: %v", err)
+		}
+		c.metrics.cacheMiss()
+		return "", false
+	}
+	entry, ok := decodeTokenCacheEntry(data)
+	if !ok || entry.hash != hash || entry.keySet != keySet || now().Unix() >= entry.until {
+		c.metrics.cacheMiss()
+		return "", false
+	}
+	c.metrics.cacheHit()
+	return entry.subject, true
+}
+
+// store caches a verified token until it expires (including leeway), at
+// most for maxTTL.
+func (c *tokenCache) store(token string, keySet uint32, claims *jwtverify.Claims) {
+	if c == nil {
+		return
+	}
+	current := now().Truncate(time.Second)
+	until := current.Add(c.maxTTL)
+	if claims.ExpiresAt != nil {
+		if exp := claims.ExpiresAt.Add(c.leeway); exp.Before(until) {
+			until = exp
+		}
+	}
+	if !current.Before(until) {
+		return
+	}
+	hash := sha256.Sum256([]byte(token))
+	key := c.slotKey(hash)
+	_, cas, err := proxywasm.GetSharedData(key)
+	if err != nil && !errors.Is(err, types.ErrorStatusNotFound) {
+		proxywasm.LogWarnf("read token cache failed: %v", err)
+		return
+	}
+	entry := tokenCacheEntry{hash: hash, keySet: keySet, until: until.Unix(), subject: claims.Subject}
+	if err := proxywasm.SetSharedData(key, entry.encode(), cas); err != nil {
+		if errors.Is(err, types.ErrorStatusCasMismatch) {
+			c.metrics.cacheConflict()
+			return
+		}
+		proxywasm.LogWarnf("write token cache failed: %v", err)
+	}
+}
+
+func (e tokenCacheEntry) encode() []byte {
+	buf := make([]byte, tokenCacheEntryHeaderSize, tokenCacheEntryHeaderSize+len(e.subject))
+	copy(buf, e.hash[:])
+	binary.BigEndian.PutUint32(buf[sha256.Size:], e.keySet)
+	binary.BigEndian.PutUint64(buf[sha256.Size+4:], uint64(e.until))
+	return append(buf, e.subject...)
+}
+
+func decodeTokenCacheEntry(data []byte) (tokenCacheEntry, bool) {
+	if len(data) <= tokenCacheEntryHeaderSize {
+		return tokenCacheEntry{}, false
+	}
+	var e tokenCacheEntry
+	copy(e.hash[:], data)
+	e.keySet = binary.BigEndian.Uint32(data[sha256.Size:])
+	e.until = int64(binary.BigEndian.Uint64(data[sha256.Size+4:]))
+	e.subject = string(data[tokenCacheEntryHeaderSize:])
+	return e, true
+}
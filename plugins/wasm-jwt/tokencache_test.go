@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/proxy-wasm/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/winor30/gcp-service-extensions-playground/internal/jwtverify/jwtverifytest"
+)
+
+// setNow moves the plugin clock to jwtverifytest.Now+d.
+func setNow(d time.Duration) {
+	now = func() time.Time { return jwtverifytest.Now.Add(d) }
+}
+
+func assertCacheCounters(t *testing.T, host proxytest.HostEmulator, hits, misses uint64) {
+	t.Helper()
+	assertCounter(t, host, defaultMetricPrefix+"token_cache_hits_total", hits)
+	assertCounter(t, host, defaultMetricPrefix+"token_cache_misses_total", misses)
+}
+
+func TestTokenCacheHit(t *testing.T) {
+	host := startPlugin(t, testConfig())
+	token := signClaims(nil)
+
+	for range 3 {
+		action, resp, headers := sendRequest(host, bearerHeaders(token))
+		assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+	}
+	assertCacheCounters(t, host, 2, 1)
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	tests := []struct {
+		name     string
+		leeway   int
+		maxTTL   int
+		claims   map[string]any
+		hitAt    time.Duration
+		missAt   time.Duration
+		wantMiss string
+	}{
+		{
+			name:     "until exp",
+			claims:   map[string]any{"exp": jwtverifytest.Now.Add(30 * time.Second).Unix()},
+			hitAt:    29 * time.Second,
+			missAt:   30 * time.Second,
+			wantMiss: "token is expired",
+		},
+		{
+			name:     "until exp plus leeway",
+			leeway:   60,
+			claims:   map[string]any{"exp": jwtverifytest.Now.Add(-10 * time.Second).Unix()},
+			hitAt:    49 * time.Second,
+			missAt:   50 * time.Second,
+			wantMiss: "token is expired",
+		},
+		{
+			name:   "max ttl without exp",
+			maxTTL: 10,
+			claims: map[string]any{"exp": nil},
+			hitAt:  9 * time.Second,
+			missAt: 10 * time.Second,
+		},
+		{
+			name:   "max ttl before exp",
+			maxTTL: 10,
+			hitAt:  9 * time.Second,
+			missAt: 10 * time.Second,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.LeewaySeconds = tc.leeway
+			cfg.TokenCacheMaxTTLSeconds = tc.maxTTL
+			host := startPlugin(t, cfg)
+			token := signClaims(tc.claims)
+
+			action, resp, headers := sendRequest(host, bearerHeaders(token))
+			assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+
+			setNow(tc.hitAt)
+			action, resp, headers = sendRequest(host, bearerHeaders(token))
+			assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+			assertCacheCounters(t, host, 1, 1)
+
+			setNow(tc.missAt)
+			action, resp, headers = sendRequest(host, bearerHeaders(token))
+			if tc.wantMiss != "" {
+				assertDenied(t, action, resp, 403, "denied: "+tc.wantMiss)
+			} else {
+				assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+			}
+			assertCacheCounters(t, host, 1, 2)
+		})
+	}
+}
+
+func TestTokenCacheDeniedTokensAreNotCached(t *testing.T) {
+	host := startPlugin(t, testConfig())
+	token := signClaims(map[string]any{"nbf": jwtverifytest.Now.Add(time.Minute).Unix()})
+
+	for range 2 {
+		action, resp, _ := sendRequest(host, bearerHeaders(token))
+		assertDenied(t, action, resp, 403, "denied: token is not valid yet")
+	}
+	assertCacheCounters(t, host, 0, 2)
+}
+
+func TestTokenCacheBounded(t *testing.T) {
+	cfg := testConfig()
+	cfg.TokenCacheSize = ptr(1)
+	host := startPlugin(t, cfg)
+	first := signClaims(nil)
+	second := signClaims(map[string]any{"jti": "second"})
+
+	// With one slot the second token evicts the first.
+	sendRequest(host, bearerHeaders(first))
+	sendRequest(host, bearerHeaders(second))
+	sendRequest(host, bearerHeaders(second))
+	sendRequest(host, bearerHeaders(first))
+	assertCacheCounters(t, host, 1, 3)
+}
+
+func TestTokenCacheDisabled(t *testing.T) {
+	cfg := testConfig()
+	cfg.TokenCacheSize = ptr(0)
+	host := startPlugin(t, cfg)
+	token := signClaims(nil)
+
+	for range 2 {
+		action, resp, headers := sendRequest(host, bearerHeaders(token))
+		assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+	}
+	assertCacheCounters(t, host, 0, 0)
+}
+
+func TestTokenCacheSharedAcrossVMs(t *testing.T) {
+	cfg := testConfig()
+	raw := mustMarshal(t, cfg)
+	host := newHost(t, raw)
+	if status := host.StartPlugin(); status != types.OnPluginStartStatusOK {
+		t.Fatalf("StartPlugin() = %v", status)
+	}
+
+	// Another worker VM verified the token and stored its entry.
+	token := signClaims(nil)
+	cache, err := newTokenCache(raw, cfg, nil)
+	if err != nil {
+		t.Fatalf("newTokenCache() error = %v", err)
+	}
+	hash := sha256.Sum256([]byte(token))
+	entry := tokenCacheEntry{hash: hash, until: jwtverifytest.Now.Add(time.Minute).Unix(), subject: "cached-user"}
+	if err := proxywasm.SetSharedData(cache.slotKey(hash), entry.encode(), 0); err != nil {
+		t.Fatalf("SetSharedData() error = %v", err)
+	}
+
+	action, resp, headers := sendRequest(host, bearerHeaders(token))
+	assertAllowed(t, action, resp, headers, "cached-user")
+	assertCacheCounters(t, host, 1, 0)
+}
+
+func TestTokenCacheInvalidatedByJWKSChange(t *testing.T) {
+	host := startPlugin(t, remoteConfig())
+	respondJWKS(t, host, "200", fixtureJWKS(t))
+	token := signClaims(nil)
+
+	sendRequest(host, bearerHeaders(token))
+	sendRequest(host, bearerHeaders(token))
+	assertCacheCounters(t, host, 1, 1)
+
+	// A refresh returning the same key set keeps the entries.
+	host.Tick()
+	respondJWKS(t, host, "200", fixtureJWKS(t))
+	sendRequest(host, bearerHeaders(token))
+	assertCacheCounters(t, host, 2, 1)
+
+	// A changed key set invalidates them.
+	host.Tick()
+	respondJWKS(t, host, "200", jwksBody(t, publicJWK(&jwtverifytest.PrivateKey().PublicKey, "renamed")))
+	action, resp, headers := sendRequest(host, bearerHeaders(token))
+	assertAllowed(t, action, resp, headers, jwtverifytest.Subject)
+	assertCacheCounters(t, host, 2, 2)
+}